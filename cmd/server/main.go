@@ -1,29 +1,284 @@
 package main
 
 import (
+	"flag"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/radisvaliullin/test_task_17/internal/server"
+	"github.com/radisvaliullin/test_task_17/record"
 )
 
 func main() {
 
+	// flags
+	udpAddr := flag.String("udp", "", "UDP listener address of device datagrams, e.g. :1337 (disabled if empty)")
+	rateLimit := flag.Float64("rate-limit", 0, "device reading rate limit, messages per second (disabled if zero)")
+	rateBurst := flag.Int("rate-burst", 50, "device reading rate limit burst, max messages at once")
+	ratePolicy := flag.String("rate-policy", "drop", "action on exceeded rate limit (drop, disconnect)")
+	quarPath := flag.String("quarantine", "", "quarantine output file of invalid readings (disabled if empty)")
+	invalidRatio := flag.Float64("invalid-ratio", 0, "max ratio of invalid device readings (disabled if zero)")
+	invalidMin := flag.Int("invalid-min", 100, "min device readings before checking invalid ratio")
+	rejectSubnormal := flag.Bool("reject-subnormal", false, "reject readings with subnormal numbers")
+	rejectNegZero := flag.Bool("reject-neg-zero", false, "reject readings with negative zero")
+	profilesPath := flag.String("profiles", "", "validation profiles file (JSON), limits by spec if empty")
+	calibPath := flag.String("calibration", "calibration.json", "calibrations file of devices (not persisted if empty)")
+	rollupsPath := flag.String("rollups", "", "rollups output file of closed rollup buckets (disabled if empty)")
+	anomalyThreshold := flag.Float64("anomaly-threshold", 0, "z-score of temperature, altitude anomaly of device, e.g. 4 (detection disabled if zero)")
+	anomalyWarmup := flag.Int("anomaly-warmup", 30, "device readings before anomaly detection")
+	anomalySmoothing := flag.Float64("anomaly-smoothing", 0.05, "smoothing factor (0-1) of anomaly baseline, weight of new reading")
+	anomaliesPath := flag.String("anomalies", "", "anomaly events output file (disabled if empty)")
+	stuckWindow := flag.Duration("stuck-window", 0, "window of unchanged readings of stuck sensor, e.g. 10m (detection disabled if zero)")
+	stuckTolerance := flag.Float64("stuck-tolerance", 0, "max change of near-identical values of stuck sensor")
+	stuckFields := flag.String("stuck-fields", "", "checked fields of stuck sensor, comma-separated, e.g. Temp,Alt (all fields if empty)")
+	stuckSuppress := flag.Bool("stuck-suppress", false, "suppress output of device with all checked fields stuck until values change")
+	stuckPath := flag.String("stuck-events", "", "stuck sensor events output file (disabled if empty)")
+	movement := flag.Bool("movement", false, "GPS movement tracking of devices: speed, heading, moving or stationary")
+	moveMinDistance := flag.Float64("move-min-distance", 10, "min distance of movement, m (GPS jitter within it ignored)")
+	moveStartSpeed := flag.Float64("move-start-speed", 1, "speed of moving device, m/s")
+	moveStopSpeed := flag.Float64("move-stop-speed", 0.3, "speed of stationary device, m/s")
+	moveMaxSpeed := flag.Float64("move-max-speed", 100, "max plausible speed, m/s (faster position change is jump)")
+	moveRejectJumps := flag.Bool("move-reject-jumps", false, "reject readings of position jumps as invalid")
+	moveColumns := flag.Bool("move-columns", false, "append speed, heading, moving columns to output records")
+	historySize := flag.Int("history", 0, "readings kept in history of each device for export, e.g. 12000 (disabled if zero)")
+	historyDevices := flag.Int("history-devices", 1000, "max devices with history, least recently updated dropped (unlimited if zero)")
+	historyIdle := flag.Duration("history-idle", time.Hour*24, "history of device not updated within idle time dropped (kept if zero)")
+	outFormat := flag.String("output", "csv", "output records format (csv, ndjson, binary, influx)")
+	outTime := flag.String("output-time", "server", "time of output records (server, device)")
+	tsMaxFuture := flag.Duration("ts-max-future", time.Minute, "reject device time ahead of server time (disabled if zero)")
+	tsMaxAge := flag.Duration("ts-max-age", time.Hour*24, "reject device time behind server time (disabled if zero)")
+	outDir := flag.String("out-dir", "", "output records directory of rotating files (stdout if empty)")
+	outMaxSize := flag.Int64("out-max-size", 100<<20, "rotate output file exceeded size, bytes (disabled if zero)")
+	outInterval := flag.Duration("out-interval", 0, "rotate output file at interval, e.g. 1h (disabled if zero)")
+	outCompress := flag.Bool("out-compress", true, "gzip rotated output files")
+	outMaxFiles := flag.Int("out-max-files", 0, "max number of kept rotated output files (unlimited if zero)")
+	outMaxAge := flag.Duration("out-max-age", 0, "max age of kept rotated output files (unlimited if zero)")
+	webhookURL := flag.String("webhook", "", "webhook URL of valid readings batches (disabled if empty)")
+	webhookSecret := flag.String("webhook-secret", "", "webhook HMAC-SHA256 signature secret (not signed if empty)")
+	webhookHeaders := flag.String("webhook-headers", "", "webhook request headers, comma-separated Name=value")
+	webhookBatch := flag.Int("webhook-batch", 100, "webhook batch max readings")
+	webhookSpool := flag.String("webhook-spool", "webhook-spool", "webhook spool directory of pending batches")
+	webhookMaxSpool := flag.Int("webhook-max-spool", 10000, "webhook max spooled batches, oldest dropped")
+	relayAddr := flag.String("relay", "", "upstream server address to relay valid readings (disabled if empty)")
+	relayBuffer := flag.Int("relay-buffer", 100000, "max buffered readings of relay during upstream outage")
+	relayAccept := flag.Bool("relay-accept", false, "accept relay links of edge servers")
+	nodeID := flag.String("node-id", "", "cluster node id (advertise address if empty)")
+	clusterAdvertise := flag.String("cluster-advertise", "", "HTTP address of node reachable by cluster nodes (clustering disabled if empty)")
+	bansPath := flag.String("bans", "bans.json", "bans file of devices (not persisted if empty)")
+	auditPath := flag.String("audit", "", "audit log file of admin actions (disabled if empty)")
+	apiKeysPath := flag.String("api-keys", "", "API keys file of HTTP API, reloaded if changed (authentication disabled if empty)")
+	ipBanFailures := flag.Int("ipban-failures", 0, "failed device logins of IP in window to ban IP (disabled if zero)")
+	ipBanWindow := flag.Duration("ipban-window", time.Minute, "sliding window of failed device logins of IP")
+	ipBanTime := flag.Duration("ipban-time", time.Minute, "ban time of IP, doubled each next ban")
+	ipBanAllow := flag.String("ipban-allow", "", "trusted IPs, CIDRs never banned, comma-separated")
+	clusterPeers := flag.String("cluster-peers", "", "HTTP addresses of cluster seed nodes, comma-separated")
+	flag.Parse()
+
 	// config init server
 	log.Print("server init")
 
+	// output records format
+	format, err := record.ParseFormat(*outFormat)
+	if err != nil {
+		log.Fatalf("output format err: %v", err)
+	}
+
+	// rate limit policy
+	policy := server.RatePolicy(*ratePolicy)
+	if policy != server.RateDrop && policy != server.RateDisconnect {
+		log.Fatalf("rate policy err: unknown policy %q", *ratePolicy)
+	}
+
+	// output records time
+	timeSource := server.TimeSource(*outTime)
+	if timeSource != server.TimeServer && timeSource != server.TimeDevice {
+		log.Fatalf("output time err: unknown time source %q", *outTime)
+	}
+
 	// stdout logger (for logging server reading messages)
 	outLog := log.New(os.Stdout, "", 0)
+	// rotating files output, reopened on SIGHUP (logrotate)
+	if *outDir != "" {
+		sink, err := server.NewFileSink(server.FileSinkConfig{
+			Dir: *outDir, MaxSize: *outMaxSize, Interval: *outInterval,
+			Compress: *outCompress, MaxFiles: *outMaxFiles, MaxAge: *outMaxAge,
+		})
+		if err != nil {
+			log.Fatalf("output file sink init err: %v", err)
+		}
+		defer sink.Close()
+		outLog = log.New(sink, "", 0)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Print("output file sink reopen")
+				if err := sink.Reopen(); err != nil {
+					log.Printf("output file sink reopen err: %v", err)
+				}
+			}
+		}()
+	}
+
+	// quarantine output (for logging invalid reading messages)
+	var quarantine io.Writer
+	if *quarPath != "" {
+		f, err := os.OpenFile(*quarPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("quarantine file open err: %v", err)
+		}
+		defer f.Close()
+		quarantine = f
+	}
+
+	// rollups output (for logging closed rollup buckets)
+	var rollupOut io.Writer
+	if *rollupsPath != "" {
+		f, err := os.OpenFile(*rollupsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("rollups file open err: %v", err)
+		}
+		defer f.Close()
+		rollupOut = f
+	}
+
+	// anomaly detection, anomaly events output
+	var anomaly *server.AnomalyConfig
+	if *anomalyThreshold > 0 {
+		anomaly = &server.AnomalyConfig{Threshold: *anomalyThreshold, Warmup: *anomalyWarmup, Smoothing: *anomalySmoothing}
+	}
+	var anomalyOut io.Writer
+	if *anomaliesPath != "" {
+		f, err := os.OpenFile(*anomaliesPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("anomalies file open err: %v", err)
+		}
+		defer f.Close()
+		anomalyOut = f
+	}
+
+	// stuck sensor detection, stuck sensor events output
+	var stuck *server.StuckConfig
+	if *stuckWindow > 0 {
+		stuck = &server.StuckConfig{Window: *stuckWindow, Tolerance: *stuckTolerance, Suppress: *stuckSuppress}
+		for _, f := range strings.Split(*stuckFields, ",") {
+			if f != "" {
+				stuck.Fields = append(stuck.Fields, f)
+			}
+		}
+	}
+	var stuckOut io.Writer
+	if *stuckPath != "" {
+		f, err := os.OpenFile(*stuckPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("stuck events file open err: %v", err)
+		}
+		defer f.Close()
+		stuckOut = f
+	}
+
+	// movement tracking
+	var move *server.MovementConfig
+	if *movement {
+		move = &server.MovementConfig{
+			MinDistance: *moveMinDistance, StartSpeed: *moveStartSpeed, StopSpeed: *moveStopSpeed,
+			MaxSpeed: *moveMaxSpeed, RejectJumps: *moveRejectJumps, Columns: *moveColumns,
+		}
+	}
+
+	// audit log of admin actions
+	var audit io.Writer
+	if *auditPath != "" {
+		f, err := os.OpenFile(*auditPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("audit file open err: %v", err)
+		}
+		defer f.Close()
+		audit = f
+	}
+	// admin token (admin endpoints disabled if empty and API keys not set)
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" && *apiKeysPath == "" {
+		log.Print("admin token not set (ADMIN_TOKEN), admin endpoints disabled")
+	}
+
+	// validation profiles
+	var profiles *server.Profiles
+	if *profilesPath != "" {
+		var err error
+		profiles, err = server.LoadProfiles(*profilesPath)
+		if err != nil {
+			log.Fatalf("validation profiles load err: %v", err)
+		}
+	}
+
+	// webhook output
+	var webhook *server.WebhookConfig
+	if *webhookURL != "" {
+		webhook = &server.WebhookConfig{
+			URL: *webhookURL, Secret: *webhookSecret, Headers: make(map[string]string),
+			BatchSize: *webhookBatch, SpoolDir: *webhookSpool, MaxSpool: *webhookMaxSpool,
+		}
+		for _, h := range strings.Split(*webhookHeaders, ",") {
+			if kv := strings.SplitN(h, "=", 2); len(kv) == 2 {
+				webhook.Headers[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	// relay to upstream
+	var relay *server.RelayConfig
+	if *relayAddr != "" {
+		relay = &server.RelayConfig{Addr: *relayAddr, Buffer: *relayBuffer, Key: os.Getenv("RELAY_KEY")}
+	}
+
+	// IP bans
+	var ipBan *server.IPBanConfig
+	if *ipBanFailures > 0 {
+		ipBan = &server.IPBanConfig{MaxFailures: *ipBanFailures, Window: *ipBanWindow, BanTime: *ipBanTime}
+		for _, a := range strings.Split(*ipBanAllow, ",") {
+			if a != "" {
+				ipBan.Allow = append(ipBan.Allow, a)
+			}
+		}
+	}
+
+	// cluster
+	var cluster *server.ClusterConfig
+	if *clusterAdvertise != "" {
+		cluster = &server.ClusterConfig{NodeID: *nodeID, Advertise: *clusterAdvertise, Key: os.Getenv("CLUSTER_KEY")}
+		for _, peer := range strings.Split(*clusterPeers, ",") {
+			if peer != "" {
+				cluster.Peers = append(cluster.Peers, peer)
+			}
+		}
+	}
 
 	// new server init
 	s := server.New(server.Config{
-		Addr: ":1337", HTTPAddr: ":1338", LoginDeadline: time.Second, MsgDeadline: time.Second * 2},
+		Addr: ":1337", HTTPAddr: ":1338", UDPAddr: *udpAddr, LoginDeadline: time.Second, MsgDeadline: time.Second * 2,
+		RateLimit: *rateLimit, RateBurst: *rateBurst, RatePolicy: policy,
+		InvalidRatio: *invalidRatio, InvalidMinMessages: *invalidMin, Quarantine: quarantine,
+		RejectSubnormal: *rejectSubnormal, RejectNegZero: *rejectNegZero, Profiles: profiles,
+		CalibrationFile: *calibPath, RollupOut: rollupOut, Anomaly: anomaly, AnomalyOut: anomalyOut,
+		Stuck: stuck, StuckOut: stuckOut, Movement: move,
+		HistorySize: *historySize, HistoryDevices: *historyDevices, HistoryIdle: *historyIdle,
+		OutputFormat: format, Webhook: webhook,
+		OutputTime: timeSource, TimestampMaxFuture: *tsMaxFuture, TimestampMaxAge: *tsMaxAge,
+		Relay: relay, RelayAccept: *relayAccept, RelayKey: os.Getenv("RELAY_KEY"), Cluster: cluster,
+		AdminToken: adminToken, BansFile: *bansPath, AuditLog: audit, IPBan: ipBan,
+		APIKeysFile: *apiKeysPath},
 		outLog,
 	)
 
 	log.Print("server starting")
-	err := s.Start()
+	err = s.Start()
 	if err != nil {
 		log.Fatalf("server starting err: %v", err)
 	}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// admin actions of audit log
+const (
+	adminDisconnect = "disconnect"
+	adminBan        = "ban"
+	adminUnban      = "unban"
+	adminMute       = "mute"
+	adminUnmute     = "unmute"
+)
+
+// deviceRestriction ban or mute of device
+type deviceRestriction struct {
+	// until time (unix nano), permanent if zero
+	Until   int64  `json:"until,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Created int64  `json:"created"`
+}
+
+// active if restriction set and not expired at time now
+func (r *deviceRestriction) active(now int64) bool {
+	return r != nil && (r.Until == 0 || now < r.Until)
+}
+
+// restrictionRequest ban or mute request (JSON), duration e.g. "1h" (permanent if empty)
+type restrictionRequest struct {
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// restriction returns restriction of request created at time now
+func (rr *restrictionRequest) restriction(now int64) (*deviceRestriction, error) {
+	r := &deviceRestriction{Reason: rr.Reason, Created: now}
+	if rr.Duration != "" {
+		d, err := time.ParseDuration(rr.Duration)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("duration should be positive")
+		}
+		r.Until = now + int64(d)
+	}
+	return r, nil
+}
+
+// deviceAdmin admin state of device (JSON)
+type deviceAdmin struct {
+	IMEI   string             `json:"imei"`
+	Online bool               `json:"online"`
+	Ban    *deviceRestriction `json:"ban,omitempty"`
+	Mute   *deviceRestriction `json:"mute,omitempty"`
+}
+
+// auditRecord admin action record of audit log (NDJSON)
+type auditRecord struct {
+	Time       int64  `json:"time"`
+	Action     string `json:"action"`
+	IMEI       string `json:"imei"`
+	RemoteAddr string `json:"remote_addr"`
+	Until      int64  `json:"until,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// banStore bans of devices by IMEI, persisted to file if path set
+type banStore struct {
+	mux  sync.RWMutex
+	bans map[string]*deviceRestriction
+
+	path string
+}
+
+// inits ban store, loads bans from file if path set
+func newBanStore(path string) *banStore {
+	bs := &banStore{
+		bans: make(map[string]*deviceRestriction),
+		path: path,
+	}
+	if path == "" {
+		return bs
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bs
+	} else if err != nil {
+		log.Printf("bans file read err: %v", err)
+		return bs
+	}
+	if err := json.Unmarshal(b, &bs.bans); err != nil {
+		log.Printf("bans file unmarshal err: %v", err)
+		return bs
+	}
+	log.Printf("bans of %v devices loaded", len(bs.bans))
+	return bs
+}
+
+// banned returns ban of device active at time now
+func (bs *banStore) banned(imei string, now int64) (deviceRestriction, bool) {
+	bs.mux.RLock()
+	defer bs.mux.RUnlock()
+	b, ok := bs.bans[imei]
+	if !ok || !b.active(now) {
+		return deviceRestriction{}, false
+	}
+	return *b, true
+}
+
+// ban bans device (replaces previous ban), expired bans are removed (not banned if save failed)
+func (bs *banStore) ban(imei string, b *deviceRestriction) error {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+	old := make(map[string]*deviceRestriction, len(bs.bans))
+	for i, ob := range bs.bans {
+		old[i] = ob
+		if !ob.active(b.Created) {
+			delete(bs.bans, i)
+		}
+	}
+	bs.bans[imei] = b
+	if err := bs.save(); err != nil {
+		// rollback
+		bs.bans = old
+		return err
+	}
+	return nil
+}
+
+// unban removes ban of device, returns false if device not banned (not removed if save failed)
+func (bs *banStore) unban(imei string) (bool, error) {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+	b, ok := bs.bans[imei]
+	if !ok {
+		return false, nil
+	}
+	delete(bs.bans, imei)
+	if err := bs.save(); err != nil {
+		// rollback
+		bs.bans[imei] = b
+		return true, err
+	}
+	return true, nil
+}
+
+// save saves bans to file (should be called under lock)
+func (bs *banStore) save() error {
+	if bs.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(bs.bans)
+	if err != nil {
+		return err
+	}
+	tmp := bs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bs.path)
+}
+
+// adminAuthorized checks admin token of request (Authorization: Bearer <token>), responds 401
+// if not authorized (authenticated by API keys of admin scope if keys set), admin endpoints
+// are disabled (503) if neither token nor API keys set
+func (s *Server) adminAuthorized(w http.ResponseWriter, req *http.Request) bool {
+	if s.keys != nil {
+		return true
+	}
+	if s.conf.AdminToken == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if _, err := w.Write([]byte("503 Admin Endpoints Disabled")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(s.conf.AdminToken)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	if _, err := w.Write([]byte("401 Unauthorized")); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+	return false
+}
+
+// audit logs admin action to audit log
+func (s *Server) audit(req *http.Request, action, imei string, r *deviceRestriction) {
+	ar := auditRecord{Time: time.Now().UnixNano(), Action: action, IMEI: imei, RemoteAddr: req.RemoteAddr}
+	if r != nil {
+		ar.Until, ar.Reason = r.Until, r.Reason
+	}
+	log.Printf("admin, raddr - %v, imei - %v, %v", req.RemoteAddr, imei, action)
+	if s.auditLog == nil {
+		return
+	}
+	b, err := json.Marshal(&ar)
+	if err != nil {
+		log.Printf("admin, audit record marshal err: %v", err)
+		return
+	}
+	s.auditLog.Printf("%s", b)
+}
+
+// deviceAdmin returns admin state of device
+func (s *Server) deviceAdmin(imei string, now int64) *deviceAdmin {
+	da := &deviceAdmin{IMEI: imei}
+	_, da.Online = s.devStor.ok(imei)
+	if b, ok := s.pipe.bans.banned(imei, now); ok {
+		da.Ban = &b
+	}
+	if ds, ok := s.pipe.devs.lookup(imei); ok {
+		ds.mux.Lock()
+		if ds.mute.active(now) {
+			m := *ds.mute
+			da.Mute = &m
+		}
+		ds.mux.Unlock()
+	}
+	return da
+}
+
+// adminDevices manages devices, path /admin/devices/:imei[/:action] (admin token required):
+// GET returns ban and mute of device, POST disconnect closes device connection,
+// POST ban bans device (device disconnected, login rejected), POST mute suppresses output of device,
+// DELETE ban, mute removes ban, mute
+func (s *Server) adminDevices(w http.ResponseWriter, req *http.Request) {
+	if !s.adminAuthorized(w, req) {
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/admin/devices/"), "/")
+	imei, err := validParseIMEIString(path[0])
+	if err != nil || len(path) > 2 {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	var action string
+	if len(path) == 2 {
+		action = path[1]
+	}
+
+	// allowed methods of action
+	var allow []string
+	switch action {
+	case "":
+		allow = []string{http.MethodGet}
+	case adminDisconnect:
+		allow = []string{http.MethodPost}
+	case adminBan, adminMute:
+		allow = []string{http.MethodPost, http.MethodDelete}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	allowed := false
+	for _, m := range allow {
+		allowed = allowed || req.Method == m
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		if _, err := w.Write([]byte("405 Method Not Allowed")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// ban, mute restriction
+	now := time.Now().UnixNano()
+	var r *deviceRestriction
+	if req.Method == http.MethodPost && (action == adminBan || action == adminMute) {
+		rr := restrictionRequest{}
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<16)).Decode(&rr)
+		if err == nil {
+			r, err = rr.restriction(now)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte("400 Bad Request: " + err.Error())); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+	}
+
+	found, saveErr := true, error(nil)
+	switch {
+	case action == adminDisconnect:
+		found = s.devStor.disconnect(imei)
+		if found {
+			s.audit(req, adminDisconnect, imei, nil)
+		}
+	case action == adminBan && req.Method == http.MethodPost:
+		if saveErr = s.pipe.bans.ban(imei, r); saveErr == nil {
+			s.devStor.disconnect(imei)
+			s.audit(req, adminBan, imei, r)
+		}
+	case action == adminBan:
+		found, saveErr = s.pipe.bans.unban(imei)
+		if found && saveErr == nil {
+			s.audit(req, adminUnban, imei, nil)
+		}
+	case action == adminMute && req.Method == http.MethodPost:
+		ds := s.pipe.devs.get(imei)
+		ds.mux.Lock()
+		ds.mute = r
+		ds.mux.Unlock()
+		s.audit(req, adminMute, imei, r)
+	case action == adminMute:
+		ds, ok := s.pipe.devs.lookup(imei)
+		if ok {
+			ds.mux.Lock()
+			ok = ds.mute.active(now)
+			ds.mute = nil
+			ds.mux.Unlock()
+		}
+		found = ok
+		if found {
+			s.audit(req, adminUnmute, imei, nil)
+		}
+	}
+	if saveErr != nil {
+		log.Printf("admin, imei - %v, bans save err: %v", imei, saveErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Ban Not Saved")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// response
+	out, err := json.Marshal(s.deviceAdmin(imei, now))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminRequest serves admin request with token, returns response
+func testAdminRequest(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	s.httpHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+// testLoginClosed returns whether device connection closed by server after login
+func testLoginClosed(t *testing.T, addr string, login []byte) bool {
+	conn, err := dialLogin(addr, login)
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(testFrame(readingMessage{Temp: 1, BattLev: 1})); err != nil {
+		return true
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = conn.Read(make([]byte, 1))
+	// closed (EOF or reset), not read timeout
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func Test_Server_adminDevices(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bansPath := filepath.Join(dir, "bans.json")
+	var audit bytes.Buffer
+	s := New(Config{
+		Addr: "127.0.0.1:0", LoginDeadline: time.Second, MsgDeadline: time.Second,
+		AdminToken: "secret", BansFile: bansPath, AuditLog: &audit,
+	}, testOutLog)
+	if err := s.Start(); err != nil {
+		t.Fatalf("server start err: %v", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	addr := s.ln.Addr().String()
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+	}{
+		// Positive
+		{name: "get device", method: "GET", path: "/admin/devices/490154203237518", token: "secret", code: http.StatusOK},
+		{name: "mute", method: "POST", path: "/admin/devices/490154203237518/mute", token: "secret", body: `{"duration":"1h"}`, code: http.StatusOK},
+		{name: "unmute", method: "DELETE", path: "/admin/devices/490154203237518/mute", token: "secret", code: http.StatusOK},
+		{name: "calibration with token", method: "GET", path: "/admin/calibration/490154203237518", token: "secret", code: http.StatusOK},
+		// Negative
+		{name: "no token", method: "GET", path: "/admin/devices/490154203237518", code: http.StatusUnauthorized},
+		{name: "wrong token", method: "POST", path: "/admin/devices/490154203237518/disconnect", token: "wrong", code: http.StatusUnauthorized},
+		{name: "calibration without token", method: "GET", path: "/admin/calibration/490154203237518", code: http.StatusUnauthorized},
+		{name: "disconnect offline device", method: "POST", path: "/admin/devices/490154203237518/disconnect", token: "secret", code: http.StatusNotFound},
+		{name: "unmute not muted", method: "DELETE", path: "/admin/devices/490154203237518/mute", token: "secret", code: http.StatusNotFound},
+		{name: "unban not banned", method: "DELETE", path: "/admin/devices/490154203237518/ban", token: "secret", code: http.StatusNotFound},
+		{name: "wrong duration", method: "POST", path: "/admin/devices/490154203237518/ban", token: "secret", body: `{"duration":"-1h"}`, code: http.StatusBadRequest},
+		{name: "unknown action", method: "POST", path: "/admin/devices/490154203237518/reboot", token: "secret", code: http.StatusNotFound},
+		{name: "invalid imei", method: "GET", path: "/admin/devices/490154203237519", token: "secret", code: http.StatusNotFound},
+		{name: "wrong method", method: "GET", path: "/admin/devices/490154203237518/disconnect", token: "secret", code: http.StatusMethodNotAllowed},
+		{name: "partial method", method: "POS", path: "/admin/devices/490154203237518/ban", token: "secret", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+
+		if rec := testAdminRequest(s, tc.method, tc.path, tc.token, tc.body); rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v", tc.name, tc.code, rec.Code)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// token without Bearer prefix
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/devices/490154203237518", nil)
+	req.Header.Set("Authorization", "secret")
+	s.httpHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token without Bearer prefix: expected code %v, got %v", http.StatusUnauthorized, rec.Code)
+	}
+
+	// disconnect connected device
+	conn, err := dialLogin(addr, testIMEI)
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+	testClusterWait(t, "device online", func() bool {
+		_, ok := s.devStor.ok("490154203237518")
+		return ok
+	})
+	if rec := testAdminRequest(s, "POST", "/admin/devices/490154203237518/disconnect", "secret", ""); rec.Code != http.StatusOK {
+		t.Fatalf("disconnect: expected code %v, got %v", http.StatusOK, rec.Code)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("device should be disconnected, got %v", err)
+	}
+
+	// banned device login rejected, ban persisted
+	rec = testAdminRequest(s, "POST", "/admin/devices/490154203237518/ban", "secret", `{"reason":"flooding"}`)
+	da := deviceAdmin{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &da); err != nil || da.Ban == nil || da.Ban.Until != 0 || da.Ban.Reason != "flooding" {
+		t.Fatalf("wrong ban response %s, %v", rec.Body.Bytes(), err)
+	}
+	if !testLoginClosed(t, addr, testIMEI) {
+		t.Fatalf("banned device login should be rejected")
+	}
+	if b, ok := newBanStore(bansPath).banned("490154203237518", time.Now().UnixNano()); !ok || b.Reason != "flooding" {
+		t.Fatalf("ban should be persisted, got %+v", b)
+	}
+	if rec := testAdminRequest(s, "DELETE", "/admin/devices/490154203237518/ban", "secret", ""); rec.Code != http.StatusOK {
+		t.Fatalf("unban: expected code %v, got %v", http.StatusOK, rec.Code)
+	}
+	if testLoginClosed(t, addr, testIMEI) {
+		t.Fatalf("unbanned device login should be accepted")
+	}
+
+	// expired ban
+	s.pipe.bans.ban("490154203237518", &deviceRestriction{Until: 1, Created: 0})
+	if _, ok := s.pipe.bans.banned("490154203237518", time.Now().UnixNano()); ok {
+		t.Fatalf("expired ban should not be active")
+	}
+
+	// audit log
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		ar := auditRecord{}
+		if err := json.Unmarshal([]byte(line), &ar); err != nil || ar.IMEI != "490154203237518" || ar.Time == 0 {
+			t.Fatalf("wrong audit record %q, %v", line, err)
+		}
+		actions = append(actions, ar.Action)
+	}
+	if strings.Join(actions, ",") != "mute,unmute,disconnect,ban,unban" {
+		t.Fatalf("wrong audit actions %v", actions)
+	}
+}
+
+func Test_Server_adminDevices_Disabled(t *testing.T) {
+
+	// neither admin token nor API keys set
+	s := New(Config{}, testOutLog)
+	for _, path := range []string{"/admin/devices/490154203237518", "/admin/calibration/490154203237518", "/admin/ipbans"} {
+		if rec := testAdminRequest(s, "GET", path, "", ""); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%v: expected code %v, got %v", path, http.StatusServiceUnavailable, rec.Code)
+		}
+	}
+}
+
+func Test_Server_adminDevices_SaveErr(t *testing.T) {
+
+	// bans file of not existing directory
+	s := New(Config{AdminToken: "secret", BansFile: filepath.Join(os.TempDir(), "not-exists", "bans.json")}, testOutLog)
+	if rec := testAdminRequest(s, "POST", "/admin/devices/490154203237518/ban", "secret", `{}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("ban: expected code %v, got %v", http.StatusInternalServerError, rec.Code)
+	}
+	if _, ok := s.pipe.bans.banned("490154203237518", time.Now().UnixNano()); ok {
+		t.Fatalf("not saved ban should be rolled back")
+	}
+
+	s.pipe.bans.bans["490154203237518"] = &deviceRestriction{}
+	if rec := testAdminRequest(s, "DELETE", "/admin/devices/490154203237518/ban", "secret", ""); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("unban: expected code %v, got %v", http.StatusInternalServerError, rec.Code)
+	}
+	if _, ok := s.pipe.bans.banned("490154203237518", time.Now().UnixNano()); !ok {
+		t.Fatalf("not saved unban should be rolled back")
+	}
+}
+
+func Test_pipeline_mute(t *testing.T) {
+
+	var out bytes.Buffer
+	p := newPipeline(log.New(&out, "", 0), newServerStats())
+	p.historySize = 10
+	ds := p.devs.get("490154203237518")
+	ds.mute = &deviceRestriction{Until: 3}
+	for now := int64(1); now <= 4; now++ {
+		if !p.reading(now, ds, testFrame(readingMessage{Temp: 1, BattLev: 1}), &decodedReading{}) {
+			t.Fatalf("muted reading should be valid")
+		}
+	}
+	// output suppressed until mute expired, history kept
+	if !strings.HasPrefix(out.String(), "3,") || strings.Count(out.String(), "\n") != 2 {
+		t.Fatalf("muted readings should not be output, got %q", out.String())
+	}
+	if hrs := p.history("490154203237518", 0, 10); len(hrs) != 4 {
+		t.Fatalf("muted readings should be kept in history, got %v", len(hrs))
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// anomaly detection defaults
+const (
+	anomalyThreshold = 4.0
+	anomalyWarmup    = 30
+	anomalySmoothing = 0.05
+)
+
+// fields of anomaly detection
+const (
+	anomalyTemp = iota
+	anomalyAlt
+	anomalyFieldsNum
+)
+
+// anomalyFields Reading message fields of anomaly detection, min standard deviation of field
+// (readings of constant value are not anomalous within it)
+var anomalyFields = [anomalyFieldsNum]struct {
+	field  int
+	minStd float64
+}{
+	anomalyTemp: {field: fieldTemp, minStd: 0.5},
+	anomalyAlt:  {field: fieldAlt, minStd: 2},
+}
+
+// AnomalyConfig configs of per-device streaming anomaly detection of temperature and altitude
+// (z-score of reading by exponentially weighted mean and variance of device readings)
+type AnomalyConfig struct {
+	// z-score of anomaly (lower is more sensitive)
+	Threshold float64
+	// readings of device before detection (baseline warm-up)
+	Warmup int
+	// smoothing factor of mean and variance (weight of new reading)
+	Smoothing float64
+}
+
+// withDefaults returns configs with defaults of unset values
+func (c AnomalyConfig) withDefaults() *AnomalyConfig {
+	if c.Threshold <= 0 {
+		c.Threshold = anomalyThreshold
+	}
+	if c.Warmup <= 0 {
+		c.Warmup = anomalyWarmup
+	}
+	if c.Smoothing <= 0 || c.Smoothing >= 1 {
+		c.Smoothing = anomalySmoothing
+	}
+	return &c
+}
+
+// ewmStat exponentially weighted mean and variance of field
+type ewmStat struct {
+	mean float64
+	vari float64
+}
+
+// devAnomaly anomaly detection state of device (constant size)
+type devAnomaly struct {
+	// readings of baseline
+	readings int64
+	stats    [anomalyFieldsNum]ewmStat
+	// anomalies by field, last anomaly (zero time if none)
+	anomalies [anomalyFieldsNum]int64
+	last      anomalyEvent
+}
+
+// anomalyEvent anomalous reading field of device (JSON)
+type anomalyEvent struct {
+	Time   int64   `json:"time_ns"`
+	IMEI   string  `json:"imei"`
+	Field  string  `json:"field"`
+	Value  float64 `json:"value"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"std_dev"`
+	Z      float64 `json:"z"`
+}
+
+// check checks fields of Reading message at time now, updates baseline,
+// adds anomalous fields to events, returns events
+func (a *devAnomaly) check(conf *AnomalyConfig, imei string, now int64, rm *readingMessage, events []anomalyEvent) []anomalyEvent {
+	values := [anomalyFieldsNum]float64{anomalyTemp: rm.Temp, anomalyAlt: rm.Alt}
+	for i, x := range values {
+		st := &a.stats[i]
+		if a.readings == 0 {
+			st.mean, st.vari = x, 0
+			continue
+		}
+		std := math.Max(math.Sqrt(st.vari), anomalyFields[i].minStd)
+		diff := x - st.mean
+		if a.readings >= int64(conf.Warmup) {
+			if z := diff / std; math.Abs(z) > conf.Threshold {
+				e := anomalyEvent{
+					Time: now, IMEI: imei, Field: v1FieldNames[anomalyFields[i].field],
+					Value: x, Mean: st.mean, StdDev: std, Z: z,
+				}
+				a.anomalies[i]++
+				a.last = e
+				events = append(events, e)
+				// baseline follows anomalous value within threshold (persistent shift is adopted gradually)
+				diff = math.Copysign(conf.Threshold*std, diff)
+			}
+		}
+		incr := conf.Smoothing * diff
+		st.mean += incr
+		st.vari = (1 - conf.Smoothing) * (st.vari + diff*incr)
+	}
+	a.readings++
+	return events
+}
+
+// detectAnomalies checks valid Reading message of device, counts anomalies and logs anomaly events
+func (p *pipeline) detectAnomalies(now int64, ds *devState, rm *readingMessage) {
+	if p.anomaly == nil {
+		return
+	}
+	var buf [anomalyFieldsNum]anomalyEvent
+	ds.mux.Lock()
+	events := ds.anomaly.check(p.anomaly, ds.imei, now, rm, buf[:0])
+	ds.mux.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	atomic.AddInt64(&p.stats.anomalies, int64(len(events)))
+	if p.anomalyLog == nil {
+		return
+	}
+	for i := range events {
+		out, err := json.Marshal(&events[i])
+		if err != nil {
+			log.Printf("anomaly, imei - %v, marshal err: %v", ds.imei, err)
+			continue
+		}
+		p.anomalyLog.Print(string(out))
+	}
+}
+
+// v1AnomalyBaseline baseline of field
+type v1AnomalyBaseline struct {
+	Mean      float64 `json:"mean"`
+	StdDev    float64 `json:"std_dev"`
+	Anomalies int64   `json:"anomalies"`
+}
+
+// v1Anomalies anomaly detection state of device
+type v1Anomalies struct {
+	IMEI     string                       `json:"imei"`
+	Enabled  bool                         `json:"enabled"`
+	Readings int64                        `json:"readings"`
+	WarmedUp bool                         `json:"warmed_up"`
+	Fields   map[string]v1AnomalyBaseline `json:"fields"`
+	Last     *anomalyEvent                `json:"last,omitempty"`
+}
+
+// deviceAnomalies returns anomaly detection state of device
+func (s *Server) deviceAnomalies(imei string) *v1Anomalies {
+	da := &v1Anomalies{IMEI: imei, Enabled: s.pipe.anomaly != nil, Fields: make(map[string]v1AnomalyBaseline)}
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok || s.pipe.anomaly == nil {
+		return da
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	a := &ds.anomaly
+	if a.readings == 0 {
+		return da
+	}
+	da.Readings = a.readings
+	da.WarmedUp = a.readings >= int64(s.pipe.anomaly.Warmup)
+	for i, st := range a.stats {
+		da.Fields[v1FieldNames[anomalyFields[i].field]] = v1AnomalyBaseline{
+			Mean: st.mean, StdDev: math.Max(math.Sqrt(st.vari), anomalyFields[i].minStd), Anomalies: a.anomalies[i],
+		}
+	}
+	if a.last.Time != 0 {
+		last := a.last
+		da.Last = &last
+	}
+	return da
+}
+
+// v1Anomalies returns anomaly detection state of device
+func (s *Server) v1Anomalies(w http.ResponseWriter, req *http.Request, imei string) {
+	writeAPIResponse(w, s.deviceAnomalies(imei))
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_devAnomaly_check(t *testing.T) {
+
+	conf := AnomalyConfig{Warmup: 20}.withDefaults()
+	// temperature 20 +-0.5, altitude 100 +-2
+	normal := func(i int) readingMessage {
+		return readingMessage{Temp: 20 + 0.5*math.Sin(float64(i)), Alt: 100 + 2*math.Cos(float64(i)*1.3), BattLev: 50}
+	}
+
+	testCases := []struct {
+		name string
+		// readings, anomalous reading at index (none if negative)
+		readings int
+		at       int
+		reading  readingMessage
+		// expected anomalies and field of first anomaly
+		anomalies int
+		field     string
+	}{
+		// Positive
+		{name: "temperature spike", readings: 100, at: 50, reading: readingMessage{Temp: 35, Alt: 100}, anomalies: 1, field: "temperature_c"},
+		{name: "temperature drop", readings: 100, at: 50, reading: readingMessage{Temp: 5, Alt: 100}, anomalies: 1, field: "temperature_c"},
+		{name: "altitude spike", readings: 100, at: 50, reading: readingMessage{Temp: 20, Alt: 400}, anomalies: 1, field: "altitude_m"},
+		{name: "both fields", readings: 100, at: 50, reading: readingMessage{Temp: 35, Alt: 400}, anomalies: 2, field: "temperature_c"},
+		// Negative
+		{name: "normal readings", readings: 100, at: -1},
+		{name: "spike during warm-up", readings: 100, at: 10, reading: readingMessage{Temp: 35, Alt: 100}},
+		{name: "within threshold", readings: 100, at: 50, reading: readingMessage{Temp: 21.5, Alt: 104}},
+	}
+
+	for _, tc := range testCases {
+
+		a := &devAnomaly{}
+		var events []anomalyEvent
+		for i := 0; i < tc.readings; i++ {
+			rm := normal(i)
+			if i == tc.at {
+				rm = tc.reading
+			}
+			events = a.check(conf, "490154203237518", int64(i), &rm, events)
+		}
+		if len(events) != tc.anomalies {
+			t.Fatalf("%v: expected %v anomalies, got %+v", tc.name, tc.anomalies, events)
+		}
+		if tc.anomalies > 0 && (events[0].Field != tc.field || events[0].Time != int64(tc.at) || a.last != events[len(events)-1]) {
+			t.Fatalf("%v: wrong anomaly %+v, last %+v", tc.name, events[0], a.last)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// persistent shift adopted by baseline
+	a := &devAnomaly{}
+	var events []anomalyEvent
+	for i := 0; i < 500; i++ {
+		rm := normal(i)
+		if i >= 100 {
+			rm.Temp += 15
+		}
+		events = a.check(conf, "490154203237518", int64(i), &rm, events[:0])
+		if i > 300 && len(events) > 0 {
+			t.Fatalf("shifted readings should be adopted, got anomaly %+v at %v", events[0], i)
+		}
+	}
+}
+
+func Test_pipeline_detectAnomalies(t *testing.T) {
+
+	var out bytes.Buffer
+	s := New(Config{Anomaly: &AnomalyConfig{Warmup: 10, Threshold: 3}, AnomalyOut: &out}, testOutLog)
+	ds := s.pipe.devs.get("490154203237518")
+	now := time.Now().UnixNano()
+	for i := 0; i < 30; i++ {
+		rm := readingMessage{Temp: 20 + 0.2*float64(i%3), Alt: 100, BattLev: 50}
+		if i == 20 {
+			rm.Temp = 35
+		}
+		s.pipe.reading(now+int64(i), ds, testFrame(rm), &decodedReading{})
+	}
+
+	e := anomalyEvent{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out.String())), &e); err != nil ||
+		e.IMEI != "490154203237518" || e.Field != "temperature_c" || e.Value != 35 || e.Time != now+20 || e.Z < 3 {
+		t.Fatalf("wrong anomaly event %q, %v", out.String(), err)
+	}
+	if sr := s.pipe.stats.snapshot(now); sr.Anomalies != 1 {
+		t.Fatalf("expected 1 anomaly in stats, got %v", sr.Anomalies)
+	}
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/anomalies", nil))
+	da := v1Anomalies{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &da); err != nil || !da.Enabled || !da.WarmedUp || da.Readings != 30 ||
+		da.Fields["temperature_c"].Anomalies != 1 || da.Last == nil || da.Last.Value != 35 {
+		t.Fatalf("wrong device anomalies %s, %v", rec.Body.Bytes(), err)
+	}
+
+	// detection disabled
+	s = New(Config{}, testOutLog)
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/anomalies", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &da); err != nil || da.Enabled {
+		t.Fatalf("anomaly detection should be disabled, got %s, %v", rec.Body.Bytes(), err)
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// period of API keys file change check (keys reloaded if file changed)
+const apiKeysReloadPeriod = time.Second * 5
+
+// API key scopes
+const (
+	scopeStatus   = "status"
+	scopeReadings = "readings"
+	scopeIngest   = "ingest"
+	scopeAdmin    = "admin"
+	scopeCluster  = "cluster"
+)
+
+// routeScopes scopes required by routes (path prefix, any key if scope empty), routes with device IMEI
+// in path, routes not listed are forbidden
+var routeScopes = []struct {
+	prefix string
+	scope  string
+	imei   bool
+}{
+	{prefix: "/status/", scope: scopeStatus, imei: true},
+	{prefix: "/stats", scope: scopeStatus},
+	{prefix: "/readings/", scope: scopeReadings, imei: true},
+	{prefix: "/devices/", scope: scopeReadings, imei: true},
+	{prefix: "/export", scope: scopeReadings},
+	{prefix: "/geo/devices/", scope: scopeReadings, imei: true},
+	{prefix: "/geo/", scope: scopeReadings},
+	{prefix: "/ingest", scope: scopeIngest},
+	{prefix: "/admin/devices/", scope: scopeAdmin, imei: true},
+	{prefix: "/admin/calibration/", scope: scopeAdmin, imei: true},
+	{prefix: "/admin/", scope: scopeAdmin},
+	{prefix: "/cluster/", scope: scopeCluster},
+	{prefix: "/openapi.json"},
+}
+
+// apiKey API key of keys file, key stored as SHA-256 hash (hex), access to devices
+// restricted by IMEIs and groups (validation profiles) if set
+type apiKey struct {
+	ID     string   `json:"id"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes"`
+	IMEIs  []string `json:"imeis,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// apiKeysFile keys file (JSON)
+type apiKeysFile struct {
+	Keys []apiKey `json:"keys"`
+}
+
+// apiError error response (JSON)
+type apiError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// hasScope returns whether key has scope
+func (k *apiKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted returns whether key access restricted to devices
+func (k *apiKey) restricted() bool {
+	return len(k.IMEIs) > 0 || len(k.Groups) > 0
+}
+
+// allows returns whether key allows access to device of group
+func (k *apiKey) allows(imei, group string) bool {
+	if !k.restricted() {
+		return true
+	}
+	for _, i := range k.IMEIs {
+		if i == imei {
+			return true
+		}
+	}
+	for _, g := range k.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey returns SHA-256 hash (hex) of key
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// keyStore API keys by hash, reloaded if keys file changed
+type keyStore struct {
+	path string
+
+	mux  sync.RWMutex
+	keys map[string]*apiKey
+	// modification time, size of loaded file
+	mod  time.Time
+	size int64
+}
+
+// inits key store, loads keys file
+func newKeyStore(path string) (*keyStore, error) {
+	ks := &keyStore{path: path, keys: make(map[string]*apiKey)}
+	if _, err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// reload loads keys file if changed, returns true if loaded or keys revoked (keys kept on error,
+// all keys revoked if file removed)
+func (ks *keyStore) reload() (bool, error) {
+	fi, err := os.Stat(ks.path)
+	if os.IsNotExist(err) {
+		ks.mux.Lock()
+		revoked := len(ks.keys) > 0
+		ks.keys, ks.mod, ks.size = make(map[string]*apiKey), time.Time{}, 0
+		ks.mux.Unlock()
+		if revoked {
+			log.Printf("api keys, keys file removed, all keys revoked")
+		}
+		return revoked, err
+	} else if err != nil {
+		return false, err
+	}
+	ks.mux.RLock()
+	changed := !fi.ModTime().Equal(ks.mod) || fi.Size() != ks.size
+	ks.mux.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(ks.path)
+	if err != nil {
+		return false, err
+	}
+	kf := apiKeysFile{}
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return false, err
+	}
+	keys := make(map[string]*apiKey, len(kf.Keys))
+	for i := range kf.Keys {
+		k := &kf.Keys[i]
+		if len(k.Hash) != sha256.Size*2 {
+			return false, fmt.Errorf("api key %v: hash should be SHA-256 hex", k.ID)
+		}
+		if len(k.Scopes) == 0 {
+			return false, fmt.Errorf("api key %v: no scopes", k.ID)
+		}
+		keys[strings.ToLower(k.Hash)] = k
+	}
+
+	ks.mux.Lock()
+	ks.keys, ks.mod, ks.size = keys, fi.ModTime(), fi.Size()
+	ks.mux.Unlock()
+	log.Printf("api keys, %v keys loaded", len(keys))
+	return true, nil
+}
+
+// lookup returns API key
+func (ks *keyStore) lookup(key string) (*apiKey, bool) {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+	k, ok := ks.keys[hashAPIKey(key)]
+	return k, ok
+}
+
+// run reloads keys file if changed each reload period until done
+func (ks *keyStore) run(done <-chan struct{}) {
+	t := time.NewTicker(apiKeysReloadPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// removed file logged once (keys revoked)
+			if _, err := ks.reload(); err != nil && !os.IsNotExist(err) {
+				log.Printf("api keys, reload err: %v", err)
+			}
+		}
+	}
+}
+
+// requestKey returns API key of request (Authorization: Bearer <key> or X-API-Key: <key>)
+func requestKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// adminKey admin API key of admin token
+var adminKey = &apiKey{ID: "admin-token", Scopes: []string{scopeAdmin}}
+
+// clusterKey API key of node requests signed by shared cluster key
+var clusterKey = &apiKey{ID: "cluster-node", Scopes: []string{scopeCluster, scopeReadings}}
+
+// authenticate authenticates requests by API keys (node requests by cluster signature),
+// checks scope and devices of route (authentication disabled if key store not set)
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.keys == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		var k *apiKey
+		if s.cluster != nil && req.Header.Get(clusterSignatureHeader) != "" {
+			if err := s.cluster.verifyRequest(req, time.Now().UnixNano()); err != nil {
+				log.Printf("http server, raddr - %v, node request rejected: %v", req.RemoteAddr, err)
+				s.authError(w, http.StatusUnauthorized, "invalid cluster signature")
+				return
+			}
+			k = clusterKey
+		} else {
+			key := requestKey(req)
+			if key == "" {
+				s.authError(w, http.StatusUnauthorized, "api key required")
+				return
+			}
+			var ok bool
+			k, ok = s.keys.lookup(key)
+			if !ok && s.conf.AdminToken != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.conf.AdminToken)) == 1 {
+				k, ok = adminKey, true
+			}
+			if !ok {
+				s.authError(w, http.StatusUnauthorized, "invalid api key")
+				return
+			}
+		}
+		if err := s.authorize(k, req); err != nil {
+			log.Printf("http server, raddr - %v, api key %v, %v %v forbidden: %v", req.RemoteAddr, k.ID, req.Method, req.URL.Path, err)
+			s.authError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// authorize checks scope of route and devices of request
+func (s *Server) authorize(k *apiKey, req *http.Request) error {
+	if strings.HasPrefix(req.URL.Path, apiV1Prefix) {
+		r, imei, _ := lookupRoute(apiRoutes, req.Method, req.URL.Path)
+		if r == nil {
+			return errors.New("unknown route")
+		}
+		if !k.hasScope(r.scope) {
+			return fmt.Errorf("scope %v required", r.scope)
+		}
+		if k.restricted() && imei == "" {
+			return errors.New("api key restricted to devices")
+		}
+		if k.restricted() && !k.allows(imei, s.pipe.devs.profiles.lookup(imei).name) {
+			return fmt.Errorf("device %v not allowed", imei)
+		}
+		return nil
+	}
+	for _, rs := range routeScopes {
+		if !strings.HasPrefix(req.URL.Path, rs.prefix) {
+			continue
+		}
+		if rs.scope == "" {
+			return nil
+		}
+		if !k.hasScope(rs.scope) {
+			return fmt.Errorf("scope %v required", rs.scope)
+		}
+		if !k.restricted() {
+			return nil
+		}
+		// devices of request
+		var imeis []string
+		if rs.imei {
+			imeis = []string{strings.SplitN(strings.TrimPrefix(req.URL.Path, rs.prefix), "/", 2)[0]}
+		} else if rs.prefix == "/export" {
+			for _, v := range req.URL.Query()["imei"] {
+				imeis = append(imeis, strings.Split(v, ",")...)
+			}
+		}
+		if len(imeis) == 0 {
+			return errors.New("api key restricted to devices")
+		}
+		for _, imei := range imeis {
+			if !k.allows(imei, s.pipe.devs.profiles.lookup(imei).name) {
+				return fmt.Errorf("device %v not allowed", imei)
+			}
+		}
+		return nil
+	}
+	return errors.New("unknown route")
+}
+
+// authError writes error response (JSON)
+func (s *Server) authError(w http.ResponseWriter, code int, msg string) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, code, errCodeUnauthorized, msg)
+		return
+	}
+	writeAPIError(w, code, errCodeForbidden, msg)
+}
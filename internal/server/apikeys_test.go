@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testWriteKeys writes API keys file
+func testWriteKeys(t *testing.T, path string, keys ...apiKey) {
+	b, err := json.Marshal(&apiKeysFile{Keys: keys})
+	if err != nil {
+		t.Fatalf("api keys marshal err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatalf("api keys write err: %v", err)
+	}
+}
+
+func Test_Server_authenticate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	testWriteKeys(t, path,
+		apiKey{ID: "reader", Hash: hashAPIKey("reader-key"), Scopes: []string{scopeStatus, scopeReadings}},
+		apiKey{ID: "status", Hash: hashAPIKey("status-key"), Scopes: []string{scopeStatus}},
+		apiKey{ID: "device", Hash: hashAPIKey("device-key"), Scopes: []string{scopeStatus, scopeReadings}, IMEIs: []string{"490154203237526"}},
+		apiKey{ID: "greenhouse", Hash: hashAPIKey("greenhouse-key"), Scopes: []string{scopeStatus, scopeReadings}, Groups: []string{"greenhouse"}},
+		apiKey{ID: "admin", Hash: hashAPIKey("admin-key"), Scopes: []string{scopeAdmin}},
+	)
+	s := New(Config{
+		APIKeysFile: path, AdminToken: "token",
+		Profiles: &Profiles{Profiles: map[string]Profile{"greenhouse": {}}, IMEI: map[string]string{"490154203237518": "greenhouse"}},
+	}, testOutLog)
+	if s.keys, err = newKeyStore(path); err != nil {
+		t.Fatalf("new key store err: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		path string
+		// X-API-Key header, bearer token
+		key    string
+		bearer string
+		code   int
+	}{
+		// Positive
+		{name: "status", path: "/status/490154203237518", key: "status-key", code: http.StatusOK},
+		{name: "readings by bearer", path: "/readings/490154203237518", bearer: "reader-key", code: http.StatusOK},
+		{name: "device restricted key", path: "/status/490154203237526", key: "device-key", code: http.StatusOK},
+		{name: "group restricted key", path: "/devices/490154203237518/validation", key: "greenhouse-key", code: http.StatusOK},
+		{name: "group restricted export", path: "/export?imei=490154203237518", key: "greenhouse-key", code: http.StatusOK},
+		{name: "admin key", path: "/admin/devices/490154203237518", key: "admin-key", code: http.StatusOK},
+		{name: "admin token", path: "/admin/devices/490154203237518", bearer: "token", code: http.StatusOK},
+		{name: "api v1 device restricted key", path: "/api/v1/devices/490154203237526/status", key: "device-key", code: http.StatusOK},
+		{name: "geo track device restricted key", path: "/geo/devices/490154203237526/track", key: "device-key", code: http.StatusOK},
+		{name: "openapi any key", path: "/openapi.json", key: "status-key", code: http.StatusOK},
+		// Negative
+		{name: "no key", path: "/status/490154203237518", code: http.StatusUnauthorized},
+		{name: "invalid key", path: "/status/490154203237518", key: "unknown-key", code: http.StatusUnauthorized},
+		{name: "no scope", path: "/readings/490154203237518", key: "status-key", code: http.StatusForbidden},
+		{name: "admin token not admin scope", path: "/status/490154203237518", bearer: "token", code: http.StatusForbidden},
+		{name: "device not allowed", path: "/status/490154203237518", key: "device-key", code: http.StatusForbidden},
+		{name: "group not allowed", path: "/readings/490154203237526", key: "greenhouse-key", code: http.StatusForbidden},
+		{name: "export device not allowed", path: "/export?imei=490154203237518,490154203237526", key: "greenhouse-key", code: http.StatusForbidden},
+		{name: "restricted key without device", path: "/stats", key: "device-key", code: http.StatusForbidden},
+		{name: "api v1 no scope", path: "/api/v1/devices/490154203237518/reading", key: "status-key", code: http.StatusForbidden},
+		{name: "api v1 device not allowed", path: "/api/v1/devices/490154203237518/status", key: "device-key", code: http.StatusForbidden},
+		{name: "geo devices no scope", path: "/geo/devices", key: "status-key", code: http.StatusForbidden},
+		{name: "geo devices restricted key", path: "/geo/devices", key: "device-key", code: http.StatusForbidden},
+		{name: "geo track device not allowed", path: "/geo/devices/490154203237518/track", key: "device-key", code: http.StatusForbidden},
+		{name: "unknown route", path: "/debug/vars", key: "reader-key", code: http.StatusForbidden},
+		{name: "api v1 unknown route", path: "/api/v1/devices/490154203237518/secrets", key: "reader-key", code: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		s.httpHandler().ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v (%s)", tc.name, tc.code, rec.Code, rec.Body.Bytes())
+		}
+		if tc.code == http.StatusUnauthorized || tc.code == http.StatusForbidden {
+			ae := apiError{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &ae); err != nil || ae.Error == "" || ae.Message == "" ||
+				rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("%v: wrong error response %s, %v", tc.name, rec.Body.Bytes(), err)
+			}
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// rotated keys file reloaded
+	testWriteKeys(t, path, apiKey{ID: "rotated", Hash: hashAPIKey("rotated-key"), Scopes: []string{scopeStatus}})
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if ok, err := s.keys.reload(); !ok || err != nil {
+		t.Fatalf("changed keys file should be reloaded, got %v, %v", ok, err)
+	}
+	if _, ok := s.keys.lookup("status-key"); ok {
+		t.Fatalf("rotated key should be removed")
+	}
+	if k, ok := s.keys.lookup("rotated-key"); !ok || k.ID != "rotated" {
+		t.Fatalf("new key should be loaded")
+	}
+	// wrong keys file, keys kept
+	if err := ioutil.WriteFile(path, []byte(`{"keys":[{"id":"k","hash":"abc","scopes":["status"]}]}`), 0644); err != nil {
+		t.Fatalf("api keys write err: %v", err)
+	}
+	if _, err := s.keys.reload(); err == nil {
+		t.Fatalf("wrong key hash should be rejected")
+	}
+	if _, ok := s.keys.lookup("rotated-key"); !ok {
+		t.Fatalf("keys should be kept on reload err")
+	}
+	// removed keys file, all keys revoked
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("api keys remove err: %v", err)
+	}
+	if ok, err := s.keys.reload(); !ok || !os.IsNotExist(err) {
+		t.Fatalf("removed keys file should revoke keys, got %v, %v", ok, err)
+	}
+	if _, ok := s.keys.lookup("rotated-key"); ok {
+		t.Fatalf("keys should be revoked when keys file removed")
+	}
+	// recreated keys file loaded
+	testWriteKeys(t, path, apiKey{ID: "rotated", Hash: hashAPIKey("rotated-key"), Scopes: []string{scopeStatus}})
+	if ok, err := s.keys.reload(); !ok || err != nil {
+		t.Fatalf("recreated keys file should be loaded, got %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API v1 prefix
+const apiV1Prefix = "/api/v1/"
+
+// API error codes
+const (
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeInvalidIMEI      = "invalid_imei"
+	errCodeInvalidParameter = "invalid_parameter"
+	errCodeInternal         = "internal_error"
+)
+
+// apiParam query parameter of API route
+type apiParam struct {
+	name string
+	desc string
+}
+
+// apiRoute route of versioned API: path pattern with {imei} segment, required scope,
+// query parameters, request and response schemas (values of body types) and handler
+type apiRoute struct {
+	method  string
+	pattern string
+	scope   string
+	summary string
+	query   []apiParam
+	req     interface{}
+	resp    interface{}
+	// media type of response, JSON if empty (string schema unless response type set)
+	media string
+	// legacy route responds JSON errors (plain-text errors otherwise)
+	jsonErrors bool
+	handle     func(s *Server, w http.ResponseWriter, req *http.Request, imei string)
+}
+
+// apiRoutes routes of API v1: device routes and fleet battery forecast (stats, ingest, export,
+// geo, admin and cluster endpoints are legacy routes only)
+var apiRoutes = []apiRoute{
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/status", scope: scopeStatus,
+		summary: "Device connection status",
+		resp:    v1DeviceStatus{}, handle: (*Server).v1Status,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/reading", scope: scopeReadings,
+		summary: "Last valid reading of device (last retained reading if offline)",
+		resp:    v1DeviceReading{}, handle: (*Server).v1Reading,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/validation", scope: scopeReadings,
+		summary: "Validation statistics of device",
+		resp:    v1Validation{}, handle: (*Server).v1Validation,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/clock", scope: scopeReadings,
+		summary: "Clock skew and jitter of device sending timestamps",
+		resp:    v1Clock{}, handle: (*Server).v1Clock,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/rollups", scope: scopeReadings,
+		summary: "Rollups (min, max, avg) of device readings",
+		query: []apiParam{
+			{name: "resolution", desc: "rollup resolution: 1m (default), 1h, 1d"},
+			{name: "from", desc: "start of time range, unix nanoseconds (unbounded if not set)"},
+			{name: "to", desc: "end of time range, unix nanoseconds (unbounded if not set)"},
+		},
+		resp: []v1Rollup{}, handle: (*Server).v1Rollups,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/anomalies", scope: scopeReadings,
+		summary: "Anomaly detection baseline and anomalies of device",
+		resp:    v1Anomalies{}, handle: (*Server).v1Anomalies,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/devices/{imei}/movement", scope: scopeReadings,
+		summary: "Speed, heading, moving or stationary state and position jumps of device",
+		resp:    v1Movement{}, handle: (*Server).v1Movement,
+	},
+	{
+		method: http.MethodGet, pattern: "/api/v1/fleet/battery", scope: scopeStatus,
+		summary: "Devices predicted to be empty within hours",
+		query:   []apiParam{{name: "hours", desc: "forecast horizon, hours (24 by default)"}},
+		resp:    v1BatteryFleet{}, handle: (*Server).v1BatteryFleet,
+	},
+}
+
+// v1Reading Reading message with units
+type v1Reading struct {
+	TemperatureC float64 `json:"temperature_c"`
+	AltitudeM    float64 `json:"altitude_m"`
+	LatitudeDeg  float64 `json:"latitude_deg"`
+	LongitudeDeg float64 `json:"longitude_deg"`
+	BatteryPct   float64 `json:"battery_pct"`
+}
+
+// v1 names of Reading message fields, invalid reasons
+var (
+	v1FieldNames  = [fieldsNum]string{"temperature_c", "altitude_m", "latitude_deg", "longitude_deg", "battery_pct"}
+	v1ReasonNames = [reasonsNum]string{"", "below_min", "above_max", "nan", "pos_inf", "neg_inf", "subnormal", "negative_zero", "position_jump"}
+)
+
+// v1DeviceStatus device status: online or offline, validation profile, cluster node of connection,
+// battery forecast, stuck sensor
+type v1DeviceStatus struct {
+	IMEI    string           `json:"imei"`
+	Status  string           `json:"status"`
+	Profile string           `json:"profile,omitempty"`
+	Node    string           `json:"node,omitempty"`
+	Battery *batteryForecast `json:"battery,omitempty"`
+	// stuck sensor fields and earliest stuck since time (not stuck if zero)
+	SensorStuckFields  []string `json:"sensor_stuck_fields,omitempty"`
+	SensorStuckSinceNs int64    `json:"sensor_stuck_since_ns,omitempty"`
+}
+
+// v1DeviceReading device status, last reading (raw reading of calibrated device) and its receive time
+type v1DeviceReading struct {
+	v1DeviceStatus
+	ReceivedAtNs int64      `json:"received_at_ns,omitempty"`
+	Reading      *v1Reading `json:"reading,omitempty"`
+	Raw          *v1Reading `json:"raw,omitempty"`
+}
+
+// v1Validation validation statistics, invalid fields by reason
+type v1Validation struct {
+	IMEI          string                      `json:"imei"`
+	Valid         int64                       `json:"valid"`
+	Invalid       int64                       `json:"invalid"`
+	InvalidRatio  float64                     `json:"invalid_ratio"`
+	LastInvalidNs int64                       `json:"last_invalid_ns,omitempty"`
+	Fields        map[string]map[string]int64 `json:"fields"`
+}
+
+// v1Clock device clock: readings with device time, rejected device times by reason
+type v1Clock struct {
+	IMEI         string           `json:"imei"`
+	Readings     int64            `json:"readings"`
+	Rejected     map[string]int64 `json:"rejected"`
+	SkewNs       int64            `json:"skew_ns"`
+	JitterNs     int64            `json:"jitter_ns"`
+	LastOffsetNs int64            `json:"last_offset_ns"`
+}
+
+// v1RollupField aggregate of field in rollup bucket
+type v1RollupField struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// v1Rollup rollup bucket of device
+type v1Rollup struct {
+	IMEI       string                   `json:"imei"`
+	Resolution string                   `json:"resolution"`
+	StartNs    int64                    `json:"start_ns"`
+	EndNs      int64                    `json:"end_ns"`
+	Count      int64                    `json:"count"`
+	Open       bool                     `json:"open"`
+	Fields     map[string]v1RollupField `json:"fields"`
+}
+
+// newV1Reading converts Reading message
+func newV1Reading(rm *readingMessage) *v1Reading {
+	return &v1Reading{
+		TemperatureC: rm.Temp, AltitudeM: rm.Alt, LatitudeDeg: rm.Lat, LongitudeDeg: rm.Lon, BatteryPct: rm.BattLev,
+	}
+}
+
+// matchRoute returns IMEI segment if path matches route pattern ({name} segment matches any value)
+func (r *apiRoute) matchRoute(path string) (string, bool) {
+	pp := strings.Split(r.pattern, "/")
+	ps := strings.Split(path, "/")
+	if len(pp) != len(ps) {
+		return "", false
+	}
+	var imei string
+	for i := range pp {
+		if pp[i] == "{imei}" {
+			imei = ps[i]
+		} else if !strings.HasPrefix(pp[i], "{") && pp[i] != ps[i] {
+			return "", false
+		}
+	}
+	return imei, true
+}
+
+// lookupRoute returns route of request, allowed methods of path if method not matched
+func lookupRoute(routes []apiRoute, method, path string) (*apiRoute, string, []string) {
+	var allow []string
+	for i := range routes {
+		r := &routes[i]
+		imei, ok := r.matchRoute(path)
+		if !ok {
+			continue
+		}
+		if r.method == method {
+			return r, imei, nil
+		}
+		allow = append(allow, r.method)
+	}
+	return nil, "", allow
+}
+
+// apiV1 routes API v1 requests
+func (s *Server) apiV1(w http.ResponseWriter, req *http.Request) {
+	r, imei, allow := lookupRoute(apiRoutes, req.Method, req.URL.Path)
+	if r == nil && len(allow) > 0 {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method "+req.Method+" not allowed")
+		return
+	}
+	if r == nil {
+		writeAPIError(w, http.StatusNotFound, errCodeNotFound, "route not found")
+		return
+	}
+	if strings.Contains(r.pattern, "{imei}") {
+		if _, err := validParseIMEIString(imei); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidIMEI, err.Error())
+			return
+		}
+	}
+	r.handle(s, w, req, imei)
+}
+
+// v1Status returns status of device
+func (s *Server) v1Status(w http.ResponseWriter, req *http.Request, imei string) {
+	sts := s.deviceStatus(imei)
+	stuck, since := s.deviceStuck(imei)
+	writeAPIResponse(w, &v1DeviceStatus{
+		IMEI: sts.IMEI, Status: sts.Status, Profile: sts.Profile, Node: sts.Node,
+		Battery: sts.Battery, SensorStuckFields: stuckFieldNames(stuck, &v1FieldNames), SensorStuckSinceNs: since,
+	})
+}
+
+// v1Reading returns last reading of device (proxied to owning cluster node)
+func (s *Server) v1Reading(w http.ResponseWriter, req *http.Request, imei string) {
+	if s.proxyOwner(w, req, imei) {
+		return
+	}
+	drs := s.lastReading(imei)
+	stuck, since := s.deviceStuck(imei)
+	resp := v1DeviceReading{
+		v1DeviceStatus: v1DeviceStatus{
+			IMEI: drs.IMEI, Status: drs.Status, Profile: drs.Profile, Node: drs.Node,
+			Battery: drs.Battery, SensorStuckFields: stuckFieldNames(stuck, &v1FieldNames), SensorStuckSinceNs: since,
+		},
+		ReceivedAtNs: drs.Time,
+	}
+	if drs.Time != 0 {
+		resp.Reading = newV1Reading(&drs.Reading)
+	}
+	if drs.Raw != nil {
+		resp.Raw = newV1Reading(drs.Raw)
+	}
+	writeAPIResponse(w, &resp)
+}
+
+// v1Validation returns validation statistics of device
+func (s *Server) v1Validation(w http.ResponseWriter, req *http.Request, imei string) {
+	vs := v1Validation{IMEI: imei, Fields: make(map[string]map[string]int64)}
+	if ds, ok := s.pipe.devs.lookup(imei); ok {
+		ds.mux.Lock()
+		vs.Valid, vs.Invalid, vs.LastInvalidNs = ds.valid, ds.invalid, ds.lastInvalid
+		for f, reasons := range ds.invalidFields {
+			for r, n := range reasons {
+				if n == 0 || invalidReason(r) == reasonNone {
+					continue
+				}
+				if vs.Fields[v1FieldNames[f]] == nil {
+					vs.Fields[v1FieldNames[f]] = make(map[string]int64)
+				}
+				vs.Fields[v1FieldNames[f]][v1ReasonNames[r]] = n
+			}
+		}
+		ds.mux.Unlock()
+	}
+	if total := vs.Valid + vs.Invalid; total > 0 {
+		vs.InvalidRatio = float64(vs.Invalid) / float64(total)
+	}
+	writeAPIResponse(w, &vs)
+}
+
+// v1Clock returns clock of device
+func (s *Server) v1Clock(w http.ResponseWriter, req *http.Request, imei string) {
+	dc := s.deviceClock(imei)
+	resp := v1Clock{
+		IMEI: imei, Readings: dc.Readings, Rejected: make(map[string]int64),
+		SkewNs: dc.Skew, JitterNs: dc.Jitter, LastOffsetNs: dc.Offset,
+	}
+	for r, name := range reasonNames {
+		if n, ok := dc.Rejected[name]; ok {
+			resp.Rejected[v1ReasonNames[r]] = n
+		}
+	}
+	writeAPIResponse(w, &resp)
+}
+
+// v1Rollups returns rollups of device
+func (s *Server) v1Rollups(w http.ResponseWriter, req *http.Request, imei string) {
+	q := req.URL.Query()
+	if res := q.Get("resolution"); res != "" {
+		q.Set("res", res)
+	}
+	rus, err := s.deviceRollups(imei, q)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	resp := make([]v1Rollup, 0, len(rus))
+	for _, ru := range rus {
+		vr := v1Rollup{
+			IMEI: ru.IMEI, Resolution: ru.Res, StartNs: ru.Start, EndNs: ru.End, Count: ru.Count, Open: ru.Open,
+			Fields: make(map[string]v1RollupField, len(ru.Fields)),
+		}
+		for f, name := range fieldNames {
+			if rf, ok := ru.Fields[name]; ok {
+				vr.Fields[v1FieldNames[f]] = v1RollupField(rf)
+			}
+		}
+		resp = append(resp, vr)
+	}
+	writeAPIResponse(w, resp)
+}
+
+// v1BatteryFleet returns devices predicted to be empty within hours
+func (s *Server) v1BatteryFleet(w http.ResponseWriter, req *http.Request, imei string) {
+	hours := float64(battFleetHours)
+	if v := req.URL.Query().Get("hours"); v != "" {
+		h, err := strconv.ParseFloat(v, 64)
+		if err != nil || h <= 0 || math.IsInf(h, 0) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, "hours should be positive number")
+			return
+		}
+		hours = h
+	}
+	writeAPIResponse(w, s.batteryFleet(time.Now().UnixNano(), hours))
+}
+
+// writeAPIResponse writes JSON response
+func writeAPIResponse(w http.ResponseWriter, resp interface{}) {
+	out, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("http server: response marshal err: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
+
+// writeAPIError writes error response (JSON) with status code, error code and message
+func writeAPIError(w http.ResponseWriter, status int, code, msg string) {
+	out, err := json.Marshal(&apiError{Error: code, Message: msg})
+	if err != nil {
+		log.Printf("http server: error marshal err: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Server_apiV1(t *testing.T) {
+
+	s := New(Config{}, testOutLog)
+	ds := s.pipe.devs.get("490154203237518")
+	s.pipe.reading(1, ds, testFrame(readingMessage{BattLev: 1}), &decodedReading{})
+	s.pipe.reading(2, ds, testFrame(readingMessage{Temp: 301, BattLev: 1}), &decodedReading{})
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+		// error code of error response
+		errCode string
+	}{
+		// Positive
+		{name: "status", method: "GET", path: "/api/v1/devices/490154203237518/status", code: http.StatusOK},
+		{name: "reading", method: "GET", path: "/api/v1/devices/490154203237518/reading", code: http.StatusOK},
+		{name: "validation", method: "GET", path: "/api/v1/devices/490154203237518/validation", code: http.StatusOK},
+		{name: "clock", method: "GET", path: "/api/v1/devices/490154203237518/clock", code: http.StatusOK},
+		{name: "rollups", method: "GET", path: "/api/v1/devices/490154203237518/rollups?resolution=1h", code: http.StatusOK},
+		// Negative
+		{name: "unknown route", method: "GET", path: "/api/v1/devices/490154203237518/unknown", code: http.StatusNotFound, errCode: errCodeNotFound},
+		{name: "no resource", method: "GET", path: "/api/v1/devices/490154203237518", code: http.StatusNotFound, errCode: errCodeNotFound},
+		{name: "wrong method", method: "POST", path: "/api/v1/devices/490154203237518/status", code: http.StatusMethodNotAllowed, errCode: errCodeMethodNotAllowed},
+		{name: "not number imei", method: "GET", path: "/api/v1/devices/49015420323751a/status", code: http.StatusBadRequest, errCode: errCodeInvalidIMEI},
+		{name: "wrong resolution", method: "GET", path: "/api/v1/devices/490154203237518/rollups?resolution=1w", code: http.StatusBadRequest, errCode: errCodeInvalidParameter},
+		{name: "wrong time range", method: "GET", path: "/api/v1/devices/490154203237518/rollups?from=a", code: http.StatusBadRequest, errCode: errCodeInvalidParameter},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v (%s)", tc.name, tc.code, rec.Code, rec.Body.Bytes())
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%v: expected json response, got %v", tc.name, rec.Header().Get("Content-Type"))
+		}
+		if tc.errCode != "" {
+			ae := apiError{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &ae); err != nil || ae.Error != tc.errCode || ae.Message == "" {
+				t.Fatalf("%v: expected error %v, got %s, %v", tc.name, tc.errCode, rec.Body.Bytes(), err)
+			}
+		}
+		if tc.code == http.StatusMethodNotAllowed && rec.Header().Get("Allow") != "GET" {
+			t.Fatalf("%v: expected allow header GET, got %v", tc.name, rec.Header().Get("Allow"))
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/validation", nil))
+	vs := v1Validation{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vs); err != nil {
+		t.Fatalf("validation response unmarshal err: %v", err)
+	}
+	if vs.Valid != 1 || vs.Invalid != 1 || vs.InvalidRatio != 0.5 || vs.LastInvalidNs != 2 || vs.Fields["temperature_c"]["above_max"] != 1 {
+		t.Fatalf("wrong device validation %+v", vs)
+	}
+
+	// offline device: last retained reading, legacy route compatible
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/reading", nil))
+	dr := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dr); err != nil || dr["imei"] != "490154203237518" || dr["status"] != "offline" {
+		t.Fatalf("wrong device reading %s, %v", rec.Body.Bytes(), err)
+	}
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/devices/490154203237518/unknown", nil))
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "404 Not Found" {
+		t.Fatalf("legacy route response changed: %v %s", rec.Code, rec.Body.Bytes())
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// battery forecast
+const (
+	// rise of level (pct) above smoothed level taken as charging (new discharge segment)
+	// if kept by consecutive readings (single outlier is ignored)
+	battChargeJump     = 5.0
+	battChargeReadings = 3
+	// level smoothing factor of charging detection (EWMA)
+	battSmoothing = 0.2
+	// weight decay time of discharge rate fit (older readings weigh less)
+	battDecay = 24 * time.Hour
+	// min readings, time span of segment of forecast
+	battMinSamples = 10
+	battMinSpan    = int64(10 * time.Minute)
+	// min discharge rate (pct per hour) of time to empty, battery is stable below it
+	battMinRate = 0.01
+	// default horizon of fleet forecast (hours)
+	battFleetHours = 24
+)
+
+// battery states
+const (
+	battDischarging = "discharging"
+	battCharging    = "charging"
+	battStable      = "stable"
+)
+
+// forecast confidences
+const (
+	battConfLow    = "low"
+	battConfMedium = "medium"
+	battConfHigh   = "high"
+)
+
+// devBattery battery trend of device: weighted least squares fit of level by time of discharge segment
+// (readings since last charging), weights decay with age of reading
+type devBattery struct {
+	// segment start, last reading time (unix nano)
+	start int64
+	last  int64
+	// readings of segment, charges detected
+	samples int64
+	charges int64
+	// consecutive readings risen above smoothed level (not added to fit until charging confirmed)
+	rises int
+	// smoothed level
+	level float64
+	// weighted sums of time (hours since segment start) and level
+	w, st, sl, stt, stl, sll float64
+}
+
+// batteryForecast battery level trend and time to empty (empty estimated if discharging)
+type batteryForecast struct {
+	State          string  `json:"state"`
+	LevelPct       float64 `json:"level_pct"`
+	RatePctPerHour float64 `json:"rate_pct_per_hour"`
+	HoursToEmpty   float64 `json:"hours_to_empty,omitempty"`
+	EmptyAtNs      int64   `json:"empty_at_ns,omitempty"`
+	// confidence by goodness of fit (r2), readings and time span of fit
+	Confidence string  `json:"confidence"`
+	R2         float64 `json:"r2"`
+	Samples    int64   `json:"samples"`
+	Charges    int64   `json:"charges"`
+}
+
+// add adds battery level of reading at time now, out of order readings are ignored,
+// readings risen above smoothed level are held until rise is kept (charging) or dropped (outlier)
+func (b *devBattery) add(now int64, level float64) {
+	if b.samples > 0 && now < b.last {
+		// out of order reading (e.g. ingested backlog)
+		return
+	}
+	if b.samples > 0 && level > b.level+battChargeJump {
+		b.rises++
+		if b.rises < battChargeReadings {
+			return
+		}
+		b.charges++
+		b.samples = 0
+	}
+	b.rises = 0
+	if b.samples == 0 {
+		b.start, b.level = now, level
+		b.w, b.st, b.sl, b.stt, b.stl, b.sll = 0, 0, 0, 0, 0, 0
+	} else {
+		b.level += battSmoothing * (level - b.level)
+		d := math.Exp(-float64(now-b.last) / float64(battDecay))
+		b.w, b.st, b.sl, b.stt, b.stl, b.sll = b.w*d, b.st*d, b.sl*d, b.stt*d, b.stl*d, b.sll*d
+	}
+	t := float64(now-b.start) / float64(time.Hour)
+	b.w++
+	b.st += t
+	b.sl += level
+	b.stt += t * t
+	b.stl += t * level
+	b.sll += level * level
+	b.samples++
+	b.last = now
+}
+
+// forecast returns forecast at time now, false if not enough readings
+func (b *devBattery) forecast(now int64) (batteryForecast, bool) {
+	span := b.last - b.start
+	if b.samples < battMinSamples || span < battMinSpan {
+		return batteryForecast{}, false
+	}
+	mt, ml := b.st/b.w, b.sl/b.w
+	sxx := b.stt/b.w - mt*mt
+	sxy := b.stl/b.w - mt*ml
+	syy := b.sll/b.w - ml*ml
+	if sxx <= 0 {
+		return batteryForecast{}, false
+	}
+	rate := sxy / sxx
+	r2 := 1.0
+	if syy > 0 {
+		r2 = math.Min(sxy*sxy/(sxx*syy), 1)
+	}
+	tLast := float64(b.last-b.start) / float64(time.Hour)
+	f := batteryForecast{
+		LevelPct:       math.Max(ml+rate*(tLast-mt), 0),
+		RatePctPerHour: rate,
+		R2:             r2,
+		Samples:        b.samples,
+		Charges:        b.charges,
+	}
+
+	switch {
+	case rate > battMinRate:
+		f.State = battCharging
+	case rate > -battMinRate:
+		f.State = battStable
+	default:
+		f.State = battDischarging
+		hours := f.LevelPct / -rate
+		f.EmptyAtNs = b.last + int64(hours*float64(time.Hour))
+		f.HoursToEmpty = math.Max(float64(f.EmptyAtNs-now)/float64(time.Hour), 0)
+	}
+
+	switch {
+	case r2 >= 0.9 && b.samples >= 3*battMinSamples && span >= int64(time.Hour):
+		f.Confidence = battConfHigh
+	case r2 >= 0.6:
+		f.Confidence = battConfMedium
+	default:
+		f.Confidence = battConfLow
+	}
+	return f, true
+}
+
+// deviceBattery returns battery forecast of device at time now (nil if not enough readings)
+func (s *Server) deviceBattery(imei string, now int64) *batteryForecast {
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok {
+		return nil
+	}
+	ds.mux.Lock()
+	f, ok := ds.battery.forecast(now)
+	ds.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	return &f
+}
+
+// v1DeviceBattery battery forecast of device
+type v1DeviceBattery struct {
+	IMEI    string          `json:"imei"`
+	Battery batteryForecast `json:"battery"`
+}
+
+// v1BatteryFleet devices predicted to be empty within hours, by empty time
+type v1BatteryFleet struct {
+	Hours   float64           `json:"hours"`
+	Devices []v1DeviceBattery `json:"devices"`
+}
+
+// batteryFleet returns devices discharging to empty within hours of time now (ordered by empty time)
+func (s *Server) batteryFleet(now int64, hours float64) *v1BatteryFleet {
+	fleet := &v1BatteryFleet{Hours: hours, Devices: []v1DeviceBattery{}}
+	for _, ds := range s.pipe.devs.list() {
+		ds.mux.Lock()
+		f, ok := ds.battery.forecast(now)
+		ds.mux.Unlock()
+		if !ok || f.State != battDischarging || f.HoursToEmpty > hours {
+			continue
+		}
+		fleet.Devices = append(fleet.Devices, v1DeviceBattery{IMEI: ds.imei, Battery: f})
+	}
+	sort.Slice(fleet.Devices, func(i, j int) bool {
+		return fleet.Devices[i].Battery.EmptyAtNs < fleet.Devices[j].Battery.EmptyAtNs
+	})
+	return fleet
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testBattery returns battery trend of readings each minute with levels
+func testBattery(levels func(min int) float64, mins int) *devBattery {
+	b := &devBattery{}
+	for i := 0; i < mins; i++ {
+		b.add(int64(i)*int64(time.Minute), levels(i))
+	}
+	return b
+}
+
+func Test_devBattery_forecast(t *testing.T) {
+
+	// deterministic noise of +-2 pct
+	noise := func(i int) float64 { return 2 * math.Sin(float64(i)*1.7) }
+
+	testCases := []struct {
+		name   string
+		levels func(min int) float64
+		mins   int
+		// expected forecast, state, rate (pct per hour), min confidence
+		ok    bool
+		state string
+		rate  float64
+		conf  string
+	}{
+		// Positive
+		{name: "steady discharge", levels: func(i int) float64 { return 80 - float64(i)/60 }, mins: 120,
+			ok: true, state: battDischarging, rate: -1, conf: battConfHigh},
+		{name: "noisy discharge", levels: func(i int) float64 { return 80 - float64(i)/30 + noise(i) }, mins: 240,
+			ok: true, state: battDischarging, rate: -2, conf: battConfMedium},
+		{name: "charging jump resets trend", levels: func(i int) float64 {
+			if i < 60 {
+				return 40 - float64(i)/6
+			}
+			return 90 - float64(i-60)/60
+		}, mins: 180, ok: true, state: battDischarging, rate: -1, conf: battConfHigh},
+		{name: "stable", levels: func(i int) float64 { return 70 }, mins: 60, ok: true, state: battStable},
+		{name: "slow charging", levels: func(i int) float64 { return 20 + float64(i)/60 }, mins: 120, ok: true, state: battCharging, rate: 1},
+		// Negative
+		{name: "few readings", levels: func(i int) float64 { return 80 - float64(i) }, mins: battMinSamples - 1},
+		{name: "short span", levels: func(i int) float64 { return 80 - float64(i) }, mins: 5},
+	}
+
+	for _, tc := range testCases {
+
+		b := testBattery(tc.levels, tc.mins)
+		now := b.last
+		f, ok := b.forecast(now)
+		if ok != tc.ok {
+			t.Fatalf("%v: expected forecast %v, got %v", tc.name, tc.ok, ok)
+		}
+		if !ok {
+			t.Logf("%v: test ok", tc.name)
+			continue
+		}
+		if f.State != tc.state {
+			t.Fatalf("%v: expected state %v, got %+v", tc.name, tc.state, f)
+		}
+		if tc.rate != 0 && math.Abs(f.RatePctPerHour-tc.rate) > 0.1*math.Abs(tc.rate) {
+			t.Fatalf("%v: expected rate %v, got %+v", tc.name, tc.rate, f)
+		}
+		if tc.state == battDischarging {
+			if hours := f.LevelPct / -f.RatePctPerHour; math.Abs(f.HoursToEmpty-hours) > 0.01 ||
+				math.Abs(float64(f.EmptyAtNs-now)-f.HoursToEmpty*float64(time.Hour)) > float64(time.Millisecond) {
+				t.Fatalf("%v: wrong time to empty %+v", tc.name, f)
+			}
+		} else if f.HoursToEmpty != 0 || f.EmptyAtNs != 0 {
+			t.Fatalf("%v: time to empty should not be set %+v", tc.name, f)
+		}
+		if tc.conf == battConfHigh && f.Confidence != battConfHigh ||
+			tc.conf == battConfMedium && f.Confidence == battConfLow {
+			t.Fatalf("%v: expected confidence %v, got %+v", tc.name, tc.conf, f)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// single outlier above smoothed level is not charging
+	b := testBattery(func(i int) float64 {
+		if i == 60 {
+			return 80 - float64(i)/60 + battChargeJump + 1
+		}
+		return 80 - float64(i)/60
+	}, 120)
+	if f, ok := b.forecast(b.last); !ok || f.Charges != 0 || f.Samples != 119 || f.State != battDischarging ||
+		math.Abs(f.RatePctPerHour+1) > 0.1 {
+		t.Fatalf("single outlier should not reset discharge trend, got %+v", f)
+	}
+
+	// out of order reading ignored
+	b = testBattery(func(i int) float64 { return 80 - float64(i)/60 }, 60)
+	last := *b
+	b.add(0, 10)
+	if *b != last {
+		t.Fatalf("out of order reading should be ignored")
+	}
+}
+
+func Test_Server_batteryFleet(t *testing.T) {
+
+	s := New(Config{}, testOutLog)
+	now := time.Now().UnixNano()
+	// discharging 10 pct per hour, 1 pct per hour, stable
+	rates := map[string]float64{"490154203237518": 10, "490154203237526": 1, "356938035643809": 0}
+	for imei, rate := range rates {
+		ds := s.pipe.devs.get(imei)
+		for i := 0; i < 60; i++ {
+			ds.battery.add(now-int64(60-i)*int64(time.Minute), 50-rate*float64(i)/60)
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		path  string
+		code  int
+		imeis []string
+	}{
+		// Positive
+		{name: "default horizon", path: "/api/v1/fleet/battery", code: http.StatusOK, imeis: []string{"490154203237518"}},
+		{name: "long horizon", path: "/api/v1/fleet/battery?hours=100", code: http.StatusOK, imeis: []string{"490154203237518", "490154203237526"}},
+		// Negative
+		{name: "wrong hours", path: "/api/v1/fleet/battery?hours=-1", code: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v (%s)", tc.name, tc.code, rec.Code, rec.Body.Bytes())
+		}
+		if tc.code == http.StatusOK {
+			fleet := v1BatteryFleet{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &fleet); err != nil || len(fleet.Devices) != len(tc.imeis) {
+				t.Fatalf("%v: wrong fleet response %s, %v", tc.name, rec.Body.Bytes(), err)
+			}
+			for i, imei := range tc.imeis {
+				if fleet.Devices[i].IMEI != imei {
+					t.Fatalf("%v: expected device %v at %v, got %v", tc.name, imei, i, fleet.Devices[i].IMEI)
+				}
+			}
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// forecast on device status
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status/490154203237518", nil))
+	sts := deviceStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &sts); err != nil || sts.Battery == nil || sts.Battery.State != battDischarging {
+		t.Fatalf("wrong device status %s, %v", rec.Body.Bytes(), err)
+	}
+	// forecast on device reading (device offline)
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/reading", nil))
+	dr := v1DeviceReading{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dr); err != nil || dr.Battery == nil || dr.Battery.State != battDischarging {
+		t.Fatalf("wrong device reading %s, %v", rec.Body.Bytes(), err)
+	}
+}
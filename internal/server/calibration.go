@@ -0,0 +1,352 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// calibration actions of history
+const (
+	calibAdd    = "add"
+	calibDelete = "delete"
+)
+
+// fieldCalibration linear calibration of Reading message field: value*gain + offset
+type fieldCalibration struct {
+	Offset float64 `json:"offset"`
+	Gain   float64 `json:"gain"`
+}
+
+// UnmarshalJSON decodes field calibration, gain is 1 if not set
+func (fc *fieldCalibration) UnmarshalJSON(b []byte) error {
+	type fieldCalib fieldCalibration
+	c := fieldCalib{Gain: 1}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	*fc = fieldCalibration(c)
+	return nil
+}
+
+// calibrationEntry calibration of device fields valid in time range
+type calibrationEntry struct {
+	ID      int64             `json:"id"`
+	Temp    *fieldCalibration `json:"temp,omitempty"`
+	Alt     *fieldCalibration `json:"alt,omitempty"`
+	Lat     *fieldCalibration `json:"lat,omitempty"`
+	Lon     *fieldCalibration `json:"lon,omitempty"`
+	BattLev *fieldCalibration `json:"batt_lev,omitempty"`
+	// valid time range (unix nano), unbounded if zero
+	From int64 `json:"from,omitempty"`
+	To   int64 `json:"to,omitempty"`
+	// entry add time (unix nano)
+	Created int64 `json:"created"`
+}
+
+// calibrationChange history record of device calibration
+type calibrationChange struct {
+	Time   int64            `json:"time"`
+	Action string           `json:"action"`
+	Entry  calibrationEntry `json:"entry"`
+}
+
+// deviceCalibration calibration entries of device and history of changes
+type deviceCalibration struct {
+	IMEI    string              `json:"imei"`
+	Entries []calibrationEntry  `json:"entries"`
+	History []calibrationChange `json:"history"`
+}
+
+// valid if entry time range contains time t
+func (e *calibrationEntry) valid(t int64) bool {
+	return (e.From == 0 || t >= e.From) && (e.To == 0 || t < e.To)
+}
+
+// apply calibrates Reading message fields
+func (e *calibrationEntry) apply(rm *readingMessage) {
+	if c := e.Temp; c != nil {
+		rm.Temp = rm.Temp*c.Gain + c.Offset
+	}
+	if c := e.Alt; c != nil {
+		rm.Alt = rm.Alt*c.Gain + c.Offset
+	}
+	if c := e.Lat; c != nil {
+		rm.Lat = rm.Lat*c.Gain + c.Offset
+	}
+	if c := e.Lon; c != nil {
+		rm.Lon = rm.Lon*c.Gain + c.Offset
+	}
+	if c := e.BattLev; c != nil {
+		rm.BattLev = rm.BattLev*c.Gain + c.Offset
+	}
+}
+
+// validate checks calibration entry of request
+func (e *calibrationEntry) validate() error {
+	if e.Temp == nil && e.Alt == nil && e.Lat == nil && e.Lon == nil && e.BattLev == nil {
+		return errors.New("no field calibration")
+	}
+	for _, fc := range []*fieldCalibration{e.Temp, e.Alt, e.Lat, e.Lon, e.BattLev} {
+		if fc == nil {
+			continue
+		}
+		if classifyFloat64(fc.Offset, 0) != reasonNone || classifyFloat64(fc.Gain, 0) != reasonNone || fc.Gain == 0 {
+			return errors.New("offset and gain should be finite, gain not zero")
+		}
+	}
+	if e.From != 0 && e.To != 0 && e.From >= e.To {
+		return errors.New("from should be before to")
+	}
+	return nil
+}
+
+// calibStore calibrations of devices by IMEI, persisted to file if path set
+type calibStore struct {
+	mux     sync.RWMutex
+	devices map[string]*deviceCalibration
+	lastID  int64
+
+	path string
+}
+
+// inits calibration store, loads calibrations from file if path set
+func newCalibStore(path string) *calibStore {
+	cs := &calibStore{
+		devices: make(map[string]*deviceCalibration),
+		path:    path,
+	}
+	if path == "" {
+		return cs
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cs
+	} else if err != nil {
+		log.Printf("calibration file read err: %v", err)
+		return cs
+	}
+	if err := json.Unmarshal(b, &cs.devices); err != nil {
+		log.Printf("calibration file unmarshal err: %v", err)
+		return cs
+	}
+	for _, dc := range cs.devices {
+		for _, c := range dc.History {
+			if c.Entry.ID > cs.lastID {
+				cs.lastID = c.Entry.ID
+			}
+		}
+	}
+	log.Printf("calibrations of %v devices loaded", len(cs.devices))
+	return cs
+}
+
+// apply calibrates Reading message of device by last added entry valid at time t,
+// returns false if device has no valid entry
+func (cs *calibStore) apply(imei string, t int64, rm *readingMessage) bool {
+	cs.mux.RLock()
+	defer cs.mux.RUnlock()
+	dc, ok := cs.devices[imei]
+	if !ok {
+		return false
+	}
+	for i := len(dc.Entries) - 1; i >= 0; i-- {
+		if dc.Entries[i].valid(t) {
+			dc.Entries[i].apply(rm)
+			return true
+		}
+	}
+	return false
+}
+
+// add adds calibration entry of device (not added if save failed)
+func (cs *calibStore) add(imei string, e calibrationEntry, now int64) (calibrationEntry, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.lastID++
+	e.ID = cs.lastID
+	e.Created = now
+	dc, ok := cs.devices[imei]
+	if !ok {
+		dc = &deviceCalibration{IMEI: imei}
+		cs.devices[imei] = dc
+	}
+	dc.Entries = append(dc.Entries, e)
+	dc.History = append(dc.History, calibrationChange{Time: now, Action: calibAdd, Entry: e})
+	if err := cs.save(); err != nil {
+		// rollback
+		dc.Entries = dc.Entries[:len(dc.Entries)-1]
+		dc.History = dc.History[:len(dc.History)-1]
+		if !ok {
+			delete(cs.devices, imei)
+		}
+		cs.lastID--
+		return calibrationEntry{}, err
+	}
+	return e, nil
+}
+
+// delete deletes calibration entry of device by id (all entries if id is zero),
+// returns false if entry not found (not deleted if save failed)
+func (cs *calibStore) delete(imei string, id int64, now int64) (bool, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	dc, ok := cs.devices[imei]
+	if !ok {
+		return false, nil
+	}
+	old, historyLen := dc.Entries, len(dc.History)
+	entries := make([]calibrationEntry, 0, len(dc.Entries))
+	for _, e := range dc.Entries {
+		if id == 0 || e.ID == id {
+			dc.History = append(dc.History, calibrationChange{Time: now, Action: calibDelete, Entry: e})
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == len(old) {
+		return false, nil
+	}
+	dc.Entries = entries
+	if err := cs.save(); err != nil {
+		// rollback
+		dc.Entries, dc.History = old, dc.History[:historyLen]
+		return true, err
+	}
+	return true, nil
+}
+
+// get returns copy of device calibration
+func (cs *calibStore) get(imei string) deviceCalibration {
+	cs.mux.RLock()
+	defer cs.mux.RUnlock()
+	dc := deviceCalibration{IMEI: imei, Entries: []calibrationEntry{}, History: []calibrationChange{}}
+	if d, ok := cs.devices[imei]; ok {
+		dc.Entries = append(dc.Entries, d.Entries...)
+		dc.History = append(dc.History, d.History...)
+	}
+	return dc
+}
+
+// save saves calibrations to file (should be called under lock)
+func (cs *calibStore) save() error {
+	if cs.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(cs.devices)
+	if err != nil {
+		return err
+	}
+	tmp := cs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.path)
+}
+
+// calibration manages calibration of device, path /admin/calibration/:imei[/:id] (admin token required):
+// GET returns entries and history, POST adds entry, DELETE deletes entry by id (all entries if no id)
+func (s *Server) calibration(w http.ResponseWriter, req *http.Request) {
+	if !s.adminAuthorized(w, req) {
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/admin/calibration/"), "/")
+	imei, err := validParseIMEIString(path[0])
+	if err != nil || len(path) > 2 {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	var id int64
+	if len(path) == 2 {
+		if id, err = strconv.ParseInt(path[1], 10, 64); err != nil || id <= 0 || req.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusNotFound)
+			if _, err := w.Write([]byte("404 Not Found")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+	}
+
+	now := time.Now().UnixNano()
+	var resp interface{}
+	switch req.Method {
+	case http.MethodGet:
+		dc := s.pipe.calibs.get(imei)
+		resp = &dc
+	case http.MethodPost:
+		e := calibrationEntry{}
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<16)).Decode(&e)
+		if err == nil {
+			err = e.validate()
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte("400 Bad Request: " + err.Error())); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		e, err = s.pipe.calibs.add(imei, e, now)
+		if err != nil {
+			log.Printf("calibration, imei - %v, save err: %v", imei, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			if _, err := w.Write([]byte("500 Calibration Not Saved")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		log.Printf("calibration, imei - %v, entry added %+v", imei, e)
+		resp = &e
+	case http.MethodDelete:
+		ok, err := s.pipe.calibs.delete(imei, id, now)
+		if err != nil {
+			log.Printf("calibration, imei - %v, save err: %v", imei, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			if _, err := w.Write([]byte("500 Calibration Not Saved")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if _, err := w.Write([]byte("404 Not Found")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		log.Printf("calibration, imei - %v, entry %v deleted", imei, id)
+		dc := s.pipe.calibs.get(imei)
+		resp = &dc
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		if _, err := w.Write([]byte("405 Method Not Allowed")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// response
+	out, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_calibStore_apply(t *testing.T) {
+
+	cs := newCalibStore("")
+	if _, err := cs.add("490154203237518", calibrationEntry{Temp: &fieldCalibration{Offset: -1.5, Gain: 1}}, 1); err != nil {
+		t.Fatalf("add calibration err: %v", err)
+	}
+	if _, err := cs.add("490154203237518", calibrationEntry{Temp: &fieldCalibration{Offset: 0, Gain: 2}, From: 100, To: 200}, 2); err != nil {
+		t.Fatalf("add calibration err: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		imei       string
+		t          int64
+		temp       float64
+		calibrated bool
+	}{
+		{name: "offset entry", imei: "490154203237518", t: 99, temp: 8.5, calibrated: true},
+		{name: "time range entry", imei: "490154203237518", t: 100, temp: 20, calibrated: true},
+		{name: "after time range", imei: "490154203237518", t: 200, temp: 8.5, calibrated: true},
+		{name: "not calibrated device", imei: "356938035643809", t: 100, temp: 10, calibrated: false},
+	}
+
+	for _, tc := range testCases {
+
+		rm := readingMessage{Temp: 10}
+		ok := cs.apply(tc.imei, tc.t, &rm)
+		if ok != tc.calibrated || rm.Temp != tc.temp {
+			t.Fatalf("%v: expected temp %v (calibrated %v), got %v (%v)", tc.name, tc.temp, tc.calibrated, rm.Temp, ok)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_pipeline_reading_Calibration(t *testing.T) {
+
+	var out bytes.Buffer
+	p := newPipeline(log.New(&out, "", 0), newServerStats())
+	if _, err := p.calibs.add("490154203237518", calibrationEntry{Temp: &fieldCalibration{Offset: -2, Gain: 1}}, 1); err != nil {
+		t.Fatalf("add calibration err: %v", err)
+	}
+
+	// raw temp out of range, calibrated in range
+	r := decodedReading{}
+	if !p.reading(1, p.devs.get("490154203237518"), testFrame(readingMessage{Temp: 301, BattLev: 1}), &r) {
+		t.Fatalf("calibrated message should be valid: %+v", r)
+	}
+	drs := r.status(1)
+	if drs.Reading.Temp != 299 || drs.Raw == nil || drs.Raw.Temp != 301 {
+		t.Fatalf("wrong calibrated reading status %+v", drs)
+	}
+	if !strings.HasPrefix(out.String(), "1,490154203237518,299.000000,") {
+		t.Fatalf("calibrated message should be logged to output: %q", out.String())
+	}
+}
+
+func Test_Server_readings_Raw(t *testing.T) {
+
+	s := New(Config{HistorySize: 10}, testOutLog)
+	if _, err := s.pipe.calibs.add("490154203237518", calibrationEntry{Temp: &fieldCalibration{Offset: -2, Gain: 1}}, 1); err != nil {
+		t.Fatalf("add calibration err: %v", err)
+	}
+	s.pipe.reading(1, s.pipe.devs.get("490154203237518"), testFrame(readingMessage{Temp: 301, BattLev: 1}), &decodedReading{})
+	s.pipe.reading(2, s.pipe.devs.get("490154203237526"), testFrame(readingMessage{Temp: 7, BattLev: 1}), &decodedReading{})
+
+	// raw reading kept in history
+	hrs := s.pipe.history("490154203237518", math.MinInt64, math.MaxInt64)
+	if len(hrs) != 1 || hrs[0].msg.Temp != 299 || hrs[0].raw.Temp != 301 || !hrs[0].calibrated {
+		t.Fatalf("raw reading should be kept in history, got %+v", hrs)
+	}
+
+	// last reading of offline device, raw reading of calibrated device only
+	for imei, raw := range map[string]bool{"490154203237518": true, "490154203237526": false} {
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readings/"+imei, nil))
+		drs := deviceReadingStatus{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &drs); err != nil {
+			t.Fatalf("%v: response unmarshal err: %v", imei, err)
+		}
+		if drs.Status != "offline" || drs.Time == 0 || (drs.Raw != nil) != raw || (raw && drs.Raw.Temp != 301) {
+			t.Fatalf("%v: wrong last reading %s", imei, rec.Body.Bytes())
+		}
+	}
+}
+
+func Test_Server_calibration(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "calibration")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "calibration.json")
+
+	s := New(Config{CalibrationFile: path, AdminToken: "secret"}, testOutLog)
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		// Positive
+		{name: "add entry", method: "POST", path: "/admin/calibration/490154203237518", body: `{"temp":{"offset":-1.5}}`, code: http.StatusOK},
+		{name: "add entry 2", method: "POST", path: "/admin/calibration/490154203237518", body: `{"alt":{"gain":1.1},"from":1,"to":2}`, code: http.StatusOK},
+		{name: "delete entry", method: "DELETE", path: "/admin/calibration/490154203237518/2", code: http.StatusOK},
+		{name: "get entries", method: "GET", path: "/admin/calibration/490154203237518", code: http.StatusOK},
+		// Negative
+		{name: "no field calibration", method: "POST", path: "/admin/calibration/490154203237518", body: `{}`, code: http.StatusBadRequest},
+		{name: "zero gain", method: "POST", path: "/admin/calibration/490154203237518", body: `{"temp":{"gain":0}}`, code: http.StatusBadRequest},
+		{name: "wrong time range", method: "POST", path: "/admin/calibration/490154203237518", body: `{"temp":{"offset":1},"from":2,"to":1}`, code: http.StatusBadRequest},
+		{name: "delete unknown entry", method: "DELETE", path: "/admin/calibration/490154203237518/7", code: http.StatusNotFound},
+		{name: "invalid imei", method: "GET", path: "/admin/calibration/490154203237519", code: http.StatusNotFound},
+		{name: "wrong method", method: "PUT", path: "/admin/calibration/490154203237518", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+
+		rec := testAdminRequest(s, tc.method, tc.path, "secret", tc.body)
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v: %v", tc.name, tc.code, rec.Code, rec.Body.String())
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// calibration and history loaded from file
+	s = New(Config{CalibrationFile: path, AdminToken: "secret"}, testOutLog)
+	rec := testAdminRequest(s, "GET", "/admin/calibration/490154203237518", "secret", "")
+	dc := deviceCalibration{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dc); err != nil {
+		t.Fatalf("calibration response unmarshal err: %v", err)
+	}
+	if len(dc.Entries) != 1 || dc.Entries[0].Temp == nil || dc.Entries[0].Temp.Gain != 1 || dc.Entries[0].Temp.Offset != -1.5 {
+		t.Fatalf("wrong calibration entries %+v", dc.Entries)
+	}
+	if len(dc.History) != 3 || dc.History[2].Action != calibDelete || dc.History[2].Entry.ID != 2 {
+		t.Fatalf("wrong calibration history %+v", dc.History)
+	}
+}
+
+func Test_Server_calibration_SaveErr(t *testing.T) {
+
+	// calibration file of not existing directory
+	s := New(Config{CalibrationFile: filepath.Join(os.TempDir(), "not-exists", "calibration.json"), AdminToken: "secret"}, testOutLog)
+
+	rec := testAdminRequest(s, "POST", "/admin/calibration/490154203237518", "secret", `{"temp":{"offset":-1.5}}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected code %v, got %v: %v", http.StatusInternalServerError, rec.Code, rec.Body.String())
+	}
+	if dc := s.pipe.calibs.get("490154203237518"); len(dc.Entries) != 0 || len(dc.History) != 0 {
+		t.Fatalf("not saved calibration should be rolled back: %+v", dc)
+	}
+	rm := readingMessage{Temp: 10}
+	if s.pipe.calibs.apply("490154203237518", 1, &rm) || rm.Temp != 10 {
+		t.Fatalf("not saved calibration should not be applied")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"log"
-	"net"
 	"sync"
 	"time"
 )
@@ -69,21 +68,14 @@ func (c *TestClient) Error() <-chan error {
 func (c *TestClient) run() error {
 	defer c.wg.Done()
 
-	// connect
-	conn, err := net.Dial("tcp", c.conf.SrvAddr)
+	// connect, send login (IMEI)
+	conn, err := dialLogin(c.conf.SrvAddr, c.conf.IMEI[:])
 	if err != nil {
 		log.Printf("client conn err: %v", err)
 		return err
 	}
 	defer conn.Close()
 	log.Printf("client addr - %v, connected to server - %v", conn.LocalAddr(), conn.RemoteAddr())
-
-	// send login (IMEI)
-	_, err = conn.Write(c.conf.IMEI[:])
-	if err != nil {
-		log.Printf("client, addr = %v, send imei err: %v", conn.LocalAddr(), err)
-		return err
-	}
 	log.Printf("client, addr - %v, imei sent - %v", conn.LocalAddr(), c.conf.IMEI)
 
 	for {
@@ -0,0 +1,121 @@
+package server
+
+// timestamps protocol extension: device negotiates timestamps by login IMEI with
+// tsLoginFlag set in first byte, server confirms by tsAck, then each message is
+// device time (unix nano, int64 Big-Endian, zero if unknown) and Reading message
+const (
+	tsLoginFlag = 0x80
+	tsAck       = 0x06
+	tsLength    = 8
+)
+
+// device clock estimation
+const (
+	// readings of min offset window (clock skew is min offset of last two windows)
+	clockWindow = 100
+	// jitter smoothing factor (1/8 like TCP smoothed RTT)
+	clockJitterShift = 3
+)
+
+// TimeSource time of output records
+type TimeSource string
+
+const (
+	// TimeServer receive time of server (default)
+	TimeServer TimeSource = "server"
+	// TimeDevice device time if supplied by device, receive time otherwise
+	TimeDevice TimeSource = "device"
+)
+
+// devClock clock of device estimated by device timestamps
+type devClock struct {
+	// readings with device time, rejected implausible timestamps by reason
+	readings int64
+	rejected [reasonsNum]int64
+	// last offset (receive time - device time)
+	offset int64
+	// min offsets of current and previous windows
+	winMin  int64
+	prevMin int64
+	winN    int
+	// smoothed jitter: delay of readings relative to least delayed reading (offset above clock skew),
+	// true transport latency is unknown as device clock is not synchronized
+	jitter int64
+}
+
+// add updates clock by offset of device reading
+func (c *devClock) add(offset int64) {
+	c.readings++
+	c.offset = offset
+	if c.winN == 0 || offset < c.winMin {
+		c.winMin = offset
+	}
+	c.winN++
+	if c.readings == 1 {
+		c.prevMin = offset
+	}
+	delay := offset - c.skew()
+	c.jitter += (delay - c.jitter) >> clockJitterShift
+	if c.winN == clockWindow {
+		c.prevMin, c.winN = c.winMin, 0
+	}
+}
+
+// skew returns clock skew of device (receive time - device time of least delayed reading),
+// positive if device clock is behind
+func (c *devClock) skew() int64 {
+	if c.winN > 0 && c.winMin < c.prevMin {
+		return c.winMin
+	}
+	return c.prevMin
+}
+
+// checkTime returns reason if device time is implausible: ahead of receive time
+// more than max future or behind more than max age (checks disabled if zero)
+func (p *pipeline) checkTime(now, devTime int64) invalidReason {
+	if devTime < 0 {
+		return reasonBelowMin
+	}
+	if p.tsMaxFuture > 0 && devTime-now > p.tsMaxFuture {
+		return reasonAboveMax
+	}
+	if p.tsMaxAge > 0 && now-devTime > p.tsMaxAge {
+		return reasonBelowMin
+	}
+	return reasonNone
+}
+
+// deviceClock device clock (JSON), offsets in nanoseconds
+type deviceClock struct {
+	IMEI     string           `json:"imei"`
+	Readings int64            `json:"readings"`
+	Rejected map[string]int64 `json:"rejected"`
+	Skew     int64            `json:"skew"`
+	Jitter   int64            `json:"jitter"`
+	Offset   int64            `json:"last_offset"`
+}
+
+// deviceClock returns clock skew and jitter of device
+func (s *Server) deviceClock(imei string) *deviceClock {
+	dc := &deviceClock{IMEI: imei, Rejected: make(map[string]int64)}
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok {
+		return dc
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	c := &ds.clock
+	for r, n := range c.rejected {
+		if n > 0 {
+			dc.Rejected[invalidReason(r).String()] = n
+		}
+	}
+	if c.readings == 0 {
+		return dc
+	}
+	dc.Readings = c.readings
+	dc.Skew = c.skew()
+	dc.Jitter = c.jitter
+	dc.Offset = c.offset
+	return dc
+}
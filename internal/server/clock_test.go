@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Device_Timestamps(t *testing.T) {
+
+	srvConn, clnConn := net.Pipe()
+	var out bytes.Buffer
+	p := newPipeline(log.New(&out, "", 0), newServerStats())
+	p.outTime = TimeDevice
+	p.tsMaxFuture = int64(time.Minute)
+	p.tsMaxAge = int64(time.Hour)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	d := newDevice(devConfig{loginDeadline: time.Second, messageDeadline: time.Second}, srvConn, p, &wg, make(chan struct{}, 1), newDevStorage())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.run()
+	}()
+
+	// login with timestamps flag, ack
+	login := append([]byte{}, testIMEI...)
+	login[0] |= tsLoginFlag
+	if _, err := clnConn.Write(login); err != nil {
+		t.Fatalf("client conn write imei err: %v", err)
+	}
+	ack := make([]byte, 1)
+	if _, err := clnConn.Read(ack); err != nil || ack[0] != tsAck {
+		t.Fatalf("expected timestamps ack, got %v, %v", ack, err)
+	}
+
+	now := time.Now().UnixNano()
+	devTimes := []int64{
+		now - int64(time.Second), now - int64(time.Second)*3, now - int64(time.Millisecond)*1500,
+		// implausible
+		now + int64(time.Hour), now - int64(time.Hour)*2, -1,
+	}
+	for _, dt := range devTimes {
+		msg := make([]byte, tsLength+msgLength)
+		binary.BigEndian.PutUint64(msg, uint64(dt))
+		messageBytes(&readingMessage{Temp: 1, BattLev: 1}, msg[tsLength:])
+		if _, err := clnConn.Write(msg); err != nil {
+			t.Fatalf("client conn write message err: %v", err)
+		}
+	}
+	clnConn.Close()
+	<-errs
+
+	// output records with device time
+	records := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(records) != 3 {
+		t.Fatalf("expected %v output records, got %q", 3, out.String())
+	}
+	for i, rec := range records {
+		if !strings.HasPrefix(rec, strconv.FormatInt(devTimes[i], 10)+",490154203237518,") {
+			t.Fatalf("output record should have device time %v, got %q", devTimes[i], rec)
+		}
+	}
+
+	// clock skew about 1s (least delayed reading), jitter of delayed readings
+	dc := (&Server{pipe: p}).deviceClock("490154203237518")
+	if dc.Readings != 3 || dc.Skew < int64(time.Second) || dc.Skew > int64(time.Second)*2 || dc.Jitter <= 0 ||
+		dc.Rejected["above max"] != 1 || dc.Rejected["below min"] != 2 {
+		t.Fatalf("wrong device clock %+v", dc)
+	}
+	if dv := (&Server{pipe: p}).deviceValidation("490154203237518"); dv.Valid != 3 || dv.Invalid != 3 {
+		t.Fatalf("implausible timestamps should be invalid, got %+v", dv)
+	}
+}
+
+func Test_devClock_add(t *testing.T) {
+
+	testCases := []struct {
+		name    string
+		offsets []int64
+		skew    int64
+		jitter  int64
+	}{
+		{name: "constant offset", offsets: []int64{100, 100, 100}, skew: 100, jitter: 0},
+		{name: "delayed reading", offsets: []int64{100, 900}, skew: 100, jitter: 100},
+		{name: "min offset", offsets: []int64{500, 100, 100}, skew: 100, jitter: 0},
+	}
+
+	for _, tc := range testCases {
+
+		c := devClock{}
+		for _, o := range tc.offsets {
+			c.add(o)
+		}
+		if c.skew() != tc.skew || c.jitter != tc.jitter {
+			t.Fatalf("%v: expected skew %v, jitter %v, got %v, %v", tc.name, tc.skew, tc.jitter, c.skew(), c.jitter)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// skew follows clock drift after windows
+	c := devClock{}
+	for i := 0; i < clockWindow*2; i++ {
+		c.add(100)
+	}
+	for i := 0; i < clockWindow*2; i++ {
+		c.add(300)
+	}
+	if c.skew() != 300 {
+		t.Fatalf("skew should follow drift, got %v", c.skew())
+	}
+}
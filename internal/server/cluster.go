@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cluster defaults
+const (
+	clusterGossipPeriod = time.Second
+	clusterNodeTimeout  = time.Second * 5
+	clusterTimeout      = time.Second * 2
+	// max difference of gossip time and time of node (replayed gossip rejected)
+	clusterMaxSkew = time.Second * 30
+)
+
+// header of cluster request forwarded by node (not forwarded again)
+const clusterForwardedHeader = "X-Cluster-Forwarded"
+
+// headers of node request signature: hex HMAC-SHA256 by shared cluster key of gossip body
+// (gossip) or of method, request URI and send time (unix nano) of time header (other node requests)
+const (
+	clusterSignatureHeader = "X-Cluster-Signature"
+	clusterTimeHeader      = "X-Cluster-Time"
+)
+
+// ClusterConfig configs of cluster node, nodes gossip membership and devices connected to them
+// by HTTP (POST /cluster/gossip)
+type ClusterConfig struct {
+	// node id (advertise address if empty), HTTP address of node reachable by other nodes
+	NodeID    string
+	Advertise string
+	// HTTP addresses of seed nodes
+	Peers []string
+
+	// gossip period, node is dead if not heard for node timeout
+	GossipPeriod time.Duration
+	NodeTimeout  time.Duration
+	// shared key of cluster nodes (required): node requests and gossip responses are signed by it,
+	// signed node requests are authenticated with scopes cluster and readings (API keys enabled)
+	Key string
+}
+
+// clusterMember node of cluster
+type clusterMember struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// clusterGossip gossip message of node: node, its connected devices and members known by node
+type clusterGossip struct {
+	clusterMember
+	// send time (unix nano)
+	Time    int64           `json:"time"`
+	Devices []string        `json:"devices"`
+	Members []clusterMember `json:"members"`
+}
+
+// clusterNode state of other node
+type clusterNode struct {
+	addr string
+	// last heard time (unix nano)
+	seen    int64
+	devices map[string]struct{}
+}
+
+// cluster membership and devices directory of node
+type cluster struct {
+	conf   ClusterConfig
+	client *http.Client
+	// connected devices of node
+	local func() []string
+
+	mux   sync.Mutex
+	nodes map[string]*clusterNode
+	// addresses of members known by gossip and not heard yet (learn time)
+	learned map[string]int64
+	// signal of gossip round
+	kick chan struct{}
+}
+
+// inits cluster node
+func newCluster(conf ClusterConfig, local func() []string) (*cluster, error) {
+	if conf.Advertise == "" {
+		return nil, errors.New("cluster: advertise address required")
+	}
+	if conf.Key == "" {
+		return nil, errors.New("cluster: shared key required")
+	}
+	if conf.NodeID == "" {
+		conf.NodeID = conf.Advertise
+	}
+	if conf.GossipPeriod <= 0 {
+		conf.GossipPeriod = clusterGossipPeriod
+	}
+	if conf.NodeTimeout <= 0 {
+		conf.NodeTimeout = clusterNodeTimeout
+	}
+	c := &cluster{
+		conf:    conf,
+		client:  &http.Client{Timeout: clusterTimeout},
+		local:   local,
+		nodes:   make(map[string]*clusterNode),
+		learned: make(map[string]int64),
+		kick:    make(chan struct{}, 1),
+	}
+	return c, nil
+}
+
+// alive returns whether node heard not later than node timeout (should be used under lock)
+func (c *cluster) alive(n *clusterNode, now int64) bool {
+	return now-n.seen <= int64(c.conf.NodeTimeout)
+}
+
+// gossip returns gossip message of node
+func (c *cluster) gossip(now int64) *clusterGossip {
+	g := &clusterGossip{
+		clusterMember: clusterMember{ID: c.conf.NodeID, Addr: c.conf.Advertise},
+		Time:          now,
+		Devices:       c.local(),
+		Members:       []clusterMember{},
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for id, n := range c.nodes {
+		if c.alive(n, now) {
+			g.Members = append(g.Members, clusterMember{ID: id, Addr: n.addr})
+		}
+	}
+	return g
+}
+
+// merge merges gossip message heard from node: node state, unknown members
+func (c *cluster) merge(g *clusterGossip, now int64) {
+	if g.ID == c.conf.NodeID || g.ID == "" {
+		return
+	}
+	devices := make(map[string]struct{}, len(g.Devices))
+	for _, imei := range g.Devices {
+		devices[imei] = struct{}{}
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.nodes[g.ID] = &clusterNode{addr: g.Addr, seen: now, devices: devices}
+	delete(c.learned, g.Addr)
+	for _, m := range g.Members {
+		if _, ok := c.nodes[m.ID]; ok || m.ID == c.conf.NodeID {
+			continue
+		}
+		if _, ok := c.learned[m.Addr]; !ok {
+			c.learned[m.Addr] = now
+		}
+	}
+}
+
+// sign returns signature of gossip body
+func (c *cluster) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.conf.Key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks signature of gossip body, decodes gossip sent not earlier or later than max skew
+func (c *cluster) verify(body []byte, sig string, now int64) (*clusterGossip, error) {
+	if !hmac.Equal([]byte(sig), []byte(c.sign(body))) {
+		return nil, errors.New("cluster: wrong gossip signature")
+	}
+	g := &clusterGossip{}
+	if err := json.Unmarshal(body, g); err != nil {
+		return nil, err
+	}
+	if d := now - g.Time; d > int64(clusterMaxSkew) || d < -int64(clusterMaxSkew) {
+		return nil, errors.New("cluster: gossip time out of range")
+	}
+	return g, nil
+}
+
+// signRequest returns signature of node request (method, request URI) sent at time t
+func (c *cluster) signRequest(method, uri string, t int64) string {
+	return c.sign([]byte(method + " " + uri + " " + strconv.FormatInt(t, 10)))
+}
+
+// verifyRequest checks signature of node request sent not earlier or later than max skew
+// (signature of gossip body is checked by gossip handler)
+func (c *cluster) verifyRequest(req *http.Request, now int64) error {
+	if req.URL.Path == "/cluster/gossip" {
+		return nil
+	}
+	t, err := strconv.ParseInt(req.Header.Get(clusterTimeHeader), 10, 64)
+	if err != nil {
+		return errors.New("cluster: wrong request time")
+	}
+	sig := req.Header.Get(clusterSignatureHeader)
+	if !hmac.Equal([]byte(sig), []byte(c.signRequest(req.Method, req.URL.RequestURI(), t))) {
+		return errors.New("cluster: wrong request signature")
+	}
+	if d := now - t; d > int64(clusterMaxSkew) || d < -int64(clusterMaxSkew) {
+		return errors.New("cluster: request time out of range")
+	}
+	return nil
+}
+
+// owner returns other alive node (id, address) with connected device
+func (c *cluster) owner(imei string, now int64) (string, string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for id, n := range c.nodes {
+		if _, ok := n.devices[imei]; ok && c.alive(n, now) {
+			return id, n.addr, true
+		}
+	}
+	return "", "", false
+}
+
+// members returns alive nodes, sorted by id
+func (c *cluster) members(now int64) []clusterMember {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var ms []clusterMember
+	for id, n := range c.nodes {
+		if c.alive(n, now) {
+			ms = append(ms, clusterMember{ID: id, Addr: n.addr})
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID < ms[j].ID })
+	return ms
+}
+
+// changed signals gossip round (devices of node changed)
+func (c *cluster) changed() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run gossips with seeds and alive nodes each gossip period until done
+func (c *cluster) run(done <-chan struct{}) {
+	t := time.NewTicker(c.conf.GossipPeriod)
+	defer t.Stop()
+	for {
+		c.round()
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		case <-c.kick:
+		}
+	}
+}
+
+// round exchanges gossip with seeds, known nodes and learned members, forgets dead nodes
+func (c *cluster) round() {
+	now := time.Now().UnixNano()
+	addrs := make(map[string]bool)
+	for _, addr := range c.conf.Peers {
+		addrs[addr] = true
+	}
+	c.mux.Lock()
+	for id, n := range c.nodes {
+		if now-n.seen > int64(c.conf.NodeTimeout)*2 {
+			delete(c.nodes, id)
+			continue
+		}
+		addrs[n.addr] = true
+	}
+	for addr, t := range c.learned {
+		if now-t > int64(c.conf.NodeTimeout)*2 {
+			delete(c.learned, addr)
+			continue
+		}
+		addrs[addr] = true
+	}
+	c.mux.Unlock()
+	delete(addrs, c.conf.Advertise)
+
+	body, err := json.Marshal(c.gossip(now))
+	if err != nil {
+		log.Printf("cluster, gossip marshal err: %v", err)
+		return
+	}
+	for addr := range addrs {
+		g, err := c.exchange(addr, body)
+		if err != nil {
+			continue
+		}
+		c.merge(g, time.Now().UnixNano())
+	}
+}
+
+// exchange sends gossip to node, returns gossip of node
+func (c *cluster) exchange(addr string, body []byte) (*clusterGossip, error) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/cluster/gossip", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterSignatureHeader, c.sign(body))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("cluster: gossip response status " + resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return c.verify(b, resp.Header.Get(clusterSignatureHeader), time.Now().UnixNano())
+}
+
+// clusterGossip merges gossip of node signed by shared key, responds with signed gossip of this node (push-pull)
+func (s *Server) clusterGossip(w http.ResponseWriter, req *http.Request) {
+	if s.cluster == nil {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		if _, err := w.Write([]byte("405 Method Not Allowed")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err := w.Write([]byte("400 Bad Request: " + err.Error())); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	now := time.Now().UnixNano()
+	g, err := s.cluster.verify(body, req.Header.Get(clusterSignatureHeader), now)
+	if err != nil {
+		log.Printf("cluster, gossip from %v rejected: %v", req.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		if _, err := w.Write([]byte("401 Unauthorized")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	s.cluster.merge(g, now)
+
+	// response
+	out, err := json.Marshal(s.cluster.gossip(now))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(clusterSignatureHeader, s.cluster.sign(out))
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
+
+// clusterProxy proxies request to node signed by shared key (request is not forwarded again by node)
+func (s *Server) clusterProxy(w http.ResponseWriter, req *http.Request, addr string) {
+	preq, err := http.NewRequest(req.Method, "http://"+addr+req.URL.RequestURI(), nil)
+	if err != nil {
+		log.Printf("cluster, proxy request to %v err: %v", addr, err)
+		w.WriteHeader(http.StatusBadGateway)
+		if _, err := w.Write([]byte("502 Bad Gateway")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	t := time.Now().UnixNano()
+	preq.Header.Set(clusterForwardedHeader, s.cluster.conf.NodeID)
+	preq.Header.Set(clusterTimeHeader, strconv.FormatInt(t, 10))
+	preq.Header.Set(clusterSignatureHeader, s.cluster.signRequest(preq.Method, preq.URL.RequestURI(), t))
+	resp, err := s.cluster.client.Do(preq)
+	if err != nil {
+		log.Printf("cluster, proxy request to %v err: %v", addr, err)
+		w.WriteHeader(http.StatusBadGateway)
+		if _, err := w.Write([]byte("502 Bad Gateway")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClusterNode cluster node on loopback (device listener and HTTP server)
+type testClusterNode struct {
+	s  *Server
+	ts *httptest.Server
+}
+
+// testClusterStart starts cluster node with seed peers
+func testClusterStart(t *testing.T, id string, peers ...string) *testClusterNode {
+	return testClusterStartKeys(t, id, "", peers...)
+}
+
+// testClusterStartKeys starts cluster node with seed peers and API keys file (API keys disabled if empty)
+func testClusterStartKeys(t *testing.T, id, keysFile string, peers ...string) *testClusterNode {
+	ts := httptest.NewUnstartedServer(nil)
+	s := New(Config{
+		Addr: "127.0.0.1:0", LoginDeadline: time.Millisecond * 200, MsgDeadline: time.Millisecond * 200,
+		APIKeysFile: keysFile,
+		Cluster: &ClusterConfig{
+			NodeID: id, Advertise: ts.Listener.Addr().String(), Peers: peers,
+			GossipPeriod: time.Millisecond * 20, NodeTimeout: time.Millisecond * 200, Key: "cluster-key",
+		},
+	}, testOutLog)
+	ts.Config.Handler = s.httpHandler()
+	if err := s.Start(); err != nil {
+		t.Fatalf("node %v start err: %v", id, err)
+	}
+	ts.Start()
+	return &testClusterNode{s: s, ts: ts}
+}
+
+func (n *testClusterNode) stop() {
+	n.s.Stop()
+	n.s.Wait()
+	n.ts.Close()
+}
+
+// testClusterWait waits node condition
+func testClusterWait(t *testing.T, name string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: wait timeout", name)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// testClusterGet returns status code and JSON response of node
+func testClusterGet(t *testing.T, n *testClusterNode, path string, resp interface{}) int {
+	rec := httptest.NewRecorder()
+	n.s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			t.Fatalf("%v response unmarshal err: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func Test_Server_Cluster(t *testing.T) {
+
+	a := testClusterStart(t, "a")
+	defer a.stop()
+	b := testClusterStart(t, "b", a.s.cluster.conf.Advertise)
+	defer b.stop()
+	// c knows only b, learns a by gossip
+	c := testClusterStart(t, "c", b.s.cluster.conf.Advertise)
+
+	testClusterWait(t, "membership", func() bool {
+		return len(a.s.cluster.members(time.Now().UnixNano())) == 2 && len(c.s.cluster.members(time.Now().UnixNano())) == 2
+	})
+
+	// device connected to node a, sends valid readings
+	dev, err := dialLogin(a.s.ln.Addr().String(), testIMEIArr[:])
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	devStop := make(chan struct{})
+	devDone := make(chan struct{})
+	go func() {
+		defer close(devDone)
+		defer dev.Close()
+		for {
+			if _, err := dev.Write(testFrame(readingMessage{Temp: 20, BattLev: 50})); err != nil {
+				return
+			}
+			select {
+			case <-devStop:
+				return
+			case <-time.After(time.Millisecond * 25):
+			}
+		}
+	}()
+	testClusterWait(t, "device directory", func() bool {
+		node, _, ok := c.s.cluster.owner("490154203237518", time.Now().UnixNano())
+		return ok && node == "a"
+	})
+
+	// any node answers status
+	for _, n := range []*testClusterNode{a, b, c} {
+		sts := deviceStatus{}
+		if code := testClusterGet(t, n, "/status/490154203237518", &sts); code != http.StatusOK || sts.Status != "online" || sts.Node != "a" {
+			t.Fatalf("expected device online on node a, got %v %+v", code, sts)
+		}
+	}
+	// readings proxied to owning node
+	testClusterWait(t, "readings", func() bool {
+		drs := deviceReadingStatus{}
+		code := testClusterGet(t, c, "/readings/490154203237518", &drs)
+		return code == http.StatusOK && drs.Status == "online" && drs.Node == "a" && drs.Time > 0
+	})
+
+	// duplicate login on other node rejected
+	conn, err := dialLogin(b.s.ln.Addr().String(), testIMEIArr[:])
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("duplicate login should be closed, got %v", err)
+	}
+	conn.Close()
+	if _, ok := b.s.devStor.ok("490154203237518"); ok {
+		t.Fatalf("duplicate login should not be registered")
+	}
+
+	// dead node forgotten
+	c.stop()
+	testClusterWait(t, "dead node", func() bool {
+		return len(a.s.cluster.members(time.Now().UnixNano())) == 1
+	})
+
+	// device disconnected
+	close(devStop)
+	<-devDone
+	testClusterWait(t, "device offline", func() bool {
+		sts := deviceStatus{}
+		return testClusterGet(t, b, "/status/490154203237518", &sts) == http.StatusOK && sts.Status == "offline" && sts.Node == "b"
+	})
+
+	// gossip endpoint
+	rec := httptest.NewRecorder()
+	a.s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/cluster/gossip", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected code %v, got %v", http.StatusMethodNotAllowed, rec.Code)
+	}
+	// forged gossip rejected: no signature, wrong key, replayed
+	now := time.Now().UnixNano()
+	forged := &cluster{conf: ClusterConfig{Key: "wrong-key"}}
+	testCases := []struct {
+		name string
+		body string
+		sig  string
+	}{
+		{name: "no signature", body: fmt.Sprintf(`{"id":"x","addr":"x:1","time":%v,"devices":["490154203237526"]}`, now)},
+		{
+			name: "wrong key",
+			body: fmt.Sprintf(`{"id":"x","addr":"x:1","time":%v,"devices":["490154203237526"]}`, now),
+			sig:  forged.sign([]byte(fmt.Sprintf(`{"id":"x","addr":"x:1","time":%v,"devices":["490154203237526"]}`, now))),
+		},
+		{
+			name: "replayed",
+			body: `{"id":"x","addr":"x:1","time":1,"devices":["490154203237526"]}`,
+			sig:  a.s.cluster.sign([]byte(`{"id":"x","addr":"x:1","time":1,"devices":["490154203237526"]}`)),
+		},
+	}
+	for _, tc := range testCases {
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/cluster/gossip", strings.NewReader(tc.body))
+		if tc.sig != "" {
+			req.Header.Set(clusterSignatureHeader, tc.sig)
+		}
+		a.s.httpHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%v: expected code %v, got %v", tc.name, http.StatusUnauthorized, rec.Code)
+		}
+		if _, _, ok := a.s.cluster.owner("490154203237526", time.Now().UnixNano()); ok {
+			t.Fatalf("%v: forged gossip should not be merged", tc.name)
+		}
+	}
+	// signed gossip merged, response signed
+	body := fmt.Sprintf(`{"id":"x","addr":"x:1","time":%v,"devices":["490154203237526"]}`, now)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/cluster/gossip", strings.NewReader(body))
+	req.Header.Set(clusterSignatureHeader, a.s.cluster.sign([]byte(body)))
+	a.s.httpHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get(clusterSignatureHeader) != a.s.cluster.sign(rec.Body.Bytes()) {
+		t.Fatalf("signed gossip should be accepted with signed response, got %v", rec.Code)
+	}
+	if node, _, ok := a.s.cluster.owner("490154203237526", time.Now().UnixNano()); !ok || node != "x" {
+		t.Fatalf("signed gossip should be merged")
+	}
+
+	rec = httptest.NewRecorder()
+	(&Server{}).httpHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/cluster/gossip", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected code %v without clustering, got %v", http.StatusNotFound, rec.Code)
+	}
+}
+
+func Test_Server_Cluster_APIKeys(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	testWriteKeys(t, path, apiKey{ID: "reader", Hash: hashAPIKey("reader-key"), Scopes: []string{scopeReadings}})
+
+	// nodes authenticate gossip by signature
+	a := testClusterStartKeys(t, "a", path)
+	defer a.stop()
+	b := testClusterStartKeys(t, "b", path, a.s.cluster.conf.Advertise)
+	defer b.stop()
+	testClusterWait(t, "membership", func() bool {
+		return len(a.s.cluster.members(time.Now().UnixNano())) == 1 && len(b.s.cluster.members(time.Now().UnixNano())) == 1
+	})
+
+	// device connected to node a, sends valid readings
+	dev, err := dialLogin(a.s.ln.Addr().String(), testIMEIArr[:])
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	devStop := make(chan struct{})
+	devDone := make(chan struct{})
+	go func() {
+		defer close(devDone)
+		defer dev.Close()
+		for {
+			if _, err := dev.Write(testFrame(readingMessage{Temp: 20, BattLev: 50})); err != nil {
+				return
+			}
+			select {
+			case <-devStop:
+				return
+			case <-time.After(time.Millisecond * 25):
+			}
+		}
+	}()
+	defer func() {
+		close(devStop)
+		<-devDone
+	}()
+	testClusterWait(t, "device directory", func() bool {
+		_, _, ok := b.s.cluster.owner("490154203237518", time.Now().UnixNano())
+		return ok
+	})
+
+	// readings of client key proxied to owning node by signed request
+	testClusterWait(t, "readings", func() bool {
+		req := httptest.NewRequest("GET", "/readings/490154203237518", nil)
+		req.Header.Set("X-API-Key", "reader-key")
+		rec := httptest.NewRecorder()
+		b.s.httpHandler().ServeHTTP(rec, req)
+		drs := deviceReadingStatus{}
+		return rec.Code == http.StatusOK && json.Unmarshal(rec.Body.Bytes(), &drs) == nil && drs.Node == "a" && drs.Time > 0
+	})
+
+	// node requests: cluster key is not API key, signature of other request, replayed request rejected
+	now := time.Now().UnixNano()
+	testCases := []struct {
+		name string
+		sig  string
+		t    int64
+		code int
+	}{
+		// Positive
+		{name: "signed request", sig: a.s.cluster.signRequest("GET", "/readings/490154203237518", now), t: now, code: http.StatusOK},
+		// Negative
+		{name: "cluster key as api key", code: http.StatusUnauthorized},
+		{name: "signature of other request", sig: a.s.cluster.signRequest("GET", "/readings/490154203237526", now), t: now, code: http.StatusUnauthorized},
+		{name: "replayed request", sig: a.s.cluster.signRequest("GET", "/readings/490154203237518", 1), t: 1, code: http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/readings/490154203237518", nil)
+		req.Header.Set(clusterForwardedHeader, "b")
+		if tc.sig != "" {
+			req.Header.Set(clusterTimeHeader, strconv.FormatInt(tc.t, 10))
+			req.Header.Set(clusterSignatureHeader, tc.sig)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+a.s.cluster.conf.Key)
+		}
+		rec := httptest.NewRecorder()
+		a.s.httpHandler().ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v %s", tc.name, tc.code, rec.Code, rec.Body.Bytes())
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,9 +19,28 @@ const (
 	msgLength  = 40
 )
 
+var (
+	errRateLimit    = errors.New("reading rate limit exceeded")
+	errInvalidRatio = errors.New("invalid reading ratio exceeded")
+	errBanned       = errors.New("device banned")
+)
+
 type devConfig struct {
 	loginDeadline   time.Duration
 	messageDeadline time.Duration
+
+	// reading rate limit (messages per second, disabled if zero), burst, policy
+	rateLimit  float64
+	rateBurst  int
+	ratePolicy RatePolicy
+
+	// max ratio of invalid messages (disabled if zero), checked after min messages
+	invalidRatio       float64
+	invalidMinMessages int64
+
+	// accept relay links (relay login instead of IMEI) authenticated by shared key
+	relayAccept bool
+	relayKey    string
 }
 
 // device handle connection with new devices
@@ -33,9 +54,15 @@ type device struct {
 
 	// dev stor
 	devStor *devStorage
+	// storage of devices without connection (relayed devices), optional
+	pktStor *pktStorage
+	// cluster devices directory (clustering disabled if nil)
+	cluster *cluster
+	// failed logins of remote IPs (disabled if nil)
+	ipGuard *ipGuard
 
-	// outlog for logging Reading messages
-	outLog *log.Logger
+	// pipeline for processing Reading messages
+	pipe *pipeline
 
 	// wg
 	wg *sync.WaitGroup
@@ -45,13 +72,13 @@ type device struct {
 
 // inits new device
 func newDevice(
-	conf devConfig, conn net.Conn, olg *log.Logger, wg *sync.WaitGroup, stop chan struct{}, ds *devStorage,
+	conf devConfig, conn net.Conn, p *pipeline, wg *sync.WaitGroup, stop chan struct{}, ds *devStorage,
 ) *device {
 	d := &device{
 		conf:    conf,
 		conn:    conn,
 		raddr:   conn.RemoteAddr().String(),
-		outLog:  olg,
+		pipe:    p,
 		wg:      wg,
 		srvStop: stop,
 		devStor: ds,
@@ -94,29 +121,78 @@ func (d *device) run() error {
 	_, err := io.ReadFull(d.conn, imei)
 	if err != nil {
 		log.Printf("device, raddr - %v, read imei err: %v", d.raddr, err)
+		// connection closed before any byte (health check) is not failed login
+		if err != io.EOF {
+			d.loginFailed()
+		}
 		return err
 	}
+	atomic.AddInt64(&d.pipe.stats.bytesRead, imeiLength)
+	// relay link
+	if d.conf.relayAccept && bytes.Equal(imei, relayLogin[:]) {
+		return d.runRelayLink()
+	}
+	// timestamps protocol extension
+	timestamps := imei[0]&tsLoginFlag != 0
+	imei[0] &^= tsLoginFlag
 	// parse imei
 	d.imei, err = validParseIMEI(imei)
 	if err != nil {
 		log.Printf("device raddr - %v, imei validate err: %v", d.raddr, err)
+		d.loginFailed()
 		return err
 	}
+	// banned device
+	if b, ok := d.pipe.bans.banned(d.imei, time.Now().UnixNano()); ok {
+		log.Printf("device, raddr - %v, imei - %v banned (until %v): %v", d.raddr, d.imei, b.Until, b.Reason)
+		return errBanned
+	}
+	// device connected to other cluster node
+	if d.cluster != nil {
+		if node, _, ok := d.cluster.owner(d.imei, time.Now().UnixNano()); ok {
+			log.Printf("device, raddr - %v, device with imei - %v yet registered on node %v", d.raddr, d.imei, node)
+			return fmt.Errorf("device with imei %v yet registered on node %v", d.imei, node)
+		}
+	}
 	// register device by imei
 	dreq := make(devReq, 1)
-	if ok := d.devStor.setIfNot(d.imei, dreq); !ok {
+	if ok := d.devStor.register(d.imei, dreq, d.conn); !ok {
 		log.Printf("device, raddr - %v, device with imei - %v yet registered", d.raddr, d.imei)
 		return fmt.Errorf("device with imei %v yet registered", d.imei)
 	}
 	// unregister when connection closed
 	defer func() {
 		d.devStor.delete(d.imei)
+		if d.cluster != nil {
+			d.cluster.changed()
+		}
 	}()
-	log.Printf("device logged, raddr - %v, imei %v", d.raddr, d.imei)
+	if d.cluster != nil {
+		d.cluster.changed()
+	}
+	ds := d.pipe.devs.get(d.imei)
+	log.Printf("device logged, raddr - %v, imei %v, validation profile %v, timestamps %v",
+		d.raddr, d.imei, ds.profile.name, timestamps)
 
-	// read messages in cycle
-	msg := make([]byte, 40)
-	rm := readingMessage{}
+	// read messages in cycle (device time and Reading message if timestamps negotiated)
+	msg := make([]byte, msgLength)
+	if timestamps {
+		if _, err := d.conn.Write([]byte{tsAck}); err != nil {
+			log.Printf("device, imei - %v, write timestamps ack err: %v", d.imei, err)
+			return err
+		}
+		msg = make([]byte, tsLength+msgLength)
+	}
+	r := decodedReading{}
+	// connection messages, invalid messages
+	var total, invalid int64
+	// rate limiter
+	var tb tokenBucket
+	if d.conf.rateLimit > 0 {
+		tb = newTokenBucket(d.conf.rateLimit, d.conf.rateBurst, time.Now().UnixNano())
+	}
+	// dropped messages since last rate limit log
+	var dropped, lastDropLog int64
 	for {
 
 		// read message
@@ -127,29 +203,65 @@ func (d *device) run() error {
 			return err
 		}
 		now := time.Now().UnixNano()
+		atomic.AddInt64(&d.pipe.stats.bytesRead, int64(len(msg)))
 
-		// parse message
-		parseMessage(msg, &rm)
-		log.Printf("device, imei - %v, read message %+v", d.imei, rm)
+		// rate limit
+		if d.conf.rateLimit > 0 && !tb.allow(now) {
+			if d.conf.ratePolicy == RateDisconnect {
+				d.pipe.stats.rateLimited(d.imei, 1, true, now)
+				log.Printf("device, imei - %v, rate limit %v/s exceeded, disconnect", d.imei, d.conf.rateLimit)
+				return errRateLimit
+			}
+			d.pipe.stats.rateLimited(d.imei, 1, false, now)
+			dropped++
+			// log flooding device at most once per second
+			if now-lastDropLog >= int64(time.Second) {
+				log.Printf("device, imei - %v, rate limit %v/s exceeded, dropped %v messages", d.imei, d.conf.rateLimit, dropped)
+				dropped = 0
+				lastDropLog = now
+			}
+			continue
+		}
 
-		// if valid, logging Reading message to stdout
-		if rm.isValid() {
-			reading := fmt.Sprintf("%v,%s,%f,%f,%f,%f,%f\n", now, d.imei, rm.Temp, rm.Alt, rm.Lat, rm.Lon, rm.BattLev)
-			d.outLog.Print(reading)
+		// parse message, if valid, logging Reading message to stdout
+		total++
+		var devTime int64
+		if timestamps {
+			devTime = int64(binary.BigEndian.Uint64(msg[:tsLength]))
+		}
+		ok := d.pipe.readingAt(now, devTime, ds, msg[len(msg)-msgLength:], &r)
+		log.Printf("device, imei - %v, read message %+v", d.imei, r.msg)
+		if ok {
 
 			// response to request last reading
 			select {
 			case dresp := <-dreq:
-				dresp <- deviceReadingStatus{Reading: rm, Time: now}
+				dresp <- r.status(now)
 				close(dresp)
 			default:
 			}
 		} else {
-			log.Printf("device, imei %v, invalid reading message %+v", d.imei, rm)
+			log.Printf("device, imei %v, invalid reading message %+v: %v", d.imei, r.msg, r.reasons())
+			invalid++
+			// disconnect device sending mostly invalid messages
+			if d.conf.invalidRatio > 0 && total >= d.conf.invalidMinMessages &&
+				float64(invalid)/float64(total) > d.conf.invalidRatio {
+				log.Printf("device, imei - %v, invalid messages %v of %v exceeded ratio %v, disconnect",
+					d.imei, invalid, total, d.conf.invalidRatio)
+				return errInvalidRatio
+			}
 		}
 	}
 }
 
+// loginFailed counts failed login of device remote IP
+func (d *device) loginFailed() {
+	if d.ipGuard == nil {
+		return
+	}
+	d.ipGuard.failed(remoteIP(d.conn.RemoteAddr()), time.Now().UnixNano())
+}
+
 // validate imei (Luhn algorithm), parse to string
 func validParseIMEI(imei []byte) (string, error) {
 	if len(imei) != imeiLength {
@@ -186,6 +298,19 @@ func validParseIMEI(imei []byte) (string, error) {
 	return string(imeiChr), nil
 }
 
+// validate imei string of decimal digits (Luhn algorithm), see validParseIMEI
+func validParseIMEIString(imei string) (string, error) {
+	if len(imei) != imeiLength {
+		return "", errors.New("imei wrong length")
+	}
+	var b [imeiLength]byte
+	for i := 0; i < imeiLength; i++ {
+		// subtract 48 to get decimal number of ASCII code
+		b[i] = imei[i] - 48
+	}
+	return validParseIMEI(b[:])
+}
+
 // parse Reading message
 func parseMessage(msg []byte, rm *readingMessage) {
 	// panic if len less then message length
@@ -198,6 +323,17 @@ func parseMessage(msg []byte, rm *readingMessage) {
 	rm.BattLev = bytesToFloat64(msg[32:])
 }
 
+// decodeMessage parses Reading message and classifies its floats,
+// sets reason of each non-finite (or rejected by checks) field to v
+func decodeMessage(msg []byte, rm *readingMessage, checks floatChecks, v *validation) {
+	parseMessage(msg, rm)
+	v[fieldTemp] = classifyFloat64(rm.Temp, checks)
+	v[fieldAlt] = classifyFloat64(rm.Alt, checks)
+	v[fieldLat] = classifyFloat64(rm.Lat, checks)
+	v[fieldLon] = classifyFloat64(rm.Lon, checks)
+	v[fieldBattLev] = classifyFloat64(rm.BattLev, checks)
+}
+
 // covert 8-bytes to float64
 func bytesToFloat64(b []byte) float64 {
 	return math.Float64frombits(binary.BigEndian.Uint64(b))
@@ -32,7 +32,8 @@ func Test_Device_ReadDeadline_Positive(t *testing.T) {
 	go func() {
 		conn, err := ln.Accept()
 		if err != nil {
-			t.Fatalf("accept new connect, err: %v", err)
+			t.Errorf("accept new connect, err: %v", err)
+			return
 		}
 
 		ld := time.Millisecond * 50
@@ -40,12 +41,12 @@ func Test_Device_ReadDeadline_Positive(t *testing.T) {
 		wg := sync.WaitGroup{}
 		wg.Add(1)
 		stop := make(chan struct{}, 1)
-		d := newDevice(devConfig{loginDeadline: ld, messageDeadline: md}, conn, testOutLog, &wg, stop, newDevStorage())
+		d := newDevice(devConfig{loginDeadline: ld, messageDeadline: md}, conn, newPipeline(testOutLog, newServerStats()), &wg, stop, newDevStorage())
 		err = d.run()
 		if err == io.EOF {
 			t.Logf("test server get EOF")
 		} else if err != nil {
-			t.Fatalf("device run err: %v", err)
+			t.Errorf("device run err: %v", err)
 		}
 	}()
 
@@ -88,7 +89,8 @@ func Test_Device_LoginDeadline_Negative(t *testing.T) {
 	go func() {
 		conn, err := ln.Accept()
 		if err != nil {
-			t.Fatalf("accept new connect, err: %v", err)
+			t.Errorf("accept new connect, err: %v", err)
+			return
 		}
 
 		ld := time.Millisecond * 50
@@ -96,12 +98,12 @@ func Test_Device_LoginDeadline_Negative(t *testing.T) {
 		wg := sync.WaitGroup{}
 		wg.Add(1)
 		stop := make(chan struct{}, 1)
-		d := newDevice(devConfig{loginDeadline: ld, messageDeadline: md}, conn, testOutLog, &wg, stop, newDevStorage())
+		d := newDevice(devConfig{loginDeadline: ld, messageDeadline: md}, conn, newPipeline(testOutLog, newServerStats()), &wg, stop, newDevStorage())
 		err = d.run()
 		if e, ok := err.(net.Error); ok && e.Timeout() {
 			t.Logf("test server get i/o timeout")
 		} else if err != nil {
-			t.Fatalf("device run err: %v", err)
+			t.Errorf("device run err: %v", err)
 		}
 	}()
 
@@ -131,7 +133,8 @@ func Test_Device_MessageDeadline_Negative(t *testing.T) {
 	go func() {
 		conn, err := ln.Accept()
 		if err != nil {
-			t.Fatalf("accept new connect, err: %v", err)
+			t.Errorf("accept new connect, err: %v", err)
+			return
 		}
 
 		ld := time.Millisecond * 50
@@ -139,12 +142,12 @@ func Test_Device_MessageDeadline_Negative(t *testing.T) {
 		wg := sync.WaitGroup{}
 		wg.Add(1)
 		stop := make(chan struct{}, 1)
-		d := newDevice(devConfig{loginDeadline: ld, messageDeadline: md}, conn, testOutLog, &wg, stop, newDevStorage())
+		d := newDevice(devConfig{loginDeadline: ld, messageDeadline: md}, conn, newPipeline(testOutLog, newServerStats()), &wg, stop, newDevStorage())
 		err = d.run()
 		if e, ok := err.(net.Error); ok && e.Timeout() {
 			t.Logf("test server get i/o timeout")
 		} else if err != nil {
-			t.Fatalf("device run err: %v", err)
+			t.Errorf("device run err: %v", err)
 		}
 	}()
 
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// deviceValidation validation statistics of device
+type deviceValidation struct {
+	IMEI         string                      `json:"imei"`
+	Valid        int64                       `json:"valid"`
+	Invalid      int64                       `json:"invalid"`
+	InvalidRatio float64                     `json:"invalid_ratio"`
+	LastInvalid  int64                       `json:"last_invalid,omitempty"`
+	Fields       map[string]map[string]int64 `json:"fields"`
+}
+
+// devices routes device resources, path /devices/:imei/:resource
+func (s *Server) devices(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/devices/"), "/")
+	if len(path) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	imei, resource := path[0], path[1]
+	if _, err := strconv.ParseInt(imei, 10, 64); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	if len(imei) != 15 {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Wrong IMEI length")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	var resp interface{}
+	var err error
+	switch resource {
+	case "validation":
+		resp = s.deviceValidation(imei)
+	case "clock":
+		resp = s.deviceClock(imei)
+	case "rollups":
+		resp, err = s.deviceRollups(imei, req.URL.Query())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err := w.Write([]byte("400 Bad Request: " + err.Error())); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// response
+	out, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
+
+// deviceValidation returns validation statistics of device
+func (s *Server) deviceValidation(imei string) *deviceValidation {
+	dv := &deviceValidation{
+		IMEI:   imei,
+		Fields: make(map[string]map[string]int64),
+	}
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok {
+		return dv
+	}
+
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	dv.Valid = ds.valid
+	dv.Invalid = ds.invalid
+	if total := ds.valid + ds.invalid; total > 0 {
+		dv.InvalidRatio = float64(ds.invalid) / float64(total)
+	}
+	dv.LastInvalid = ds.lastInvalid
+	for f, reasons := range ds.invalidFields {
+		for r, n := range reasons {
+			if n == 0 || invalidReason(r) == reasonNone {
+				continue
+			}
+			if dv.Fields[fieldNames[f]] == nil {
+				dv.Fields[fieldNames[f]] = make(map[string]int64)
+			}
+			dv.Fields[fieldNames[f]][invalidReason(r).String()] = n
+		}
+	}
+	return dv
+}
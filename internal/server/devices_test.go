@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Server_devices(t *testing.T) {
+
+	s := New(Config{}, testOutLog)
+	ds := s.pipe.devs.get("490154203237518")
+	s.pipe.reading(1, ds, testFrame(readingMessage{BattLev: 1}), &decodedReading{})
+	s.pipe.reading(2, ds, testFrame(readingMessage{Temp: 301, BattLev: 1}), &decodedReading{})
+
+	testCases := []struct {
+		name string
+		path string
+		code int
+	}{
+		// Positive
+		{name: "validation", path: "/devices/490154203237518/validation", code: http.StatusOK},
+		// Negative
+		{name: "unknown resource", path: "/devices/490154203237518/unknown", code: http.StatusNotFound},
+		{name: "no resource", path: "/devices/490154203237518", code: http.StatusNotFound},
+		{name: "not number imei", path: "/devices/49015420323751a/validation", code: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v", tc.name, tc.code, rec.Code)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/devices/490154203237518/validation", nil))
+	dv := deviceValidation{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dv); err != nil {
+		t.Fatalf("validation response unmarshal err: %v", err)
+	}
+	if dv.Valid != 1 || dv.Invalid != 1 || dv.InvalidRatio != 0.5 || dv.LastInvalid != 2 || dv.Fields["Temp"]["above max"] != 1 {
+		t.Fatalf("wrong device validation %+v", dv)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import "sync"
+
+// devState state of device kept across connections
+type devState struct {
+	mux  sync.Mutex
+	imei string
+
+	// validation profile (set at init)
+	profile *profile
+
+	// validation counters: valid, invalid messages, invalid fields by reason
+	valid         int64
+	invalid       int64
+	invalidFields [fieldsNum][reasonsNum]int64
+	// last invalid message time (unix nano)
+	lastInvalid int64
+	// device clock (messages with device time)
+	clock devClock
+	// battery trend of valid messages, anomaly detection of valid messages (detection enabled)
+	battery devBattery
+	anomaly devAnomaly
+	// stuck sensor detection of valid messages (detection enabled)
+	stuck devStuck
+	// movement of valid messages (tracking enabled)
+	movement devMovement
+	// mute of device output (not muted if nil)
+	mute *deviceRestriction
+
+	// last valid message (zero time if none)
+	last histReading
+	// rollups and history of valid messages (init on first message)
+	rollups *devRollups
+	history *devHistory
+}
+
+// validated counts validation result of device Reading message with device time
+// (zero if not supplied), updates device clock by plausible device time
+func (ds *devState) validated(v *validation, timeReason invalidReason, now, devTime int64) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	if devTime != 0 || timeReason != reasonNone {
+		if timeReason != reasonNone {
+			ds.clock.rejected[timeReason]++
+		} else {
+			ds.clock.add(now - devTime)
+		}
+	}
+	if v.ok() && timeReason == reasonNone {
+		ds.valid++
+		return
+	}
+	ds.invalid++
+	ds.lastInvalid = now
+	for f, r := range v {
+		ds.invalidFields[f][r]++
+	}
+}
+
+// muted returns whether output of device is muted at time now
+func (ds *devState) muted(now int64) bool {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	return ds.mute.active(now)
+}
+
+// devStates states of devices by IMEI
+type devStates struct {
+	mux    sync.Mutex
+	states map[string]*devState
+
+	// validation profiles of devices
+	profiles *profileSet
+}
+
+func newDevStates(ps *profileSet) *devStates {
+	dss := &devStates{
+		states:   make(map[string]*devState),
+		profiles: ps,
+	}
+	return dss
+}
+
+// get returns state of device, inits new state if not exists
+func (s *devStates) get(imei string) *devState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ds, ok := s.states[imei]
+	if !ok {
+		ds = &devState{imei: imei, profile: s.profiles.lookup(imei)}
+		s.states[imei] = ds
+	}
+	return ds
+}
+
+// lookup returns state of device if exists
+func (s *devStates) lookup(imei string) (*devState, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ds, ok := s.states[imei]
+	return ds, ok
+}
+
+// list returns states of all devices
+func (s *devStates) list() []*devState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	dss := make([]*devState, 0, len(s.states))
+	for _, ds := range s.states {
+		dss = append(dss, ds)
+	}
+	return dss
+}
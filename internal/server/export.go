@@ -0,0 +1,172 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/radisvaliullin/test_task_17/record"
+)
+
+const (
+	// export records flushed to client after each exportFlushRecords
+	exportFlushRecords = 1000
+)
+
+// export streams readings of devices from history,
+// query: imei (comma-separated or repeated), from, to (unix nano), format (csv, ndjson), fields (comma-separated),
+// raw (raw readings of calibrated devices). CSV records without fields selection have format of output records.
+func (s *Server) export(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	// devices
+	var imeis []string
+	for _, v := range q["imei"] {
+		for _, imei := range strings.Split(v, ",") {
+			if _, err := validParseIMEIString(imei); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				if _, err := w.Write([]byte("400 Bad Request: imei " + imei + " " + err.Error())); err != nil {
+					log.Printf("http server: write err: %v", err)
+				}
+				return
+			}
+			imeis = append(imeis, imei)
+		}
+	}
+	if len(imeis) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err := w.Write([]byte("400 Bad Request: imei required")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	from, to, err := queryTimeRange(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err := w.Write([]byte("400 Bad Request: " + err.Error())); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// format
+	format, contentType := record.CSV, "text/csv"
+	switch q.Get("format") {
+	case "", "csv":
+	case "ndjson":
+		format, contentType = record.NDJSON, "application/x-ndjson"
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err := w.Write([]byte("400 Bad Request: unknown format")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// fields selection
+	var fields []int
+	if v := q.Get("fields"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			f := fieldByName(name)
+			if f < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				if _, err := w.Write([]byte("400 Bad Request: unknown field " + name)); err != nil {
+					log.Printf("http server: write err: %v", err)
+				}
+				return
+			}
+			fields = append(fields, f)
+		}
+	}
+
+	// raw readings
+	raw := false
+	if v := q.Get("raw"); v != "" {
+		if raw, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte("400 Bad Request: wrong raw")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+	}
+
+	// stream records
+	w.Header().Set("Content-Type", contentType)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 0, 4096)
+	records := 0
+	for _, imei := range imeis {
+		for _, hr := range s.pipe.history(imei, from, to) {
+			rm := &hr.msg
+			if raw {
+				rm = &hr.raw
+			}
+			switch {
+			case fields == nil:
+				rec := newRecord(hr.time, imei, rm)
+				buf = record.Append(buf, format, &rec)
+			case format == record.CSV:
+				buf = appendFieldsRecord(buf, hr.time, imei, rm, fields)
+			default:
+				buf = appendJSONRecord(buf, hr.time, imei, rm, fields)
+			}
+			records++
+			if records%exportFlushRecords == 0 {
+				if _, err := w.Write(buf); err != nil {
+					log.Printf("http server: write err: %v", err)
+					return
+				}
+				buf = buf[:0]
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}
+	if _, err := w.Write(buf); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+	log.Printf("export, raddr - %v, devices %v, records %v", req.RemoteAddr, len(imeis), records)
+}
+
+// fieldByName returns Reading message field by name, -1 if not found
+func fieldByName(name string) int {
+	for f, n := range fieldNames {
+		if n == name {
+			return f
+		}
+	}
+	return -1
+}
+
+// appendFieldsRecord appends CSV record of selected Reading message fields to dst
+func appendFieldsRecord(dst []byte, t int64, imei string, rm *readingMessage, fields []int) []byte {
+	vals := [fieldsNum]float64{rm.Temp, rm.Alt, rm.Lat, rm.Lon, rm.BattLev}
+	dst = strconv.AppendInt(dst, t, 10)
+	dst = append(dst, ',')
+	dst = append(dst, imei...)
+	for _, f := range fields {
+		dst = append(dst, ',')
+		dst = strconv.AppendFloat(dst, vals[f], 'f', 6, 64)
+	}
+	return append(dst, '\n')
+}
+
+// appendJSONRecord appends NDJSON record of selected Reading message fields to dst
+func appendJSONRecord(dst []byte, t int64, imei string, rm *readingMessage, fields []int) []byte {
+	vals := [fieldsNum]float64{rm.Temp, rm.Alt, rm.Lat, rm.Lon, rm.BattLev}
+	dst = append(dst, `{"time":`...)
+	dst = strconv.AppendInt(dst, t, 10)
+	dst = append(dst, `,"imei":"`...)
+	dst = append(dst, imei...)
+	dst = append(dst, '"')
+	for _, f := range fields {
+		dst = append(dst, `,"`...)
+		dst = append(dst, fieldNames[f]...)
+		dst = append(dst, `":`...)
+		dst = strconv.AppendFloat(dst, vals[f], 'g', -1, 64)
+	}
+	return append(dst, "}\n"...)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_devHistory_rangeCopy(t *testing.T) {
+
+	dh := newDevHistory(3)
+	if hrs := dh.rangeCopy(nil, math.MinInt64, math.MaxInt64); len(hrs) != 0 {
+		t.Fatalf("empty history expected, got %+v", hrs)
+	}
+	for i := int64(1); i <= 5; i++ {
+		dh.add(i, &readingMessage{Temp: float64(i)}, nil)
+	}
+
+	// oldest readings overwritten, receive order kept
+	hrs := dh.rangeCopy(nil, math.MinInt64, math.MaxInt64)
+	if len(hrs) != 3 || hrs[0].time != 3 || hrs[2].time != 5 || hrs[2].msg.Temp != 5 {
+		t.Fatalf("wrong history %+v", hrs)
+	}
+	hrs = dh.rangeCopy(nil, 4, 5)
+	if len(hrs) != 1 || hrs[0].time != 4 {
+		t.Fatalf("wrong history range %+v", hrs)
+	}
+
+	// readings out of time order (ingest backlog)
+	dh.add(2, &readingMessage{Temp: 2}, nil)
+	hrs = dh.rangeCopy(nil, 2, 5)
+	if dh.ordered || len(hrs) != 2 || hrs[0].time != 4 || hrs[1].time != 2 {
+		t.Fatalf("wrong history range of unordered readings %+v", hrs)
+	}
+}
+
+func Test_histDevices(t *testing.T) {
+
+	p := newPipeline(testOutLog, newServerStats())
+	p.historySize = 10
+	p.histDevs = newHistDevices(2)
+	p.historyIdle = time.Hour
+
+	imeis := []string{"490154203237518", "490154203237526", "490154203237534"}
+	for i, imei := range imeis {
+		p.retain(int64(i), p.devs.get(imei), &readingMessage{Temp: float64(i)}, nil)
+	}
+
+	// history of least recently updated device evicted
+	if hrs := p.history(imeis[0], math.MinInt64, math.MaxInt64); len(hrs) != 0 {
+		t.Fatalf("history of least recently updated device should be evicted, got %+v", hrs)
+	}
+	if hrs := p.history(imeis[2], math.MinInt64, math.MaxInt64); len(hrs) != 1 || len(p.histDevs.devs) != 2 {
+		t.Fatalf("history of device should be kept, got %+v", hrs)
+	}
+
+	// last reading not replaced by older reading (ingested backlog)
+	ds := p.devs.get(imeis[2])
+	p.retain(10, ds, &readingMessage{Lat: 1}, nil)
+	p.retain(5, ds, &readingMessage{Lat: 2}, nil)
+	if ds.last.time != 10 || ds.last.msg.Lat != 1 {
+		t.Fatalf("last reading should be kept by time, got %+v", ds.last)
+	}
+
+	// idle histories dropped
+	p.historyExpire(time.Now().Add(time.Hour * 2).UnixNano())
+	if hrs := p.history(imeis[2], math.MinInt64, math.MaxInt64); len(hrs) != 0 || len(p.histDevs.devs) != 0 {
+		t.Fatalf("idle history should be dropped, got %+v", hrs)
+	}
+}
+
+func Test_Server_export(t *testing.T) {
+
+	s := New(Config{HistorySize: 10}, testOutLog)
+	ds := s.pipe.devs.get("490154203237518")
+	s.pipe.reading(1, ds, testFrame(readingMessage{Temp: 1.5, BattLev: 1}), &decodedReading{})
+	s.pipe.reading(2, ds, testFrame(readingMessage{Temp: 2, BattLev: 0.5}), &decodedReading{})
+	// invalid reading is not kept
+	s.pipe.reading(3, ds, testFrame(readingMessage{Temp: 1000, BattLev: 1}), &decodedReading{})
+	ds = s.pipe.devs.get("490154203237526")
+	s.pipe.reading(4, ds, testFrame(readingMessage{Temp: 3, BattLev: 1}), &decodedReading{})
+	// calibrated device
+	if _, err := s.pipe.calibs.add("490154203237534", calibrationEntry{Temp: &fieldCalibration{Offset: -2, Gain: 1}}, 1); err != nil {
+		t.Fatalf("add calibration err: %v", err)
+	}
+	ds = s.pipe.devs.get("490154203237534")
+	s.pipe.reading(5, ds, testFrame(readingMessage{Temp: 10, BattLev: 1}), &decodedReading{})
+
+	testCases := []struct {
+		name  string
+		query string
+		code  int
+		body  string
+	}{
+		// Positive
+		{
+			name:  "csv",
+			query: "?imei=490154203237518",
+			code:  http.StatusOK,
+			body: "1,490154203237518,1.500000,0.000000,0.000000,0.000000,1.000000\n" +
+				"2,490154203237518,2.000000,0.000000,0.000000,0.000000,0.500000\n",
+		},
+		{
+			name:  "csv, devices, time range, fields",
+			query: "?imei=490154203237518,490154203237526&from=2&to=5&fields=BattLev,Temp",
+			code:  http.StatusOK,
+			body:  "2,490154203237518,0.500000,2.000000\n4,490154203237526,1.000000,3.000000\n",
+		},
+		{
+			name:  "ndjson, repeated imei",
+			query: "?imei=490154203237518&imei=490154203237526&format=ndjson&from=2",
+			code:  http.StatusOK,
+			body: `{"time":2,"imei":"490154203237518","Temp":2,"Alt":0,"Lat":0,"Lon":0,"BattLev":0.5}` + "\n" +
+				`{"time":4,"imei":"490154203237526","Temp":3,"Alt":0,"Lat":0,"Lon":0,"BattLev":1}` + "\n",
+		},
+		{
+			name:  "ndjson, fields",
+			query: "?imei=490154203237518&format=ndjson&fields=Temp",
+			code:  http.StatusOK,
+			body:  `{"time":1,"imei":"490154203237518","Temp":1.5}` + "\n" + `{"time":2,"imei":"490154203237518","Temp":2}` + "\n",
+		},
+		{
+			name:  "calibrated device",
+			query: "?imei=490154203237534",
+			code:  http.StatusOK,
+			body:  "5,490154203237534,8.000000,0.000000,0.000000,0.000000,1.000000\n",
+		},
+		{
+			name:  "raw, calibrated and not calibrated devices",
+			query: "?imei=490154203237534,490154203237526&raw=true&format=ndjson&fields=Temp",
+			code:  http.StatusOK,
+			body:  `{"time":5,"imei":"490154203237534","Temp":10}` + "\n" + `{"time":4,"imei":"490154203237526","Temp":3}` + "\n",
+		},
+		{
+			name:  "unknown device",
+			query: "?imei=356938035643809",
+			code:  http.StatusOK,
+		},
+		// Negative
+		{name: "no imei", query: "", code: http.StatusBadRequest},
+		{name: "wrong imei", query: "?imei=49015420323751", code: http.StatusBadRequest},
+		{name: "wrong range", query: "?imei=490154203237518&from=2&to=1", code: http.StatusBadRequest},
+		{name: "unknown format", query: "?imei=490154203237518&format=xml", code: http.StatusBadRequest},
+		{name: "unknown field", query: "?imei=490154203237518&fields=Temp,Speed", code: http.StatusBadRequest},
+		{name: "wrong raw", query: "?imei=490154203237518&raw=yes", code: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/export"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v, %v", tc.name, tc.code, rec.Code, rec.Body.String())
+		}
+		if tc.code != http.StatusOK && rec.Header().Get("Content-Type") == "text/csv" {
+			t.Fatalf("%v: error response should not be csv", tc.name)
+		}
+		if tc.code == http.StatusOK && rec.Body.String() != tc.body {
+			t.Fatalf("%v: expected body %q, got %q", tc.name, tc.body, rec.Body.String())
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// history disabled
+	s = New(Config{}, testOutLog)
+	ds = s.pipe.devs.get("490154203237518")
+	s.pipe.reading(1, ds, testFrame(readingMessage{Temp: 1.5, BattLev: 1}), &decodedReading{})
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/export?imei=490154203237518", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("empty export expected without history, got %v %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layout of rotation time in rotated file names
+const fileSinkTimeLayout = "20060102T150405.000000000"
+
+// FileSinkConfig configs of rotating file output
+type FileSinkConfig struct {
+	// directory and name of output file (readings by default), current file is Dir/Name.log,
+	// rotated files are Dir/Name-<rotation time UTC>.log[.gz]
+	Dir  string
+	Name string
+
+	// rotate when file exceeds max size, bytes (disabled if zero)
+	MaxSize int64
+	// rotate at wall-clock interval boundaries, e.g. each hour (disabled if zero)
+	Interval time.Duration
+
+	// gzip rotated files
+	Compress bool
+	// max number and max age of kept rotated files (unlimited if zero)
+	MaxFiles int
+	MaxAge   time.Duration
+}
+
+// FileSink rotating file output of records, each write (record) goes to single file,
+// file is rotated by size or time interval before write
+type FileSink struct {
+	conf FileSinkConfig
+	path string
+
+	mux  sync.Mutex
+	f    *os.File
+	size int64
+	// time of next interval rotation (unix nano), set on first write
+	next int64
+
+	// rotated files compression and cleanup (serialized)
+	bgMux sync.Mutex
+	wg    sync.WaitGroup
+
+	now func() time.Time
+}
+
+// NewFileSink inits rotating file output, opens current file (appended if exists)
+func NewFileSink(conf FileSinkConfig) (*FileSink, error) {
+	if conf.Name == "" {
+		conf.Name = "readings"
+	}
+	if conf.MaxSize < 0 || conf.Interval < 0 || conf.MaxFiles < 0 || conf.MaxAge < 0 {
+		return nil, errors.New("file sink: negative limits")
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileSink{
+		conf: conf,
+		path: filepath.Join(conf.Dir, conf.Name+".log"),
+		now:  time.Now,
+	}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// open opens current file, replaces previous file (closed) on success
+func (fs *FileSink) open() error {
+	f, err := os.OpenFile(fs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fs.f != nil {
+		if err := fs.f.Close(); err != nil {
+			log.Printf("file sink, %v close err: %v", fs.path, err)
+		}
+	}
+	fs.f = f
+	fs.size = fi.Size()
+	return nil
+}
+
+// nextRotation returns time of next interval rotation after t (max int64 if disabled)
+func (fs *FileSink) nextRotation(t time.Time) int64 {
+	if fs.conf.Interval == 0 {
+		return 1<<63 - 1
+	}
+	return t.Truncate(fs.conf.Interval).Add(fs.conf.Interval).UnixNano()
+}
+
+// Write writes record p to current file, rotates file before write if needed
+// (record is written to previous file if rotation failed)
+func (fs *FileSink) Write(p []byte) (int, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if fs.f == nil {
+		return 0, errors.New("file sink: closed")
+	}
+	now := fs.now()
+	if fs.next == 0 {
+		fs.next = fs.nextRotation(now)
+	}
+	if (fs.conf.MaxSize > 0 && fs.size > 0 && fs.size+int64(len(p)) > fs.conf.MaxSize) || now.UnixNano() >= fs.next {
+		fs.next = fs.nextRotation(now)
+		if fs.size > 0 {
+			if err := fs.rotate(now); err != nil {
+				log.Printf("file sink, %v rotate err: %v", fs.path, err)
+			}
+		}
+	}
+	n, err := fs.f.Write(p)
+	fs.size += int64(n)
+	return n, err
+}
+
+// rotate renames current file to rotated file, opens new current file,
+// compresses rotated file and cleans up old files in background
+func (fs *FileSink) rotate(now time.Time) error {
+	rotated := filepath.Join(fs.conf.Dir, fs.conf.Name+"-"+now.UTC().Format(fileSinkTimeLayout)+".log")
+	if err := os.Rename(fs.path, rotated); err != nil {
+		return err
+	}
+	// previous file (already rotated) kept open if new file open fails
+	if err := fs.open(); err != nil {
+		return err
+	}
+	fs.wg.Add(1)
+	go func() {
+		defer fs.wg.Done()
+		fs.bgMux.Lock()
+		defer fs.bgMux.Unlock()
+		if fs.conf.Compress {
+			if err := compressFile(rotated); err != nil {
+				log.Printf("file sink, %v compress err: %v", rotated, err)
+			}
+		}
+		fs.cleanup(now)
+	}()
+	return nil
+}
+
+// compressFile gzips file to file.gz, removes file on success
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// cleanup removes rotated files over max number of files and older than max age
+func (fs *FileSink) cleanup(now time.Time) {
+	if fs.conf.MaxFiles == 0 && fs.conf.MaxAge == 0 {
+		return
+	}
+	files, err := fs.rotatedFiles()
+	if err != nil {
+		log.Printf("file sink, %v rotated files list err: %v", fs.conf.Dir, err)
+		return
+	}
+	for i, path := range files {
+		remove := fs.conf.MaxFiles > 0 && len(files)-i > fs.conf.MaxFiles
+		if !remove && fs.conf.MaxAge > 0 {
+			fi, err := os.Stat(path)
+			remove = err == nil && now.Sub(fi.ModTime()) > fs.conf.MaxAge
+		}
+		if remove {
+			if err := os.Remove(path); err != nil {
+				log.Printf("file sink, %v remove err: %v", path, err)
+			}
+		}
+	}
+}
+
+// rotatedFiles returns rotated files, oldest first
+func (fs *FileSink) rotatedFiles() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(fs.conf.Dir, fs.conf.Name+"-*.log*"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".log") || strings.HasSuffix(path, ".log.gz") {
+			files = append(files, path)
+		}
+	}
+	// names ordered by rotation time
+	sort.Strings(files)
+	return files, nil
+}
+
+// Reopen reopens current file (e.g. on SIGHUP after file moved by logrotate)
+func (fs *FileSink) Reopen() error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if fs.f == nil {
+		return errors.New("file sink: closed")
+	}
+	return fs.open()
+}
+
+// Close closes current file, waits for background compression and cleanup
+func (fs *FileSink) Close() error {
+	fs.mux.Lock()
+	var err error
+	if fs.f != nil {
+		err = fs.f.Close()
+		fs.f = nil
+	}
+	fs.mux.Unlock()
+	fs.wg.Wait()
+	return err
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSinkFiles returns contents of current and rotated files of sink directory, oldest first
+func testSinkFiles(t *testing.T, fs *FileSink) []string {
+	paths, err := fs.rotatedFiles()
+	if err != nil {
+		t.Fatalf("rotated files list err: %v", err)
+	}
+	paths = append(paths, fs.path)
+	var files []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("file open err: %v", err)
+		}
+		var b []byte
+		if strings.HasSuffix(path, ".gz") {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("%v gzip reader err: %v", path, err)
+			}
+			b, err = ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%v read err: %v", path, err)
+			}
+		} else if b, err = ioutil.ReadAll(f); err != nil {
+			t.Fatalf("%v read err: %v", path, err)
+		}
+		f.Close()
+		files = append(files, string(b))
+	}
+	return files
+}
+
+func Test_FileSink_Write(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 12, 20, 10, 59, 0, 0, time.UTC)
+	testCases := []struct {
+		name string
+		conf FileSinkConfig
+		// writes of records and time step before each write
+		records int
+		step    time.Duration
+		files   []string
+	}{
+		{
+			name:    "size rotation",
+			conf:    FileSinkConfig{MaxSize: 10, Compress: true},
+			records: 5,
+			files:   []string{"r0\nr1\nr2\n", "r3\nr4\n"},
+		},
+		{
+			name:    "size rotation, record over max size not split",
+			conf:    FileSinkConfig{MaxSize: 2, Compress: true},
+			records: 2,
+			files:   []string{"r0\n", "r1\n"},
+		},
+		{
+			name:    "size rotation, max files",
+			conf:    FileSinkConfig{MaxSize: 3, MaxFiles: 2},
+			records: 5,
+			files:   []string{"r2\n", "r3\n", "r4\n"},
+		},
+		{
+			name:    "interval rotation",
+			conf:    FileSinkConfig{Interval: time.Minute, Compress: true},
+			records: 4,
+			step:    time.Second * 30,
+			files:   []string{"r0\n", "r1\nr2\n", "r3\n"},
+		},
+		{
+			name:    "interval rotation, max age",
+			conf:    FileSinkConfig{Interval: time.Minute, MaxAge: time.Hour},
+			records: 3,
+			step:    time.Hour,
+			files:   []string{"r1\n", "r2\n"},
+		},
+	}
+
+	for i, tc := range testCases {
+
+		tc.conf.Dir = filepath.Join(dir, strings.Repeat("d", i+1))
+		fs, err := NewFileSink(tc.conf)
+		if err != nil {
+			t.Fatalf("%v: new file sink err: %v", tc.name, err)
+		}
+		tm := now
+		fs.now = func() time.Time { return tm }
+		for r := 0; r < tc.records; r++ {
+			// rotated files names unique by time
+			tm = tm.Add(tc.step + time.Millisecond)
+			if r > 0 && tc.conf.MaxAge > 0 {
+				// rotated files age by mod time
+				paths, _ := fs.rotatedFiles()
+				for _, path := range paths {
+					if err := os.Chtimes(path, tm.Add(-tc.conf.MaxAge*2), tm.Add(-tc.conf.MaxAge*2)); err != nil {
+						t.Fatalf("%v: chtimes err: %v", tc.name, err)
+					}
+				}
+			}
+			if _, err := fs.Write([]byte("r" + string(rune('0'+r)) + "\n")); err != nil {
+				t.Fatalf("%v: write err: %v", tc.name, err)
+			}
+			// wait background compression and cleanup
+			fs.wg.Wait()
+		}
+		files := testSinkFiles(t, fs)
+		if strings.Join(files, "|") != strings.Join(tc.files, "|") {
+			t.Fatalf("%v: expected files %q, got %q", tc.name, tc.files, files)
+		}
+		if tc.conf.Compress {
+			paths, _ := fs.rotatedFiles()
+			for _, path := range paths {
+				if !strings.HasSuffix(path, ".gz") {
+					t.Fatalf("%v: rotated file should be compressed, got %v", tc.name, path)
+				}
+			}
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatalf("%v: close err: %v", tc.name, err)
+		}
+		if _, err := fs.Write([]byte("r\n")); err == nil {
+			t.Fatalf("%v: write to closed sink should fail", tc.name)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_FileSink_Reopen(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileSink(FileSinkConfig{Dir: dir, Name: "out"})
+	if err != nil {
+		t.Fatalf("new file sink err: %v", err)
+	}
+	defer fs.Close()
+	if _, err := fs.Write([]byte("r0\n")); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	// file moved by logrotate, records written to moved file until reopen
+	moved := filepath.Join(dir, "out.log.1")
+	if err := os.Rename(fs.path, moved); err != nil {
+		t.Fatalf("rename err: %v", err)
+	}
+	if _, err := fs.Write([]byte("r1\n")); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	if err := fs.Reopen(); err != nil {
+		t.Fatalf("reopen err: %v", err)
+	}
+	if _, err := fs.Write([]byte("r2\n")); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(moved)
+	if err != nil || string(b) != "r0\nr1\n" {
+		t.Fatalf("expected moved file records, got %q, %v", b, err)
+	}
+	b, err = ioutil.ReadFile(fs.path)
+	if err != nil || string(b) != "r2\n" {
+		t.Fatalf("expected reopened file records, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// track points returned by default (track simplified over it)
+	geoMaxPoints = 1000
+	// start tolerance of track simplification to max points, m
+	geoMinTolerance = 1.0
+)
+
+// GeoJSON types
+const (
+	geoTypeFeatureCollection = "FeatureCollection"
+	geoTypeFeature           = "Feature"
+	geoTypePoint             = "Point"
+	geoTypeLineString        = "LineString"
+)
+
+// geoPoint GeoJSON Point geometry, coordinates [longitude, latitude]
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// geoLineString GeoJSON LineString geometry, coordinates [[longitude, latitude], ...]
+type geoLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+// geoDeviceProperties properties of device position feature
+type geoDeviceProperties struct {
+	IMEI         string  `json:"imei"`
+	Status       string  `json:"status"`
+	TimeNs       int64   `json:"time_ns"`
+	TemperatureC float64 `json:"temperature_c"`
+	AltitudeM    float64 `json:"altitude_m"`
+	BatteryPct   float64 `json:"battery_pct"`
+}
+
+// geoDeviceFeature GeoJSON Feature of device position
+type geoDeviceFeature struct {
+	Type       string              `json:"type"`
+	ID         string              `json:"id"`
+	Geometry   geoPoint            `json:"geometry"`
+	Properties geoDeviceProperties `json:"properties"`
+}
+
+// geoDevices GeoJSON FeatureCollection of device positions
+type geoDevices struct {
+	Type     string             `json:"type"`
+	Features []geoDeviceFeature `json:"features"`
+}
+
+// geoTrackProperties properties of device track feature: time of points (times_ns aligned with
+// coordinates), points of track before simplification
+type geoTrackProperties struct {
+	IMEI         string  `json:"imei"`
+	FromNs       int64   `json:"from_ns,omitempty"`
+	ToNs         int64   `json:"to_ns,omitempty"`
+	Points       int     `json:"points"`
+	SourcePoints int     `json:"source_points"`
+	ToleranceM   float64 `json:"tolerance_m"`
+	TimesNs      []int64 `json:"times_ns"`
+}
+
+// geoTrack GeoJSON Feature of device track (null geometry if less than 2 points)
+type geoTrack struct {
+	Type       string             `json:"type"`
+	ID         string             `json:"id"`
+	Geometry   *geoLineString     `json:"geometry"`
+	Properties geoTrackProperties `json:"properties"`
+}
+
+// geoBBox bounding box: min longitude, min latitude, max longitude, max latitude
+// (box crosses antimeridian if min longitude is over max longitude)
+type geoBBox struct {
+	set                            bool
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// contains returns whether position is in bounding box (any position if box not set)
+func (b *geoBBox) contains(lat, lon float64) bool {
+	if !b.set {
+		return true
+	}
+	if lat < b.minLat || lat > b.maxLat {
+		return false
+	}
+	if b.minLon <= b.maxLon {
+		return lon >= b.minLon && lon <= b.maxLon
+	}
+	return lon >= b.minLon || lon <= b.maxLon
+}
+
+// queryBBox parses bbox query parameter "minLon,minLat,maxLon,maxLat" (not set if empty)
+func queryBBox(q url.Values) (geoBBox, error) {
+	b := geoBBox{}
+	v := q.Get("bbox")
+	if v == "" {
+		return b, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return b, errors.New("wrong bbox")
+	}
+	var vals [4]float64
+	for i, p := range parts {
+		x, err := strconv.ParseFloat(p, 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+			return b, errors.New("wrong bbox")
+		}
+		vals[i] = x
+	}
+	b = geoBBox{set: true, minLon: vals[0], minLat: vals[1], maxLon: vals[2], maxLat: vals[3]}
+	if b.minLat > b.maxLat || b.minLat < -90 || b.maxLat > 90 || math.Abs(b.minLon) > 180 || math.Abs(b.maxLon) > 180 {
+		return b, errors.New("wrong bbox")
+	}
+	return b, nil
+}
+
+// devicePositions returns positions of devices with valid readings in bounding box (ordered by IMEI)
+func (s *Server) devicePositions(bbox geoBBox) *geoDevices {
+	fc := &geoDevices{Type: geoTypeFeatureCollection, Features: []geoDeviceFeature{}}
+	for _, ds := range s.pipe.devs.list() {
+		ds.mux.Lock()
+		last := ds.last
+		ds.mux.Unlock()
+		if last.time == 0 || !bbox.contains(last.msg.Lat, last.msg.Lon) {
+			continue
+		}
+		fc.Features = append(fc.Features, geoDeviceFeature{
+			Type:     geoTypeFeature,
+			ID:       ds.imei,
+			Geometry: geoPoint{Type: geoTypePoint, Coordinates: [2]float64{last.msg.Lon, last.msg.Lat}},
+			Properties: geoDeviceProperties{
+				IMEI: ds.imei, Status: s.deviceStatus(ds.imei).Status, TimeNs: last.time,
+				TemperatureC: last.msg.Temp, AltitudeM: last.msg.Alt, BatteryPct: last.msg.BattLev,
+			},
+		})
+	}
+	sort.Slice(fc.Features, func(i, j int) bool { return fc.Features[i].ID < fc.Features[j].ID })
+	return fc
+}
+
+// deviceTrack returns track of device readings in time range [from, to) and bounding box,
+// simplified by tolerance (m), or to max points if tolerance is zero
+func (s *Server) deviceTrack(imei string, from, to int64, bbox geoBBox, tolerance float64, maxPoints int) *geoTrack {
+	tr := &geoTrack{Type: geoTypeFeature, ID: imei, Properties: geoTrackProperties{IMEI: imei, TimesNs: []int64{}}}
+	var pts []histReading
+	for _, hr := range s.pipe.history(imei, from, to) {
+		if bbox.contains(hr.msg.Lat, hr.msg.Lon) {
+			pts = append(pts, hr)
+		}
+	}
+	tr.Properties.SourcePoints = len(pts)
+
+	keep := simplifyTrack(pts, tolerance)
+	for tolerance == 0 && countKept(keep) > maxPoints {
+		if tr.Properties.ToleranceM == 0 {
+			tr.Properties.ToleranceM = geoMinTolerance
+		} else {
+			tr.Properties.ToleranceM *= 2
+		}
+		keep = simplifyTrack(pts, tr.Properties.ToleranceM)
+	}
+	if tolerance > 0 {
+		tr.Properties.ToleranceM = tolerance
+	}
+
+	line := &geoLineString{Type: geoTypeLineString, Coordinates: [][2]float64{}}
+	for i, hr := range pts {
+		if !keep[i] {
+			continue
+		}
+		line.Coordinates = append(line.Coordinates, [2]float64{hr.msg.Lon, hr.msg.Lat})
+		tr.Properties.TimesNs = append(tr.Properties.TimesNs, hr.time)
+	}
+	tr.Properties.Points = len(line.Coordinates)
+	if n := len(tr.Properties.TimesNs); n > 0 {
+		tr.Properties.FromNs, tr.Properties.ToNs = tr.Properties.TimesNs[0], tr.Properties.TimesNs[n-1]
+	}
+	if len(line.Coordinates) >= 2 {
+		tr.Geometry = line
+	}
+	return tr
+}
+
+// countKept returns kept points of track
+func countKept(keep []bool) int {
+	n := 0
+	for _, k := range keep {
+		if k {
+			n++
+		}
+	}
+	return n
+}
+
+// simplifyTrack returns kept points of track simplified by Douglas-Peucker with tolerance (m),
+// distances of points in equirectangular projection (all points kept if tolerance is zero)
+func simplifyTrack(pts []histReading, tolerance float64) []bool {
+	keep := make([]bool, len(pts))
+	if tolerance <= 0 || len(pts) <= 2 {
+		for i := range keep {
+			keep[i] = true
+		}
+		return keep
+	}
+	// projection of positions, m
+	cosLat := math.Cos(pts[0].msg.Lat * math.Pi / 180)
+	xy := make([][2]float64, len(pts))
+	for i, hr := range pts {
+		lon := hr.msg.Lon - pts[0].msg.Lon
+		// shortest longitude difference over antimeridian
+		lon = math.Remainder(lon, 360)
+		xy[i] = [2]float64{lon * cosLat * math.Pi / 180 * earthRadius, hr.msg.Lat * math.Pi / 180 * earthRadius}
+	}
+
+	keep[0], keep[len(pts)-1] = true, true
+	stack := [][2]int{{0, len(pts) - 1}}
+	for len(stack) > 0 {
+		seg := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		maxDist, maxI := 0.0, -1
+		for i := seg[0] + 1; i < seg[1]; i++ {
+			if d := segmentDistance(xy[i], xy[seg[0]], xy[seg[1]]); d > maxDist {
+				maxDist, maxI = d, i
+			}
+		}
+		if maxI < 0 || maxDist <= tolerance {
+			continue
+		}
+		keep[maxI] = true
+		stack = append(stack, [2]int{seg[0], maxI}, [2]int{maxI, seg[1]})
+	}
+	return keep
+}
+
+// segmentDistance returns distance of point p to segment ab
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/l))
+	}
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
+
+// geoDevices returns GeoJSON FeatureCollection of device positions, query: bbox (JSON errors)
+func (s *Server) geoDevices(w http.ResponseWriter, req *http.Request) {
+	bbox, err := queryBBox(req.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	writeGeoJSON(w, s.devicePositions(bbox))
+}
+
+// geoTrack returns GeoJSON LineString Feature of device track from history,
+// query: from, to (unix nano), bbox, tolerance (m), max_points (JSON errors)
+func (s *Server) geoTrack(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/geo/devices/"), "/")
+	if len(path) != 2 || path[1] != "track" {
+		writeAPIError(w, http.StatusNotFound, errCodeNotFound, "route not found")
+		return
+	}
+	imei := path[0]
+	if _, err := validParseIMEIString(imei); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidIMEI, err.Error())
+		return
+	}
+
+	// device of other node
+	if s.proxyOwner(w, req, imei) {
+		return
+	}
+	q := req.URL.Query()
+	from, to, err := queryTimeRange(q)
+	var bbox geoBBox
+	if err == nil {
+		bbox, err = queryBBox(q)
+	}
+	tolerance, maxPoints := 0.0, geoMaxPoints
+	if v := q.Get("tolerance"); err == nil && v != "" {
+		if tolerance, err = strconv.ParseFloat(v, 64); err != nil || tolerance < 0 || math.IsInf(tolerance, 0) {
+			err = errors.New("wrong tolerance")
+		}
+	}
+	if v := q.Get("max_points"); err == nil && v != "" {
+		if maxPoints, err = strconv.Atoi(v); err != nil || maxPoints < 2 {
+			err = errors.New("wrong max_points")
+		}
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	writeGeoJSON(w, s.deviceTrack(imei, from, to, bbox, tolerance, maxPoints))
+}
+
+// writeGeoJSON writes GeoJSON response
+func writeGeoJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("http server: response marshal err: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_queryBBox(t *testing.T) {
+
+	testCases := []struct {
+		name string
+		bbox string
+		err  bool
+		// positions in and out of box
+		in, out [][2]float64
+	}{
+		// Positive
+		{name: "not set", in: [][2]float64{{0, 0}, {-90, 180}}},
+		{name: "box", bbox: "30,50,40,60", in: [][2]float64{{55, 35}, {50, 30}}, out: [][2]float64{{45, 35}, {55, 41}}},
+		{name: "over antimeridian", bbox: "170,-10,-170,10", in: [][2]float64{{0, 175}, {0, -175}}, out: [][2]float64{{0, 0}, {20, 175}}},
+		// Negative
+		{name: "wrong count", bbox: "1,2,3", err: true},
+		{name: "wrong float", bbox: "a,2,3,4", err: true},
+		{name: "min lat over max lat", bbox: "0,10,1,5", err: true},
+		{name: "out of range", bbox: "0,-91,1,5", err: true},
+	}
+
+	for _, tc := range testCases {
+
+		b, err := queryBBox(url.Values{"bbox": {tc.bbox}})
+		if tc.err != (err != nil) {
+			t.Fatalf("%v: expected err %v, got %v", tc.name, tc.err, err)
+		}
+		for _, p := range tc.in {
+			if !b.contains(p[0], p[1]) {
+				t.Fatalf("%v: position %v should be in box", tc.name, p)
+			}
+		}
+		for _, p := range tc.out {
+			if b.contains(p[0], p[1]) {
+				t.Fatalf("%v: position %v should not be in box", tc.name, p)
+			}
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_simplifyTrack(t *testing.T) {
+
+	// track of positions, metres north and east of origin
+	track := func(pos [][2]float64) []histReading {
+		pts := make([]histReading, len(pos))
+		for i, p := range pos {
+			pts[i] = histReading{time: int64(i), msg: readingMessage{Lat: p[0] * testDegPerM, Lon: p[1] * testDegPerM}}
+		}
+		return pts
+	}
+	line := make([][2]float64, 100)
+	for i := range line {
+		line[i] = [2]float64{float64(i) * 10, 0.5 * math.Sin(float64(i))}
+	}
+
+	testCases := []struct {
+		name      string
+		pos       [][2]float64
+		tolerance float64
+		// expected kept points
+		kept []int
+	}{
+		// Positive
+		{name: "straight line with jitter", pos: line, tolerance: 1, kept: []int{0, 99}},
+		{name: "corner", pos: [][2]float64{{0, 0}, {100, 0}, {200, 0}, {200, 100}, {200, 200}}, tolerance: 5, kept: []int{0, 2, 4}},
+		{name: "detour", pos: [][2]float64{{0, 0}, {100, 0}, {100, 50}, {100, 0}, {200, 0}}, tolerance: 5, kept: []int{0, 1, 2, 3, 4}},
+		// Negative
+		{name: "no tolerance", pos: [][2]float64{{0, 0}, {1, 0}, {2, 0}}, kept: []int{0, 1, 2}},
+		{name: "jitter over tolerance", pos: line[:5], tolerance: 0.01, kept: []int{0, 1, 2, 3, 4}},
+	}
+
+	for _, tc := range testCases {
+
+		keep := simplifyTrack(track(tc.pos), tc.tolerance)
+		var kept []int
+		for i, k := range keep {
+			if k {
+				kept = append(kept, i)
+			}
+		}
+		if len(kept) != len(tc.kept) {
+			t.Fatalf("%v: expected kept %v, got %v", tc.name, tc.kept, kept)
+		}
+		for i := range kept {
+			if kept[i] != tc.kept[i] {
+				t.Fatalf("%v: expected kept %v, got %v", tc.name, tc.kept, kept)
+			}
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_Server_geo(t *testing.T) {
+
+	s := New(Config{HistorySize: 1000}, testOutLog)
+	now := time.Now().UnixNano()
+	// device moving north 10 m each reading with zigzag, device in other area
+	ds := s.pipe.devs.get("490154203237518")
+	for i := 0; i < 500; i++ {
+		rm := readingMessage{Temp: 20 + float64(i)/100, Lat: 55 + float64(i)*10*testDegPerM, Lon: 37 + float64(i%2)*testDegPerM, BattLev: 50}
+		s.pipe.reading(now+int64(i)*int64(time.Second), ds, testFrame(rm), &decodedReading{})
+	}
+	s.pipe.reading(now, s.pipe.devs.get("490154203237526"), testFrame(readingMessage{Temp: -5, Lat: -33.9, Lon: 151.2, BattLev: 80}), &decodedReading{})
+	// device without valid readings
+	s.pipe.devs.get("356938035643809")
+
+	testCases := []struct {
+		name string
+		path string
+		code int
+		// expected device features or track points
+		imeis  []string
+		points int
+	}{
+		// Positive
+		{name: "devices", path: "/geo/devices", code: http.StatusOK, imeis: []string{"490154203237518", "490154203237526"}},
+		{name: "devices in bbox", path: "/geo/devices?bbox=150,-35,152,-33", code: http.StatusOK, imeis: []string{"490154203237526"}},
+		{name: "track", path: "/geo/devices/490154203237518/track", code: http.StatusOK, points: 500},
+		{name: "track time range", path: fmt.Sprintf("/geo/devices/490154203237518/track?from=%v&to=%v", now+100*int64(time.Second), now+200*int64(time.Second)),
+			code: http.StatusOK, points: 100},
+		{name: "track simplified by tolerance", path: "/geo/devices/490154203237518/track?tolerance=5", code: http.StatusOK, points: 2},
+		{name: "track simplified to max points", path: "/geo/devices/490154203237518/track?max_points=100", code: http.StatusOK, points: 2},
+		{name: "unknown device track", path: "/geo/devices/356938035643809/track", code: http.StatusOK},
+		// Negative
+		{name: "wrong bbox", path: "/geo/devices?bbox=1,2", code: http.StatusBadRequest},
+		{name: "wrong tolerance", path: "/geo/devices/490154203237518/track?tolerance=-1", code: http.StatusBadRequest},
+		{name: "wrong time range", path: "/geo/devices/490154203237518/track?from=2&to=1", code: http.StatusBadRequest},
+		{name: "wrong max points", path: "/geo/devices/490154203237518/track?max_points=1", code: http.StatusBadRequest},
+		{name: "wrong imei", path: "/geo/devices/49015420323751/track", code: http.StatusBadRequest},
+		{name: "wrong resource", path: "/geo/devices/490154203237518/path", code: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v (%s)", tc.name, tc.code, rec.Code, rec.Body.Bytes())
+		}
+		if tc.code != http.StatusOK {
+			ae := apiError{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &ae); err != nil || ae.Error == "" || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("%v: wrong error response %s, %v", tc.name, rec.Body.Bytes(), err)
+			}
+			t.Logf("%v: test ok", tc.name)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/geo+json" {
+			t.Fatalf("%v: wrong content type %v", tc.name, ct)
+		}
+		if tc.imeis != nil {
+			fc := geoDevices{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &fc); err != nil || fc.Type != geoTypeFeatureCollection || len(fc.Features) != len(tc.imeis) {
+				t.Fatalf("%v: wrong devices %s, %v", tc.name, rec.Body.Bytes(), err)
+			}
+			for i, imei := range tc.imeis {
+				if f := fc.Features[i]; f.ID != imei || f.Properties.Status != "offline" || f.Geometry.Type != geoTypePoint {
+					t.Fatalf("%v: wrong feature %v: %+v", tc.name, i, f)
+				}
+			}
+			t.Logf("%v: test ok", tc.name)
+			continue
+		}
+		tr := geoTrack{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &tr); err != nil || tr.Type != geoTypeFeature || tr.Properties.Points != tc.points ||
+			len(tr.Properties.TimesNs) != tc.points || tc.points < 2 && tr.Geometry != nil || tc.points >= 2 && len(tr.Geometry.Coordinates) != tc.points {
+			t.Fatalf("%v: wrong track %s, %v", tc.name, rec.Body.Bytes(), err)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// last device position, track time range and bbox
+	fc := s.devicePositions(geoBBox{})
+	if p := fc.Features[0]; math.Abs(p.Geometry.Coordinates[1]-(55+4990*testDegPerM)) > 1e-9 || math.Abs(p.Properties.TemperatureC-24.99) > 1e-9 || p.Properties.TimeNs != now+499*int64(time.Second) {
+		t.Fatalf("wrong device position %+v", p)
+	}
+	bbox := geoBBox{set: true, minLon: 36, minLat: 55, maxLon: 38, maxLat: 55 + 199.5*10*testDegPerM}
+	tr := s.deviceTrack("490154203237518", now+100*int64(time.Second), now+300*int64(time.Second), bbox, 0, geoMaxPoints)
+	if tr.Properties.Points != 100 || tr.Properties.FromNs != now+100*int64(time.Second) || tr.Properties.ToNs != now+199*int64(time.Second) {
+		t.Fatalf("wrong track of time range and bbox %+v", tr.Properties)
+	}
+}
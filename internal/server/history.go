@@ -0,0 +1,217 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// histReading valid Reading message of device kept in history with raw message (raw equals message
+// if device not calibrated)
+type histReading struct {
+	time       int64
+	msg        readingMessage
+	raw        readingMessage
+	calibrated bool
+}
+
+// newHistReading history reading of Reading message of time t, raw message nil if device not calibrated
+func newHistReading(t int64, rm, raw *readingMessage) histReading {
+	hr := histReading{time: t, msg: *rm, raw: *rm}
+	if raw != nil {
+		hr.raw, hr.calibrated = *raw, true
+	}
+	return hr
+}
+
+// devHistory ring of last valid Reading messages of device (should be used under device state lock),
+// ring grows up to size readings
+type devHistory struct {
+	readings []histReading
+	size     int
+	// index of next overwritten reading of full ring (oldest reading)
+	next int
+	// readings added in time order (range found by binary search)
+	ordered bool
+	// last add time (server time, unix nano)
+	updated int64
+}
+
+// inits device history of size readings
+func newDevHistory(size int) *devHistory {
+	dh := &devHistory{
+		size:    size,
+		ordered: true,
+	}
+	return dh
+}
+
+// add adds Reading message of time t (raw message nil if device not calibrated),
+// oldest reading is overwritten if history is full
+func (dh *devHistory) add(t int64, rm, raw *readingMessage) {
+	if n := len(dh.readings); n > 0 && t < dh.at(n-1).time {
+		dh.ordered = false
+	}
+	if len(dh.readings) < dh.size {
+		dh.readings = append(dh.readings, newHistReading(t, rm, raw))
+		return
+	}
+	dh.readings[dh.next] = newHistReading(t, rm, raw)
+	dh.next = (dh.next + 1) % len(dh.readings)
+}
+
+// at returns i-th reading in receive order
+func (dh *devHistory) at(i int) *histReading {
+	return &dh.readings[(dh.next+i)%len(dh.readings)]
+}
+
+// rangeCopy appends readings of time range [from, to) to dst in receive order
+func (dh *devHistory) rangeCopy(dst []histReading, from, to int64) []histReading {
+	n := len(dh.readings)
+	if !dh.ordered {
+		for i := 0; i < n; i++ {
+			if hr := dh.at(i); hr.time >= from && hr.time < to {
+				dst = append(dst, *hr)
+			}
+		}
+		return dst
+	}
+	for i := sort.Search(n, func(i int) bool { return dh.at(i).time >= from }); i < n; i++ {
+		hr := dh.at(i)
+		if hr.time >= to {
+			break
+		}
+		dst = append(dst, *hr)
+	}
+	return dst
+}
+
+// histDevices devices with history, number of devices capped
+// (history of least recently updated device evicted)
+type histDevices struct {
+	mux  sync.Mutex
+	devs map[string]*devState
+	// max devices (unlimited if zero)
+	max int
+}
+
+func newHistDevices(max int) *histDevices {
+	hd := &histDevices{
+		devs: make(map[string]*devState),
+		max:  max,
+	}
+	return hd
+}
+
+// track adds device with new history, evicts history of least recently updated device over max devices
+// (device state should not be locked)
+func (hd *histDevices) track(ds *devState) {
+	hd.mux.Lock()
+	defer hd.mux.Unlock()
+	hd.devs[ds.imei] = ds
+	if hd.max <= 0 || len(hd.devs) <= hd.max {
+		return
+	}
+	var oldest *devState
+	var oldestUpdated int64
+	for _, d := range hd.devs {
+		if d == ds {
+			continue
+		}
+		d.mux.Lock()
+		updated := int64(0)
+		if d.history != nil {
+			updated = d.history.updated
+		}
+		d.mux.Unlock()
+		if oldest == nil || updated < oldestUpdated {
+			oldest, oldestUpdated = d, updated
+		}
+	}
+	hd.evict(oldest)
+}
+
+// expire evicts histories of devices not updated within idle before time now
+func (hd *histDevices) expire(now int64, idle time.Duration) {
+	hd.mux.Lock()
+	defer hd.mux.Unlock()
+	for _, d := range hd.devs {
+		d.mux.Lock()
+		expired := d.history == nil || now-d.history.updated > int64(idle)
+		d.mux.Unlock()
+		if expired {
+			hd.evict(d)
+		}
+	}
+}
+
+// evict drops history of device (should be called under lock)
+func (hd *histDevices) evict(ds *devState) {
+	ds.mux.Lock()
+	ds.history = nil
+	ds.mux.Unlock()
+	delete(hd.devs, ds.imei)
+}
+
+// retain keeps valid Reading message of device (raw message nil if device not calibrated) as last message,
+// in history and rollups, logs closed rollup buckets
+func (p *pipeline) retain(now int64, ds *devState, rm, raw *readingMessage) {
+	var closed [rollupResNum]closedBucket
+	newHistory := false
+	ds.mux.Lock()
+	if p.historySize > 0 {
+		if ds.history == nil {
+			ds.history = newDevHistory(p.historySize)
+			newHistory = true
+		}
+		ds.history.add(now, rm, raw)
+		ds.history.updated = time.Now().UnixNano()
+	}
+	if ds.rollups == nil {
+		ds.rollups = newDevRollups()
+	}
+	n := ds.rollups.add(now, rm, &closed)
+	ds.battery.add(now, rm.BattLev)
+	// last reading kept by time (out of order readings of ingested backlog are older)
+	if now >= ds.last.time {
+		ds.last = newHistReading(now, rm, raw)
+	}
+	ds.mux.Unlock()
+
+	if newHistory {
+		p.histDevs.track(ds)
+	}
+	p.rollupsOutput(ds.imei, closed[:n])
+}
+
+// historyExpire drops histories of devices not updated within history idle time (kept if zero)
+func (p *pipeline) historyExpire(now int64) {
+	if p.historyIdle > 0 {
+		p.histDevs.expire(now, p.historyIdle)
+	}
+}
+
+// history returns readings of device in time range [from, to)
+func (p *pipeline) history(imei string, from, to int64) []histReading {
+	ds, ok := p.devs.lookup(imei)
+	if !ok {
+		return nil
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	if ds.history == nil {
+		return nil
+	}
+	return ds.history.rangeCopy(nil, from, to)
+}
+
+// lastReading returns last retained reading of device
+func (p *pipeline) lastReading(imei string) (histReading, bool) {
+	ds, ok := p.devs.lookup(imei)
+	if !ok {
+		return histReading{}, false
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	return ds.last, ds.last.time != 0
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+)
+
+const (
+	// ingest binary frame: IMEI, time (unix nano, int64 Big-Endian), Reading message
+	ingestFrameLength = imeiLength + 8 + msgLength
+	// max size of ingest request body
+	ingestMaxBodySize = 1 << 22
+)
+
+// ingest request (JSON)
+type ingestRequest struct {
+	Readings []ingestReading `json:"readings"`
+}
+
+// ingestReading device Reading with its original device time
+type ingestReading struct {
+	IMEI    string         `json:"imei"`
+	Time    int64          `json:"time"`
+	Reading readingMessage `json:"reading"`
+}
+
+// ingest response
+type ingestResponse struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []ingestResult `json:"results"`
+}
+
+// ingestResult accept/reject result of batch item
+type ingestResult struct {
+	Index    int    `json:"index"`
+	IMEI     string `json:"imei"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ingest accepts batch of Reading messages of devices (uploaded by gateways)
+func (s *Server) ingest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		if _, err := w.Write([]byte("405 Method Not Allowed")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, ingestMaxBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		if _, err := w.Write([]byte("413 Request Entity Too Large")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// batch items by content type
+	var items []ingestReading
+	var results []ingestResult
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mt {
+	case "application/json":
+		ir := ingestRequest{}
+		if err := json.Unmarshal(body, &ir); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte("400 Bad Request")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		items = ir.Readings
+		results = make([]ingestResult, len(items))
+		for i := range items {
+			results[i] = ingestResult{Index: i, IMEI: items[i].IMEI}
+			if _, err := validParseIMEIString(items[i].IMEI); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+	case "application/octet-stream":
+		if len(body)%ingestFrameLength != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte("400 Wrong Frames Length")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		items = make([]ingestReading, len(body)/ingestFrameLength)
+		results = make([]ingestResult, len(items))
+		for i := range items {
+			frame := body[i*ingestFrameLength : (i+1)*ingestFrameLength]
+			results[i] = ingestResult{Index: i}
+			imei, err := parseIngestFrame(frame, &items[i])
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+			results[i].IMEI = imei
+		}
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		if _, err := w.Write([]byte("415 Unsupported Media Type")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// validate and log readings
+	resp := ingestResponse{Results: results}
+	for i := range items {
+		if results[i].Error == "" {
+			if err := s.ingestReading(&items[i]); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		if results[i].Error == "" {
+			results[i].Accepted = true
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+	log.Printf("ingest, raddr - %v, accepted %v, rejected %v", req.RemoteAddr, resp.Accepted, resp.Rejected)
+
+	// response
+	out, err := json.Marshal(&resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
+
+// ingestReading validates Reading of batch item (time of item is device time) and logs it to output,
+// items of banned devices rejected
+func (s *Server) ingestReading(ir *ingestReading) error {
+	if ir.Time <= 0 {
+		return errors.New("reading time required")
+	}
+	now := time.Now().UnixNano()
+	if _, ok := s.pipe.bans.banned(ir.IMEI, now); ok {
+		return errBanned
+	}
+	frame := make([]byte, msgLength)
+	messageBytes(&ir.Reading, frame)
+	r := decodedReading{}
+	if !s.pipe.readingAt(now, ir.Time, s.pipe.devs.get(ir.IMEI), frame, &r) {
+		log.Printf("ingest, imei %v, invalid reading message %+v: %v", ir.IMEI, r.msg, r.reasons())
+		return fmt.Errorf("invalid reading message: %v", r.reasons())
+	}
+	return nil
+}
+
+// parseIngestFrame parses binary ingest frame, returns parsed IMEI
+func parseIngestFrame(frame []byte, ir *ingestReading) (string, error) {
+	// panic if len less then frame length
+	_ = frame[ingestFrameLength-1]
+
+	imei, err := validParseIMEI(frame[:imeiLength])
+	if err != nil {
+		return "", err
+	}
+	ir.IMEI = imei
+	ir.Time = int64(binary.BigEndian.Uint64(frame[imeiLength : imeiLength+8]))
+	parseMessage(frame[imeiLength+8:ingestFrameLength], &ir.Reading)
+	return imei, nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// binary ingest frame
+func testIngestFrame(t *testing.T, imei []byte, tm int64, rm readingMessage) []byte {
+	var buf bytes.Buffer
+	buf.Write(imei)
+	if err := binary.Write(&buf, binary.BigEndian, tm); err != nil {
+		t.Fatalf("time to bytes converting err: %v", err)
+	}
+	if err := binary.Write(&buf, binary.BigEndian, rm); err != nil {
+		t.Fatalf("message to bytes converting err: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func Test_Server_ingest(t *testing.T) {
+
+	jsonBatch := `{"readings":[
+		{"imei":"490154203237518","time":1257894000000000000,"reading":{"Temp":67.77,"BattLev":0.25}},
+		{"imei":"490154203237519","time":1257894000000000000,"reading":{"BattLev":1}},
+		{"imei":"490154203237518","time":1257894000000000001,"reading":{"Temp":301,"BattLev":1}},
+		{"imei":"490154203237518","reading":{"BattLev":1}},
+		{"imei":"490154203237518","time":%v,"reading":{"BattLev":1}}
+	]}`
+	// far future time
+	jsonBatch = fmt.Sprintf(jsonBatch, time.Now().AddDate(100, 0, 0).UnixNano())
+	var binBatch []byte
+	binBatch = append(binBatch, testIngestFrame(t, testIMEI, 1257894000000000000, readingMessage{Temp: 67.77, BattLev: 0.25})...)
+	binBatch = append(binBatch, testIngestFrame(t, testIMEI, 1257894000000000001, readingMessage{BattLev: 0})...)
+
+	testCases := []struct {
+		name        string
+		method      string
+		contentType string
+		body        []byte
+		code        int
+		accepted    []bool
+	}{
+		// Positive
+		{
+			name:        "json batch",
+			method:      "POST",
+			contentType: "application/json",
+			body:        []byte(jsonBatch),
+			code:        http.StatusOK,
+			accepted:    []bool{true, false, false, false, false},
+		},
+		{
+			name:        "binary batch",
+			method:      "POST",
+			contentType: "application/octet-stream",
+			body:        binBatch,
+			code:        http.StatusOK,
+			accepted:    []bool{true, false},
+		},
+		// Negative
+		{
+			name:   "wrong method",
+			method: "GET",
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:        "wrong content type",
+			method:      "POST",
+			contentType: "text/plain",
+			code:        http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "binary batch, partial frame",
+			method:      "POST",
+			contentType: "application/octet-stream",
+			body:        binBatch[:ingestFrameLength+1],
+			code:        http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		var out bytes.Buffer
+		s := New(Config{OutputTime: TimeDevice, TimestampMaxFuture: time.Minute}, log.New(&out, "", 0))
+
+		req := httptest.NewRequest(tc.method, "/ingest", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v", tc.name, tc.code, rec.Code)
+		}
+		if tc.code != http.StatusOK {
+			t.Logf("%v: test ok", tc.name)
+			continue
+		}
+
+		resp := ingestResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v: response unmarshal err: %v", tc.name, err)
+		}
+		if len(resp.Results) != len(tc.accepted) {
+			t.Fatalf("%v: expected %v results, got %+v", tc.name, len(tc.accepted), resp)
+		}
+		for i, ok := range tc.accepted {
+			if resp.Results[i].Accepted != ok {
+				t.Fatalf("%v: item %v, expected accepted %v, got %+v", tc.name, i, ok, resp.Results[i])
+			}
+		}
+		if tc.contentType == "application/json" && resp.Results[4].Error != "invalid reading message: Time: above max" {
+			t.Fatalf("%v: far future item should be rejected by time, got %+v", tc.name, resp.Results[4])
+		}
+		if out.String() != "1257894000000000000,490154203237518,67.770000,0.000000,0.000000,0.000000,0.250000\n" {
+			t.Fatalf("%v: wrong output %q", tc.name, out.String())
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_Server_ingest_Banned(t *testing.T) {
+
+	var out bytes.Buffer
+	s := New(Config{}, log.New(&out, "", 0))
+	if err := s.pipe.bans.ban("490154203237518", &deviceRestriction{Reason: "test"}); err != nil {
+		t.Fatalf("ban err: %v", err)
+	}
+	body := `{"readings":[
+		{"imei":"490154203237518","time":1257894000000000000,"reading":{"BattLev":1}},
+		{"imei":"490154203237526","time":1257894000000000000,"reading":{"BattLev":1}}
+	]}`
+	req := httptest.NewRequest("POST", "/ingest", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, req)
+	resp := ingestResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response unmarshal err: %v", err)
+	}
+	if resp.Accepted != 1 || resp.Rejected != 1 || resp.Results[0].Error != errBanned.Error() || !resp.Results[1].Accepted {
+		t.Fatalf("item of banned device should be rejected, got %+v", resp)
+	}
+	if strings.Contains(out.String(), ",490154203237518,") {
+		t.Fatalf("reading of banned device should not be output, got %q", out.String())
+	}
+}
+
+func Test_validParseIMEIString(t *testing.T) {
+
+	for _, imei := range []string{"490154203237518", "49015420323751", "490154203237519", "49015420323751a"} {
+		_, err := validParseIMEIString(imei)
+		if (err == nil) != strings.HasSuffix(imei, "8") {
+			t.Fatalf("imei %v, unexpected validation result, err: %v", imei, err)
+		}
+	}
+}
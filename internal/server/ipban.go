@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IP ban defaults
+const (
+	ipBanMaxFailures = 5
+	ipBanWindow      = time.Minute
+	ipBanTime        = time.Minute
+	ipBanMaxTime     = time.Hour * 24
+)
+
+// IPBanConfig configs of temporary bans of remote IPs with repeated failed device logins
+// (wrong IMEI, login timeout)
+type IPBanConfig struct {
+	// failed logins in sliding window to ban IP
+	MaxFailures int
+	Window      time.Duration
+	// ban time of first ban, doubled each next ban of IP (limited by max ban time),
+	// ban count of IP reset if IP not banned for max ban time
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+	// allowlist of trusted IPs, CIDRs (never banned)
+	Allow []string
+}
+
+// ipRecord failed logins and bans of remote IP
+type ipRecord struct {
+	// failed login times in window (unix nano)
+	failures []int64
+	// bans count, ban end time, last failure time
+	bans  int
+	until int64
+	last  int64
+}
+
+// ipBanStatus failed logins and ban of remote IP (JSON)
+type ipBanStatus struct {
+	IP       string `json:"ip"`
+	Failures int    `json:"failures"`
+	Bans     int    `json:"bans"`
+	Until    int64  `json:"until,omitempty"`
+}
+
+// ipBansResponse /admin/ipbans response
+type ipBansResponse struct {
+	Refused int64         `json:"refused"`
+	IPs     []ipBanStatus `json:"ips"`
+}
+
+// ipGuard tracks failed logins of remote IPs, bans IPs exceeded failures
+type ipGuard struct {
+	conf  IPBanConfig
+	allow []*net.IPNet
+
+	mux sync.Mutex
+	ips map[string]*ipRecord
+
+	// connections refused at accept (updated atomically)
+	refused int64
+}
+
+// inits IP guard
+func newIPGuard(conf IPBanConfig) (*ipGuard, error) {
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = ipBanMaxFailures
+	}
+	if conf.Window <= 0 {
+		conf.Window = ipBanWindow
+	}
+	if conf.BanTime <= 0 {
+		conf.BanTime = ipBanTime
+	}
+	if conf.MaxBanTime <= 0 {
+		conf.MaxBanTime = ipBanMaxTime
+	}
+	if conf.MaxBanTime < conf.BanTime {
+		conf.MaxBanTime = conf.BanTime
+	}
+	g := &ipGuard{conf: conf, ips: make(map[string]*ipRecord)}
+	for _, a := range conf.Allow {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("ip ban: allowlist: %v", err)
+		}
+		g.allow = append(g.allow, n)
+	}
+	return g, nil
+}
+
+// remoteIP returns IP of remote address (host:port)
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// allowlisted returns whether IP is trusted
+func (g *ipGuard) allowlisted(ip string) bool {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return false
+	}
+	for _, n := range g.allow {
+		if n.Contains(pip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns false if IP is banned at time now (refused connection counted)
+func (g *ipGuard) allowed(ip string, now int64) bool {
+	g.mux.Lock()
+	r, ok := g.ips[ip]
+	banned := ok && now < r.until
+	g.mux.Unlock()
+	if banned {
+		atomic.AddInt64(&g.refused, 1)
+	}
+	return !banned
+}
+
+// failed counts failed login of IP at time now, bans IP exceeded failures in window,
+// returns true if IP banned
+func (g *ipGuard) failed(ip string, now int64) bool {
+	if g.allowlisted(ip) {
+		return false
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	r, ok := g.ips[ip]
+	if !ok {
+		r = &ipRecord{}
+		g.ips[ip] = r
+	}
+	// ban count reset
+	if r.bans > 0 && now-r.until > int64(g.conf.MaxBanTime) {
+		r.bans = 0
+	}
+	r.last = now
+	r.failures = append(g.expired(r.failures, now), now)
+	if len(r.failures) < g.conf.MaxFailures {
+		return false
+	}
+	r.bans++
+	ban := g.conf.BanTime
+	for i := 1; i < r.bans && ban < g.conf.MaxBanTime; i++ {
+		ban *= 2
+	}
+	if ban > g.conf.MaxBanTime {
+		ban = g.conf.MaxBanTime
+	}
+	r.until = now + int64(ban)
+	r.failures = r.failures[:0]
+	log.Printf("ip ban, ip - %v banned for %v (ban %v)", ip, ban, r.bans)
+	return true
+}
+
+// expired removes failure times out of window (should be used under lock)
+func (g *ipGuard) expired(failures []int64, now int64) []int64 {
+	i := 0
+	for i < len(failures) && now-failures[i] > int64(g.conf.Window) {
+		i++
+	}
+	return append(failures[:0], failures[i:]...)
+}
+
+// unban removes ban and failures of IP, returns false if IP not tracked
+func (g *ipGuard) unban(ip string) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	_, ok := g.ips[ip]
+	delete(g.ips, ip)
+	return ok
+}
+
+// cleanup forgets IPs without failures in window, not banned and with reset ban count
+func (g *ipGuard) cleanup(now int64) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for ip, r := range g.ips {
+		if now-r.last > int64(g.conf.Window) && now-r.until > int64(g.conf.MaxBanTime) {
+			delete(g.ips, ip)
+		}
+	}
+}
+
+// snapshot returns failures and bans of tracked IPs, sorted by IP
+func (g *ipGuard) snapshot(now int64) *ipBansResponse {
+	resp := &ipBansResponse{Refused: atomic.LoadInt64(&g.refused), IPs: []ipBanStatus{}}
+	g.mux.Lock()
+	for ip, r := range g.ips {
+		r.failures = g.expired(r.failures, now)
+		st := ipBanStatus{IP: ip, Failures: len(r.failures), Bans: r.bans}
+		if now < r.until {
+			st.Until = r.until
+		}
+		resp.IPs = append(resp.IPs, st)
+	}
+	g.mux.Unlock()
+	sort.Slice(resp.IPs, func(i, j int) bool { return resp.IPs[i].IP < resp.IPs[j].IP })
+	return resp
+}
+
+// run forgets stale IPs each window until done
+func (g *ipGuard) run(done <-chan struct{}) {
+	t := time.NewTicker(g.conf.Window)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			g.cleanup(now.UnixNano())
+		}
+	}
+}
+
+// ipBans returns failed logins and bans of IPs, path /admin/ipbans[/:ip] (admin token required):
+// GET returns tracked IPs, DELETE removes ban of IP
+func (s *Server) ipBans(w http.ResponseWriter, req *http.Request) {
+	if !s.adminAuthorized(w, req) {
+		return
+	}
+	if s.ipGuard == nil {
+		w.WriteHeader(http.StatusNotFound)
+		if _, err := w.Write([]byte("404 Not Found")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	ip := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/admin/ipbans"), "/")
+	switch {
+	case ip == "" && req.Method == http.MethodGet:
+	case ip != "" && req.Method == http.MethodDelete:
+		if !s.ipGuard.unban(ip) {
+			w.WriteHeader(http.StatusNotFound)
+			if _, err := w.Write([]byte("404 Not Found")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		log.Printf("admin, raddr - %v, ip - %v unbanned", req.RemoteAddr, ip)
+	default:
+		if ip == "" {
+			w.Header().Set("Allow", http.MethodGet)
+		} else {
+			w.Header().Set("Allow", http.MethodDelete)
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		if _, err := w.Write([]byte("405 Method Not Allowed")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	// response
+	out, err := json.Marshal(s.ipGuard.snapshot(time.Now().UnixNano()))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
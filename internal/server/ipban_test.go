@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_ipGuard_failed(t *testing.T) {
+
+	g, err := newIPGuard(IPBanConfig{
+		MaxFailures: 3, Window: time.Second, BanTime: time.Second, MaxBanTime: time.Second * 3,
+		Allow: []string{"10.0.0.0/8", "192.168.1.7", "::1"},
+	})
+	if err != nil {
+		t.Fatalf("new ip guard err: %v", err)
+	}
+	sec := int64(time.Second)
+
+	testCases := []struct {
+		name string
+		ip   string
+		// failure times, expected ban end (not banned if zero)
+		failures []int64
+		until    int64
+	}{
+		// Positive
+		{name: "first ban", ip: "1.1.1.1", failures: []int64{1, 2, 3}, until: 3 + sec},
+		{name: "escalated ban", ip: "1.1.1.1", failures: []int64{3 * sec, 3*sec + 1, 3*sec + 2}, until: 5*sec + 2},
+		{name: "max ban", ip: "1.1.1.1", failures: []int64{6 * sec, 6*sec + 1, 6*sec + 2}, until: 9*sec + 2},
+		{name: "ban count reset", ip: "1.1.1.1", failures: []int64{20 * sec, 20*sec + 1, 20*sec + 2}, until: 21*sec + 2},
+		// Negative
+		{name: "failures out of window", ip: "2.2.2.2", failures: []int64{1, sec + 2, 2*sec + 3}},
+		{name: "allowlisted cidr", ip: "10.1.2.3", failures: []int64{1, 2, 3}},
+		{name: "allowlisted ip", ip: "192.168.1.7", failures: []int64{1, 2, 3}},
+		{name: "allowlisted ipv6", ip: "::1", failures: []int64{1, 2, 3}},
+	}
+
+	for _, tc := range testCases {
+
+		banned := false
+		for _, f := range tc.failures {
+			banned = g.failed(tc.ip, f)
+		}
+		last := tc.failures[len(tc.failures)-1]
+		if banned != (tc.until != 0) || g.allowed(tc.ip, last) != (tc.until == 0) {
+			t.Fatalf("%v: expected banned %v, got %v", tc.name, tc.until != 0, banned)
+		}
+		if tc.until != 0 && (g.allowed(tc.ip, tc.until-1) || !g.allowed(tc.ip, tc.until)) {
+			t.Fatalf("%v: expected ban until %v, got %+v", tc.name, tc.until, g.ips[tc.ip])
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// stale IPs forgotten
+	g.cleanup(30 * sec)
+	if len(g.ips) != 0 {
+		t.Fatalf("stale ips should be forgotten, got %v", len(g.ips))
+	}
+	if _, err := newIPGuard(IPBanConfig{Allow: []string{"gateway"}}); err == nil {
+		t.Fatalf("wrong allowlist should be rejected")
+	}
+}
+
+func Test_Server_ipBans(t *testing.T) {
+
+	s := New(Config{
+		Addr: "127.0.0.1:0", LoginDeadline: time.Second, MsgDeadline: time.Second,
+		IPBan: &IPBanConfig{MaxFailures: 2, Window: time.Minute, BanTime: time.Minute}, AdminToken: "secret",
+	}, testOutLog)
+	if err := s.Start(); err != nil {
+		t.Fatalf("server start err: %v", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	addr := s.ln.Addr().String()
+
+	// connections closed before login (health checks) are not failed logins
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial err: %v", err)
+		}
+		conn.Close()
+	}
+	time.Sleep(time.Millisecond * 50)
+	if testLoginClosed(t, addr, testIMEI) {
+		t.Fatalf("health checks should not ban ip")
+	}
+
+	// failed logins (Luhn failure), IP banned
+	wrongIMEI := append([]byte{}, testIMEI...)
+	wrongIMEI[14] = 9
+	for i := 0; i < 2; i++ {
+		if !testLoginClosed(t, addr, wrongIMEI) {
+			t.Fatalf("wrong imei login should be rejected")
+		}
+	}
+	// valid login of banned IP refused at accept
+	if !testLoginClosed(t, addr, testIMEI) {
+		t.Fatalf("banned ip should be refused")
+	}
+
+	rec := testAdminRequest(s, "GET", "/admin/ipbans", "secret", "")
+	resp := ipBansResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Refused != 1 || len(resp.IPs) != 1 ||
+		resp.IPs[0].IP != "127.0.0.1" || resp.IPs[0].Bans != 1 || resp.IPs[0].Until == 0 {
+		t.Fatalf("wrong ip bans response %s, %v", rec.Body.Bytes(), err)
+	}
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		// Positive
+		{name: "unban", method: "DELETE", path: "/admin/ipbans/127.0.0.1", code: http.StatusOK},
+		// Negative
+		{name: "unban unknown ip", method: "DELETE", path: "/admin/ipbans/127.0.0.1", code: http.StatusNotFound},
+		{name: "wrong method", method: "POST", path: "/admin/ipbans", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+
+		if rec := testAdminRequest(s, tc.method, tc.path, "secret", ""); rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v", tc.name, tc.code, rec.Code)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+	if testLoginClosed(t, addr, testIMEI) {
+		t.Fatalf("unbanned ip login should be accepted")
+	}
+
+	// IP bans disabled
+	if rec := testAdminRequest(New(Config{AdminToken: "secret"}, testOutLog), "GET", "/admin/ipbans", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected code %v without ip bans, got %v", http.StatusNotFound, rec.Code)
+	}
+}
@@ -1,6 +1,10 @@
 package server
 
-import "sync"
+import (
+	"io"
+	"log"
+	"sync"
+)
 
 type readingMessage struct {
 	Temp    float64
@@ -10,52 +14,68 @@ type readingMessage struct {
 	BattLev float64
 }
 
+// isValid validates Reading message fields
 func (m *readingMessage) isValid() bool {
-	return isRange(m.Temp, -300, 300, true) &&
-		isRange(m.Alt, -20_000, 20_000, true) &&
-		isRange(m.Lat, -90, 90, true) &&
-		isRange(m.Lon, -180, 180, true) &&
-		isRange(m.BattLev, 0, 100, false)
+	var v validation
+	return m.validate(&readingLimits, &v)
 }
 
-func isRange(v, min, max float64, minInclusive bool) bool {
-	if v > max {
-		return false
+// validate validates Reading message fields by limits, sets reason of each invalid field to v.
+// Fields already rejected by decoding (see decodeMessage) are not checked.
+func (m *readingMessage) validate(lim *[fieldsNum]fieldLimit, v *validation) bool {
+	if v[fieldTemp] == reasonNone {
+		v[fieldTemp] = lim[fieldTemp].check(m.Temp)
 	}
-	if minInclusive && v < min {
-		return false
-	} else if !minInclusive && v <= min {
-		return false
+	if v[fieldAlt] == reasonNone {
+		v[fieldAlt] = lim[fieldAlt].check(m.Alt)
 	}
-	return true
+	if v[fieldLat] == reasonNone {
+		v[fieldLat] = lim[fieldLat].check(m.Lat)
+	}
+	if v[fieldLon] == reasonNone {
+		v[fieldLon] = lim[fieldLon].check(m.Lon)
+	}
+	if v[fieldBattLev] == reasonNone {
+		v[fieldBattLev] = lim[fieldBattLev].check(m.BattLev)
+	}
+	return v.ok()
 }
 
-//
 type devReq chan devReqResp
 type devReqResp chan deviceReadingStatus
 
-//
 type devStorage struct {
 	// map[imei]value
 	mux     sync.Mutex
 	storage map[string]devReq
+	// connections of devices (closed by disconnect)
+	conns map[string]io.Closer
 }
 
 func newDevStorage() *devStorage {
 	ds := &devStorage{
 		storage: make(map[string]devReq),
+		conns:   make(map[string]io.Closer),
 	}
 	return ds
 }
 
 // setIfNot if IMEI does not exist in stor set IMEI to storage and return True or return False
 func (s *devStorage) setIfNot(imei string, dr devReq) bool {
+	return s.register(imei, dr, nil)
+}
+
+// register sets IMEI and connection of device if IMEI does not exist, returns false otherwise
+func (s *devStorage) register(imei string, dr devReq, conn io.Closer) bool {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	if _, ok := s.storage[imei]; ok {
 		return false
 	}
 	s.storage[imei] = dr
+	if conn != nil {
+		s.conns[imei] = conn
+	}
 	return true
 }
 
@@ -63,6 +83,27 @@ func (s *devStorage) delete(imei string) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	delete(s.storage, imei)
+	delete(s.conns, imei)
+}
+
+// disconnect closes connection of device, returns false if device not connected
+func (s *devStorage) disconnect(imei string) bool {
+	s.mux.Lock()
+	conn, ok := s.conns[imei]
+	s.mux.Unlock()
+	if !ok {
+		return false
+	}
+	if err := conn.Close(); err != nil {
+		log.Printf("device, imei - %v, disconnect err: %v", imei, err)
+	}
+	return true
+}
+
+func (s *devStorage) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.storage)
 }
 
 func (s *devStorage) ok(imei string) (devReq, bool) {
@@ -72,13 +113,35 @@ func (s *devStorage) ok(imei string) (devReq, bool) {
 	return dr, ok
 }
 
+// imeis returns IMEIs of connected devices
+func (s *devStorage) imeis() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	imeis := make([]string, 0, len(s.storage))
+	for imei := range s.storage {
+		imeis = append(imeis, imei)
+	}
+	return imeis
+}
+
 type deviceStatus struct {
 	IMEI   string `json:"imei"`
 	Status string `json:"status"`
+	// applied validation profile
+	Profile string `json:"profile,omitempty"`
+	// cluster node of device connection (clustering enabled)
+	Node string `json:"node,omitempty"`
+	// battery forecast (enough readings of device)
+	Battery *batteryForecast `json:"battery,omitempty"`
+	// stuck sensor fields and earliest stuck since time (unix nano, not stuck if zero)
+	SensorStuckFields []string `json:"sensor_stuck_fields,omitempty"`
+	SensorStuck       int64    `json:"sensor_stuck_since,omitempty"`
 }
 
 type deviceReadingStatus struct {
 	deviceStatus
 	Reading readingMessage `json:"reading,omitempty"`
-	Time    int64          `json:"time,omitempty"`
+	// raw reading of calibrated device
+	Raw  *readingMessage `json:"raw,omitempty"`
+	Time int64           `json:"time,omitempty"`
 }
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// movement tracking defaults
+const (
+	// min distance of movement (GPS jitter within it ignored), m
+	moveMinDistance = 10.0
+	// speed of moving device, speed of stationary device (hysteresis), m/s
+	moveStartSpeed = 1.0
+	moveStopSpeed  = 0.3
+	// max plausible speed, m/s (faster position change is jump)
+	moveMaxSpeed = 100.0
+	// consecutive consistent jumps accepted as new position (device relocated)
+	moveJumpConfirm = 3
+)
+
+// mean Earth radius, m
+const earthRadius = 6371008.8
+
+// movement states
+const (
+	moveMoving     = "moving"
+	moveStationary = "stationary"
+)
+
+// MovementConfig configs of GPS movement tracking of devices: speed and heading between
+// valid readings, moving or stationary state, jumps of position faster than max speed
+type MovementConfig struct {
+	// min distance of movement, m (GPS jitter within it ignored)
+	MinDistance float64
+	// speed of moving device, stationary below stop speed, m/s
+	StartSpeed float64
+	StopSpeed  float64
+	// max plausible speed, m/s
+	MaxSpeed float64
+	// reject readings of position jumps as invalid (quarantined)
+	RejectJumps bool
+	// append speed, heading, moving columns to output records
+	Columns bool
+}
+
+// withDefaults returns configs with defaults of unset values
+func (c MovementConfig) withDefaults() *MovementConfig {
+	if c.MinDistance <= 0 {
+		c.MinDistance = moveMinDistance
+	}
+	if c.StartSpeed <= 0 {
+		c.StartSpeed = moveStartSpeed
+	}
+	if c.StopSpeed <= 0 || c.StopSpeed > c.StartSpeed {
+		c.StopSpeed = math.Min(moveStopSpeed, c.StartSpeed)
+	}
+	if c.MaxSpeed <= 0 {
+		c.MaxSpeed = moveMaxSpeed
+	}
+	return &c
+}
+
+// distance returns great-circle distance between positions (haversine), m
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp, dl := p2-p1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// bearing returns initial bearing from first position to second, degrees clockwise from north [0, 360)
+func bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dl := (lon2 - lon1) * math.Pi / 180
+	y := math.Sin(dl) * math.Cos(p2)
+	x := math.Cos(p1)*math.Sin(p2) - math.Sin(p1)*math.Cos(p2)*math.Cos(dl)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// motion movement of device at reading: speed (m/s), heading (degrees), moving or stationary
+type motion struct {
+	speed   float64
+	heading float64
+	moving  bool
+}
+
+// devMovement movement tracking state of device (constant size)
+type devMovement struct {
+	positions int64
+	// last position and its time
+	lat, lon float64
+	last     int64
+	// anchor position and its time (last position moved over min distance from previous anchor)
+	anchorLat, anchorLon float64
+	anchor               int64
+	motion
+	// distance travelled, m
+	distance float64
+	// moving or stationary since time
+	since int64
+	// jumps of position, last jump time, consecutive consistent jumps and last jump position
+	jumps    int64
+	lastJump int64
+	pending  int
+	jumpLat  float64
+	jumpLon  float64
+}
+
+// update updates movement by position at time now, returns whether position is jump
+// (jump is not applied to movement until confirmed by consecutive consistent jumps)
+func (m *devMovement) update(conf *MovementConfig, now int64, lat, lon float64) bool {
+	if m.positions == 0 {
+		m.reset(now, lat, lon)
+		return false
+	}
+	if now < m.last {
+		// out of order position ignored
+		return false
+	}
+	if d := distance(m.lat, m.lon, lat, lon); d > conf.MinDistance && d > conf.MaxSpeed*float64(now-m.last)/1e9 {
+		m.jumps++
+		m.lastJump = now
+		if m.pending > 0 && distance(m.jumpLat, m.jumpLon, lat, lon) <= conf.MinDistance {
+			m.pending++
+		} else {
+			m.pending = 1
+		}
+		m.jumpLat, m.jumpLon = lat, lon
+		if m.pending >= moveJumpConfirm {
+			// device relocated, movement starts at new position
+			dist, jumps, lastJump := m.distance, m.jumps, m.lastJump
+			m.reset(now, lat, lon)
+			m.distance, m.jumps, m.lastJump = dist, jumps, lastJump
+		}
+		return true
+	}
+	m.pending = 0
+	m.lat, m.lon, m.last = lat, lon, now
+	m.positions++
+
+	// speed and heading by anchor position, GPS jitter within min distance ignored
+	d := distance(m.anchorLat, m.anchorLon, lat, lon)
+	if dt := float64(now-m.anchor) / 1e9; dt > 0 {
+		m.speed = d / dt
+	}
+	if d >= conf.MinDistance {
+		m.heading = bearing(m.anchorLat, m.anchorLon, lat, lon)
+		m.distance += d
+		m.anchorLat, m.anchorLon, m.anchor = lat, lon, now
+	}
+	switch {
+	case !m.moving && m.speed >= conf.StartSpeed:
+		m.moving, m.since = true, now
+	case m.moving && m.speed < conf.StopSpeed:
+		m.moving, m.since = false, now
+	}
+	return false
+}
+
+// reset starts movement at position at time now (stationary)
+func (m *devMovement) reset(now int64, lat, lon float64) {
+	*m = devMovement{positions: 1, lat: lat, lon: lon, last: now, anchorLat: lat, anchorLon: lon, anchor: now, since: now}
+}
+
+// move updates movement of device by valid Reading message of position time t, counts jumps, marks position of jump
+// invalid if jumps rejected, sets motion of message, returns whether message is valid
+func (p *pipeline) move(t int64, ds *devState, r *decodedReading) bool {
+	if p.movement == nil {
+		return true
+	}
+	ds.mux.Lock()
+	jump := ds.movement.update(p.movement, t, r.msg.Lat, r.msg.Lon)
+	r.motion = ds.movement.motion
+	ds.mux.Unlock()
+	if !jump {
+		return true
+	}
+	atomic.AddInt64(&p.stats.jumps, 1)
+	log.Printf("movement, imei - %v, position jump to %v, %v", ds.imei, r.msg.Lat, r.msg.Lon)
+	if !p.movement.RejectJumps {
+		return true
+	}
+	r.v[fieldLat], r.v[fieldLon] = reasonJump, reasonJump
+	return false
+}
+
+// v1Movement movement of device
+type v1Movement struct {
+	IMEI    string `json:"imei"`
+	Enabled bool   `json:"enabled"`
+	// moving or stationary since time (empty if no position)
+	State      string  `json:"state,omitempty"`
+	SinceNs    int64   `json:"since_ns,omitempty"`
+	SpeedMps   float64 `json:"speed_mps"`
+	HeadingDeg float64 `json:"heading_deg"`
+	DistanceM  float64 `json:"distance_m"`
+	// last position and its time
+	LatitudeDeg  float64 `json:"latitude_deg"`
+	LongitudeDeg float64 `json:"longitude_deg"`
+	PositionNs   int64   `json:"position_ns,omitempty"`
+	Positions    int64   `json:"positions"`
+	// position jumps, last jump time
+	Jumps      int64 `json:"jumps"`
+	LastJumpNs int64 `json:"last_jump_ns,omitempty"`
+}
+
+// deviceMovement returns movement of device
+func (s *Server) deviceMovement(imei string) *v1Movement {
+	dm := &v1Movement{IMEI: imei, Enabled: s.pipe.movement != nil}
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok || s.pipe.movement == nil {
+		return dm
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	m := &ds.movement
+	dm.Positions, dm.Jumps, dm.LastJumpNs = m.positions, m.jumps, m.lastJump
+	if m.positions == 0 {
+		return dm
+	}
+	dm.State = moveStationary
+	if m.moving {
+		dm.State = moveMoving
+	}
+	dm.SinceNs, dm.SpeedMps, dm.HeadingDeg, dm.DistanceM = m.since, m.speed, m.heading, m.distance
+	dm.LatitudeDeg, dm.LongitudeDeg, dm.PositionNs = m.lat, m.lon, m.last
+	return dm
+}
+
+// v1Movement returns movement of device
+func (s *Server) v1Movement(w http.ResponseWriter, req *http.Request, imei string) {
+	writeAPIResponse(w, s.deviceMovement(imei))
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// degrees of latitude per metre
+const testDegPerM = 180 / (math.Pi * earthRadius)
+
+func Test_distance(t *testing.T) {
+
+	testCases := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		dist, bearing          float64
+	}{
+		{name: "one degree north", lat1: 0, lon1: 0, lat2: 1, lon2: 0, dist: 111195, bearing: 0},
+		{name: "one degree east", lat1: 0, lon1: 0, lat2: 0, lon2: 1, dist: 111195, bearing: 90},
+		{name: "south", lat1: 10, lon1: 20, lat2: 9, lon2: 20, dist: 111195, bearing: 180},
+		{name: "west over antimeridian", lat1: 0, lon1: -179.5, lat2: 0, lon2: 179.5, dist: 111195, bearing: 270},
+		{name: "London to Paris", lat1: 51.5074, lon1: -0.1278, lat2: 48.8566, lon2: 2.3522, dist: 343556, bearing: 148.1},
+	}
+
+	for _, tc := range testCases {
+
+		if d := distance(tc.lat1, tc.lon1, tc.lat2, tc.lon2); math.Abs(d-tc.dist) > 0.001*tc.dist {
+			t.Fatalf("%v: expected distance %v, got %v", tc.name, tc.dist, d)
+		}
+		if b := bearing(tc.lat1, tc.lon1, tc.lat2, tc.lon2); math.Abs(b-tc.bearing) > 0.1 {
+			t.Fatalf("%v: expected bearing %v, got %v", tc.name, tc.bearing, b)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_devMovement_update(t *testing.T) {
+
+	conf := MovementConfig{}.withDefaults()
+	sec := int64(time.Second)
+
+	testCases := []struct {
+		name string
+		// positions each 10 seconds, metres north and east of origin
+		positions func(i int) (north, east float64)
+		n         int
+		// expected state, speed (m/s), heading (degrees), jumps
+		moving  bool
+		speed   float64
+		heading float64
+		jumps   int64
+	}{
+		// Positive
+		{name: "moving north", positions: func(i int) (float64, float64) { return 50 * float64(i), 0 }, n: 20,
+			moving: true, speed: 5, heading: 0},
+		{name: "moving east", positions: func(i int) (float64, float64) { return 0, 20 * float64(i) }, n: 20,
+			moving: true, speed: 2, heading: 90},
+		{name: "stopped", positions: func(i int) (float64, float64) {
+			if i < 10 {
+				return 50 * float64(i), 0
+			}
+			return 450 + float64(i%2), 0
+		}, n: 60, moving: false, heading: 0},
+		{name: "GPS jitter", positions: func(i int) (float64, float64) { return 4 * math.Sin(float64(i)), 4 * math.Cos(float64(i)) }, n: 60},
+		{name: "single jump", positions: func(i int) (float64, float64) {
+			if i == 10 {
+				return 5000, 0
+			}
+			return 0, 0
+		}, n: 20, jumps: 1},
+		// Negative
+		{name: "slow walk below start speed", positions: func(i int) (float64, float64) { return 5 * float64(i), 0 }, n: 20},
+		{name: "fast but plausible", positions: func(i int) (float64, float64) { return 900 * float64(i), 0 }, n: 5,
+			moving: true, speed: 90, heading: 0},
+	}
+
+	for _, tc := range testCases {
+
+		m := &devMovement{}
+		for i := 0; i < tc.n; i++ {
+			north, east := tc.positions(i)
+			m.update(conf, int64(i)*10*sec, north*testDegPerM, east*testDegPerM)
+		}
+		if m.moving != tc.moving || m.jumps != tc.jumps {
+			t.Fatalf("%v: expected moving %v, jumps %v, got %+v", tc.name, tc.moving, tc.jumps, m)
+		}
+		if tc.speed != 0 && (math.Abs(m.speed-tc.speed) > 0.05*tc.speed || math.Abs(m.heading-tc.heading) > 0.5) {
+			t.Fatalf("%v: expected speed %v, heading %v, got %+v", tc.name, tc.speed, tc.heading, m)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// relocated device accepted after consecutive consistent jumps
+	m := &devMovement{}
+	m.update(conf, 0, 0, 0)
+	for i := 1; i <= moveJumpConfirm; i++ {
+		if !m.update(conf, int64(i)*sec, 1, 1) {
+			t.Fatalf("position %v should be jump", i)
+		}
+	}
+	if m.update(conf, int64(moveJumpConfirm+1)*sec, 1, 1) || m.lat != 1 || m.lon != 1 || m.jumps != moveJumpConfirm {
+		t.Fatalf("relocated position should be accepted, got %+v", m)
+	}
+}
+
+func Test_pipeline_move(t *testing.T) {
+
+	var out, quar bytes.Buffer
+	s := New(Config{Movement: &MovementConfig{RejectJumps: true, Columns: true}, Quarantine: &quar}, log.New(&out, "", 0))
+	ds := s.pipe.devs.get("490154203237518")
+	now := time.Now().UnixNano()
+	// moving north 5 m/s, jump at reading 5
+	for i := 0; i < 10; i++ {
+		rm := readingMessage{Temp: 20, Lat: 50 * float64(i) * testDegPerM, BattLev: 50}
+		if i == 5 {
+			rm.Lat = 10
+		}
+		s.pipe.reading(now+int64(i)*int64(10*time.Second), ds, testFrame(rm), &decodedReading{})
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 9 || !strings.HasSuffix(lines[8], ",5.000000,0.000000,true") {
+		t.Fatalf("expected 9 output records with movement columns, got:\n%v", out.String())
+	}
+	if !strings.Contains(quar.String(), "Lat: position jump;Lon: position jump") {
+		t.Fatalf("jump should be quarantined, got %q", quar.String())
+	}
+	if sr := s.pipe.stats.snapshot(now); sr.Jumps != 1 || sr.Invalid != 1 {
+		t.Fatalf("wrong jump stats %v, invalid %v", sr.Jumps, sr.Invalid)
+	}
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/movement", nil))
+	dm := v1Movement{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dm); err != nil || !dm.Enabled || dm.State != moveMoving ||
+		math.Abs(dm.SpeedMps-5) > 0.1 || math.Abs(dm.DistanceM-450) > 1 || dm.Positions != 9 || dm.Jumps != 1 || dm.LastJumpNs != now+5*int64(10*time.Second) {
+		t.Fatalf("wrong device movement %s, %v", rec.Body.Bytes(), err)
+	}
+
+	// positions of device time, readings received in burst
+	ds = s.pipe.devs.get("490154203237526")
+	for i := 0; i < 10; i++ {
+		rm := readingMessage{Temp: 20, Lat: 50 * float64(i) * testDegPerM, BattLev: 50}
+		s.pipe.readingAt(now, now-int64(10-i)*int64(10*time.Second), ds, testFrame(rm), &decodedReading{})
+	}
+	ds.mux.Lock()
+	m := ds.movement
+	ds.mux.Unlock()
+	if m.jumps != 0 || m.positions != 10 || math.Abs(m.speed-5) > 0.1 {
+		t.Fatalf("movement should be tracked by device time, got %+v", m)
+	}
+
+	// tracking disabled
+	s = New(Config{}, testOutLog)
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/movement", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &dm); err != nil || dm.Enabled {
+		t.Fatalf("movement tracking should be disabled, got %s, %v", rec.Body.Bytes(), err)
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// OpenAPI version, title of API document
+const (
+	openAPIVersion = "3.0.3"
+	openAPITitle   = "Device server API"
+)
+
+// httpRoute route of HTTP server mux, route responds JSON errors
+type httpRoute struct {
+	pattern    string
+	handler    http.HandlerFunc
+	jsonErrors bool
+}
+
+// httpRoutes routes of HTTP server mux, API v1 dispatched by apiRoutes, legacy routes by routeDocs
+func (s *Server) httpRoutes() []httpRoute {
+	routes := []httpRoute{
+		{pattern: "/stats", handler: s.stats},
+		{pattern: "/readings/", handler: s.readings},
+		{pattern: "/status/", handler: s.status},
+		{pattern: "/ingest", handler: s.ingest},
+		{pattern: "/devices/", handler: s.devices},
+		{pattern: "/admin/calibration/", handler: s.calibration},
+		{pattern: "/admin/devices/", handler: s.adminDevices},
+		{pattern: "/admin/ipbans", handler: s.ipBans},
+		{pattern: "/admin/ipbans/", handler: s.ipBans},
+		{pattern: "/export", handler: s.export},
+		{pattern: apiV1Prefix, handler: s.apiV1},
+		{pattern: "/cluster/gossip", handler: s.clusterGossip},
+		{pattern: "/openapi.json", handler: s.openAPI},
+		{pattern: "/geo/devices", handler: s.geoDevices, jsonErrors: true},
+		{pattern: "/geo/devices/", handler: s.geoTrack, jsonErrors: true},
+	}
+	for i := range routes {
+		if routes[i].pattern != apiV1Prefix {
+			routes[i].handler = legacyRoute(routes[i].handler, routes[i].jsonErrors)
+		}
+	}
+	return routes
+}
+
+// legacyRoute passes request of route documented by routeDocs to handler,
+// responds 404 if path is not documented, 405 if method is not documented
+func legacyRoute(handler http.HandlerFunc, jsonErrors bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r, _, allow := lookupRoute(routeDocs, req.Method, req.URL.Path)
+		if r == nil && len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			if jsonErrors {
+				writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method "+req.Method+" not allowed")
+				return
+			}
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			if _, err := w.Write([]byte("405 Method Not Allowed")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		if r == nil && jsonErrors {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "route not found")
+			return
+		}
+		if r == nil {
+			w.WriteHeader(http.StatusNotFound)
+			if _, err := w.Write([]byte("404 Not Found")); err != nil {
+				log.Printf("http server: write err: %v", err)
+			}
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// imei query parameter, time range query parameters, bounding box query parameter
+var (
+	imeiParam = apiParam{name: "imei", desc: "device IMEIs (comma-separated or repeated)"}
+	fromParam = apiParam{name: "from", desc: "start of time range, unix nanoseconds (unbounded if not set)"}
+	toParam   = apiParam{name: "to", desc: "end of time range, unix nanoseconds (unbounded if not set)"}
+	bboxParam = apiParam{name: "bbox", desc: "bounding box: minLon,minLat,maxLon,maxLat (not filtered if not set)"}
+)
+
+// routeDocs routes of legacy API, admin and cluster endpoints (requests of other paths and methods
+// are not passed to handlers of httpRoutes)
+var routeDocs = []apiRoute{
+	{method: http.MethodGet, pattern: "/stats", scope: scopeStatus, summary: "Server statistics", resp: statsResponse{}},
+	{method: http.MethodGet, pattern: "/readings/{imei}", scope: scopeReadings, summary: "Last valid reading of device (last retained reading if offline)", resp: deviceReadingStatus{}},
+	{method: http.MethodGet, pattern: "/status/{imei}", scope: scopeStatus, summary: "Device connection status", resp: deviceStatus{}},
+	{
+		method: http.MethodPost, pattern: "/ingest", scope: scopeIngest,
+		summary: "Batch upload of readings with original device time (JSON or application/octet-stream frames)",
+		req:     ingestRequest{}, resp: ingestResponse{},
+	},
+	{method: http.MethodGet, pattern: "/devices/{imei}/validation", scope: scopeReadings, summary: "Validation statistics of device", resp: deviceValidation{}},
+	{method: http.MethodGet, pattern: "/devices/{imei}/clock", scope: scopeReadings, summary: "Clock skew and jitter of device", resp: deviceClock{}},
+	{
+		method: http.MethodGet, pattern: "/devices/{imei}/rollups", scope: scopeReadings, summary: "Rollups (min, max, avg) of device readings",
+		query: []apiParam{{name: "res", desc: "rollup resolution: 1m (default), 1h, 1d"}, fromParam, toParam},
+		resp:  []rollup{},
+	},
+	{
+		method: http.MethodGet, pattern: "/export", scope: scopeReadings, summary: "Export of readings history",
+		query: []apiParam{imeiParam, fromParam, toParam,
+			{name: "format", desc: "csv (default), ndjson"}, {name: "fields", desc: "fields of records (comma-separated)"},
+			{name: "raw", desc: "raw readings of calibrated devices (true, false by default)"}},
+		media: "text/csv",
+	},
+	{
+		method: http.MethodGet, pattern: "/geo/devices", scope: scopeReadings, summary: "GeoJSON positions of devices (last valid reading)",
+		query: []apiParam{bboxParam}, resp: geoDevices{}, media: "application/geo+json", jsonErrors: true,
+	},
+	{
+		method: http.MethodGet, pattern: "/geo/devices/{imei}/track", scope: scopeReadings, summary: "GeoJSON track of device from readings history",
+		query: []apiParam{fromParam, toParam, bboxParam,
+			{name: "tolerance", desc: "simplification tolerance, m (simplified to max_points if not set)"},
+			{name: "max_points", desc: "max points of track simplified without tolerance (1000 by default)"}},
+		resp: geoTrack{}, media: "application/geo+json", jsonErrors: true,
+	},
+	{method: http.MethodGet, pattern: "/admin/calibration/{imei}", scope: scopeAdmin, summary: "Calibration entries and history of device", resp: deviceCalibration{}},
+	{method: http.MethodPost, pattern: "/admin/calibration/{imei}", scope: scopeAdmin, summary: "Add calibration entry of device", req: calibrationEntry{}, resp: calibrationEntry{}},
+	{method: http.MethodDelete, pattern: "/admin/calibration/{imei}", scope: scopeAdmin, summary: "Delete all calibration entries of device", resp: deviceCalibration{}},
+	{method: http.MethodDelete, pattern: "/admin/calibration/{imei}/{id}", scope: scopeAdmin, summary: "Delete calibration entry of device", resp: deviceCalibration{}},
+	{method: http.MethodGet, pattern: "/admin/devices/{imei}", scope: scopeAdmin, summary: "Ban and mute of device", resp: deviceAdmin{}},
+	{method: http.MethodPost, pattern: "/admin/devices/{imei}/disconnect", scope: scopeAdmin, summary: "Disconnect device", resp: deviceAdmin{}},
+	{method: http.MethodPost, pattern: "/admin/devices/{imei}/ban", scope: scopeAdmin, summary: "Ban device", req: restrictionRequest{}, resp: deviceAdmin{}},
+	{method: http.MethodDelete, pattern: "/admin/devices/{imei}/ban", scope: scopeAdmin, summary: "Unban device", resp: deviceAdmin{}},
+	{method: http.MethodPost, pattern: "/admin/devices/{imei}/mute", scope: scopeAdmin, summary: "Mute output of device", req: restrictionRequest{}, resp: deviceAdmin{}},
+	{method: http.MethodDelete, pattern: "/admin/devices/{imei}/mute", scope: scopeAdmin, summary: "Unmute output of device", resp: deviceAdmin{}},
+	{method: http.MethodGet, pattern: "/admin/ipbans", scope: scopeAdmin, summary: "Failed logins and bans of remote IPs", resp: ipBansResponse{}},
+	{method: http.MethodDelete, pattern: "/admin/ipbans/{ip}", scope: scopeAdmin, summary: "Unban remote IP", resp: ipBansResponse{}},
+	{method: http.MethodPost, pattern: "/cluster/gossip", scope: scopeCluster, summary: "Gossip of cluster node (push-pull)", req: clusterGossip{}, resp: clusterGossip{}},
+	{method: http.MethodGet, pattern: "/openapi.json", summary: "OpenAPI document of API", resp: map[string]interface{}{}},
+}
+
+// openAPIDoc OpenAPI document
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+// openAPIInfo info of OpenAPI document
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// openAPIComponents schemas of types, security schemes
+type openAPIComponents struct {
+	Schemas         map[string]*jsonSchema     `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurity `json:"securitySchemes"`
+}
+
+// openAPISecurity security scheme
+type openAPISecurity struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// openAPIOperation operation of path, required API key scope (x-scope)
+type openAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	Scope       string                      `json:"x-scope,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+// openAPIParameter path or query parameter
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+// openAPIBody request body
+type openAPIBody struct {
+	Required bool                     `json:"required"`
+	Content  map[string]*openAPIMedia `json:"content"`
+}
+
+// openAPIResponse response of status
+type openAPIResponse struct {
+	Description string                   `json:"description"`
+	Content     map[string]*openAPIMedia `json:"content,omitempty"`
+}
+
+// openAPIMedia schema of media type
+type openAPIMedia struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+// jsonSchema schema of type (subset of OpenAPI schema)
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+}
+
+// schemaGen generates schemas of Go types, named structs are added to components
+type schemaGen struct {
+	schemas map[string]*jsonSchema
+}
+
+// schema returns schema of type (reference to component of named struct)
+func (g *schemaGen) schema(t reflect.Type) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if s.Ref != "" {
+			return s
+		}
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &jsonSchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &jsonSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &jsonSchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &jsonSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// registered before fields to stop recursion of self-referencing types
+			g.schemas[t.Name()] = &jsonSchema{}
+			*g.schemas[t.Name()] = *g.object(t)
+		}
+		return &jsonSchema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	// interface, any value
+	return &jsonSchema{}
+}
+
+// object returns object schema of struct, fields of embedded structs are inlined (as encoding/json does)
+func (g *schemaGen) object(t reflect.Type) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+	g.fields(t, s)
+	return s
+}
+
+// fields adds properties of struct fields to object schema
+func (g *schemaGen) fields(t reflect.Type, s *jsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, s)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+		omit := false
+		for _, o := range opts[1:] {
+			omit = omit || o == "omitempty"
+		}
+		if !omit && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// jsonContent returns JSON content of value type
+func (g *schemaGen) jsonContent(v interface{}) map[string]*openAPIMedia {
+	return map[string]*openAPIMedia{"application/json": {Schema: g.schema(reflect.TypeOf(v))}}
+}
+
+// operation returns operation of route
+func (g *schemaGen) operation(r *apiRoute, v1 bool) *openAPIOperation {
+	op := &openAPIOperation{Summary: r.summary, Scope: r.scope, Responses: make(map[string]*openAPIResponse)}
+	for _, seg := range strings.Split(r.pattern, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			op.Parameters = append(op.Parameters, openAPIParameter{
+				Name: strings.Trim(seg, "{}"), In: "path", Required: true, Schema: &jsonSchema{Type: "string"},
+			})
+		}
+	}
+	for _, q := range r.query {
+		op.Parameters = append(op.Parameters, openAPIParameter{
+			Name: q.name, In: "query", Description: q.desc, Schema: &jsonSchema{Type: "string"},
+		})
+	}
+	if r.req != nil {
+		op.RequestBody = &openAPIBody{Required: true, Content: g.jsonContent(r.req)}
+	}
+
+	ok := &openAPIResponse{Description: "OK"}
+	switch {
+	case r.media != "" && r.resp != nil:
+		ok.Content = map[string]*openAPIMedia{r.media: {Schema: g.schema(reflect.TypeOf(r.resp))}}
+	case r.media != "":
+		ok.Content = map[string]*openAPIMedia{r.media: {Schema: &jsonSchema{Type: "string"}}}
+	case r.resp != nil:
+		ok.Content = g.jsonContent(r.resp)
+	}
+	op.Responses["200"] = ok
+	errContent := g.jsonContent(apiError{})
+	op.Responses["401"] = &openAPIResponse{Description: "API key required or invalid", Content: errContent}
+	op.Responses["403"] = &openAPIResponse{Description: "API key scope or devices not allowed", Content: errContent}
+	if v1 || r.jsonErrors {
+		op.Responses["400"] = &openAPIResponse{Description: "Invalid IMEI or parameter", Content: errContent}
+		op.Responses["404"] = &openAPIResponse{Description: "Route not found", Content: errContent}
+		op.Responses["405"] = &openAPIResponse{Description: "Method not allowed", Content: errContent}
+		return op
+	}
+	// legacy routes respond plain-text errors
+	textContent := map[string]*openAPIMedia{"text/plain": {Schema: &jsonSchema{Type: "string"}}}
+	op.Responses["400"] = &openAPIResponse{Description: "Invalid request or parameter", Content: textContent}
+	op.Responses["404"] = &openAPIResponse{Description: "Route, device or entry not found, invalid IMEI", Content: textContent}
+	op.Responses["405"] = &openAPIResponse{Description: "Method not allowed", Content: textContent}
+	op.Responses["500"] = &openAPIResponse{Description: "Internal error, wrong IMEI length", Content: textContent}
+	if r.scope == scopeAdmin {
+		op.Responses["503"] = &openAPIResponse{Description: "Admin endpoints disabled", Content: textContent}
+	}
+	return op
+}
+
+// newOpenAPIDoc generates OpenAPI document of routes
+func newOpenAPIDoc() *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI: openAPIVersion,
+		Info:    openAPIInfo{Title: openAPITitle, Version: "v1"},
+		Paths:   make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			SecuritySchemes: map[string]openAPISecurity{
+				"apiKey": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"bearer": {Type: "http", Scheme: "bearer"},
+			},
+		},
+		Security: []map[string][]string{{"apiKey": {}}, {"bearer": {}}},
+	}
+	g := &schemaGen{schemas: make(map[string]*jsonSchema)}
+	add := func(routes []apiRoute, v1 bool) {
+		for i := range routes {
+			r := &routes[i]
+			if doc.Paths[r.pattern] == nil {
+				doc.Paths[r.pattern] = make(map[string]*openAPIOperation)
+			}
+			doc.Paths[r.pattern][strings.ToLower(r.method)] = g.operation(r, v1)
+		}
+	}
+	add(apiRoutes, true)
+	add(routeDocs, false)
+	doc.Components.Schemas = g.schemas
+	return doc
+}
+
+// openAPI returns OpenAPI document of API
+func (s *Server) openAPI(w http.ResponseWriter, req *http.Request) {
+	out, err := json.Marshal(newOpenAPIDoc())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
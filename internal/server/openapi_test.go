@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Server_openAPI(t *testing.T) {
+
+	s := New(Config{}, testOutLog)
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected json response, got %v %v", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	doc := openAPIDoc{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi document unmarshal err: %v", err)
+	}
+	if doc.OpenAPI != openAPIVersion || len(doc.Paths) == 0 {
+		t.Fatalf("wrong openapi document %v, %v paths", doc.OpenAPI, len(doc.Paths))
+	}
+
+	// registered routes described (subtree route by paths under it)
+	for _, r := range s.httpRoutes() {
+		found := false
+		for path := range doc.Paths {
+			if path == r.pattern || strings.HasSuffix(r.pattern, "/") && strings.HasPrefix(path, r.pattern) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("route %v is missing in openapi document", r.pattern)
+		}
+	}
+	for _, r := range append(append([]apiRoute{}, apiRoutes...), routeDocs...) {
+		if doc.Paths[r.pattern][strings.ToLower(r.method)] == nil {
+			t.Fatalf("route %v %v is missing in openapi document", r.method, r.pattern)
+		}
+	}
+
+	// handled methods of paths are methods of document, paths under documented paths are not handled
+	params := strings.NewReplacer("{imei}", "490154203237518", "{id}", "1", "{ip}", "127.0.0.1")
+	h := s.httpHandler()
+	for pattern, ops := range doc.Paths {
+		path := params.Replace(pattern)
+		for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader("{}")))
+			documented := ops[strings.ToLower(method)] != nil
+			if documented && rec.Code == http.StatusMethodNotAllowed || !documented && rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("%v %v: documented %v, got code %v", method, path, documented, rec.Code)
+			}
+		}
+		for method := range ops {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(strings.ToUpper(method), path+"/undocumented/path", nil))
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("%v %v/undocumented/path: expected code %v, got %v", method, path, http.StatusNotFound, rec.Code)
+			}
+		}
+	}
+
+	// legacy routes document plain-text errors
+	if op := doc.Paths["/readings/{imei}"]["get"]; op.Responses["404"] == nil || op.Responses["404"].Content["text/plain"] == nil ||
+		op.Responses["500"] == nil || op.Responses["500"].Content["text/plain"] == nil {
+		t.Fatalf("legacy route should document plain-text errors, got %+v", op.Responses)
+	}
+	if op := doc.Paths["/geo/devices"]["get"]; op.Responses["400"] == nil || op.Responses["400"].Content["application/json"] == nil {
+		t.Fatalf("geo route should document JSON errors, got %+v", op.Responses)
+	}
+
+	testCases := []struct {
+		name   string
+		schema string
+		// expected properties, required properties
+		props    []string
+		required []string
+	}{
+		{name: "device status", schema: "deviceStatus", props: []string{"imei", "status", "profile", "node"}, required: []string{"imei", "status"}},
+		{name: "embedded status inlined", schema: "deviceReadingStatus", props: []string{"imei", "status", "reading", "raw", "time"}, required: []string{"imei", "status"}},
+		{name: "v1 reading", schema: "v1DeviceReading", props: []string{"imei", "received_at_ns", "reading", "raw"}},
+		{name: "error", schema: "apiError", props: []string{"error", "message"}, required: []string{"error", "message"}},
+		{name: "request body", schema: "restrictionRequest", props: []string{"duration", "reason"}},
+	}
+
+	for _, tc := range testCases {
+
+		sch, ok := doc.Components.Schemas[tc.schema]
+		if !ok {
+			t.Fatalf("%v: schema %v not found", tc.name, tc.schema)
+		}
+		for _, p := range tc.props {
+			if sch.Properties[p] == nil {
+				t.Fatalf("%v: property %v not found", tc.name, p)
+			}
+		}
+		for _, p := range tc.required {
+			if !strings.Contains(","+strings.Join(sch.Required, ",")+",", ","+p+",") {
+				t.Fatalf("%v: property %v should be required, got %v", tc.name, p, sch.Required)
+			}
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/radisvaliullin/test_task_17/record"
+)
+
+// pipeline processes Reading messages of all ingestion paths (tcp, udp, http)
+type pipeline struct {
+	// std out logger for loggin Reading message
+	outLog *log.Logger
+	// output records format, records encoded to buffer and written under lock
+	format record.Format
+	outMux sync.Mutex
+	outBuf []byte
+
+	// optional float checks of decoding
+	checks floatChecks
+
+	// quarantine logger for loggin invalid Reading message (disabled if nil)
+	quarLog *log.Logger
+	// rollup logger for loggin closed rollup buckets (disabled if nil)
+	rollupLog *log.Logger
+	// anomaly detection of device readings (disabled if nil), anomaly events logger (disabled if nil)
+	anomaly    *AnomalyConfig
+	anomalyLog *log.Logger
+	// stuck sensor detection of devices (disabled if nil), stuck sensor events logger (disabled if nil)
+	stuck    *stuckDetector
+	stuckLog *log.Logger
+	// movement tracking of devices (disabled if nil)
+	movement *MovementConfig
+
+	// server statistics
+	stats *serverStats
+	// devices states
+	devs *devStates
+	// calibrations of devices
+	calibs *calibStore
+	// bans of devices
+	bans *banStore
+	// history size of device, readings (history disabled if zero), devices with history,
+	// history of device dropped if not updated within idle time (kept if zero)
+	historySize int
+	histDevs    *histDevices
+	historyIdle time.Duration
+	// webhook output of valid Reading messages (disabled if nil)
+	webhook *webhook
+	// relay of valid Reading messages to upstream (disabled if nil)
+	relay *relay
+
+	// time of output records, max device time ahead of receive time and
+	// behind receive time (checks disabled if zero), nanoseconds
+	outTime     TimeSource
+	tsMaxFuture int64
+	tsMaxAge    int64
+}
+
+// decodedReading Reading message of device decoded by pipeline
+type decodedReading struct {
+	// calibrated message (if device calibrated) and raw message as received
+	msg        readingMessage
+	raw        readingMessage
+	calibrated bool
+	// device time (zero if not supplied)
+	devTime int64
+
+	// validation result, invalid reason of device time
+	v          validation
+	timeReason invalidReason
+	// motion of device at message (movement tracking enabled)
+	motion motion
+}
+
+// inits new pipeline
+func newPipeline(olg *log.Logger, st *serverStats) *pipeline {
+	p := &pipeline{
+		outLog: olg,
+		stats:  st,
+		devs:   newDevStates(newProfileSet(nil)),
+		calibs: newCalibStore(""),
+		bans:   newBanStore(""),
+
+		histDevs: newHistDevices(0),
+	}
+	return p
+}
+
+// output writes valid Reading message record of output format to output,
+// with movement columns of motion (not written if nil)
+func (p *pipeline) output(now int64, imei string, rm *readingMessage, mv *motion) {
+	rec := newRecord(now, imei, rm)
+	if mv != nil {
+		rec.HasMovement, rec.Speed, rec.Heading, rec.Moving = true, mv.speed, mv.heading, mv.moving
+	}
+	p.outMux.Lock()
+	p.outBuf = record.Append(p.outBuf[:0], p.format, &rec)
+	if _, err := p.outLog.Writer().Write(p.outBuf); err != nil {
+		log.Printf("output, imei - %v, write err: %v", imei, err)
+	}
+	p.outMux.Unlock()
+	if p.webhook != nil {
+		p.webhook.add(now, imei, rm)
+	}
+	atomic.AddInt64(&p.stats.readings, 1)
+}
+
+// newRecord output record of Reading message of device received at time t
+func newRecord(t int64, imei string, rm *readingMessage) record.Record {
+	return record.Record{Time: t, IMEI: imei, Temp: rm.Temp, Alt: rm.Alt, Lat: rm.Lat, Lon: rm.Lon, BattLev: rm.BattLev}
+}
+
+// reading decodes Reading message frame of device, calibrates and validates it,
+// logs valid message to output, counts invalid message and logs it to quarantine
+func (p *pipeline) reading(now int64, ds *devState, frame []byte, r *decodedReading) bool {
+	return p.readingAt(now, 0, ds, frame, r)
+}
+
+// readingAt processes Reading message frame of device with device time (zero if not supplied),
+// message with implausible device time is invalid, output record has time of output time source
+func (p *pipeline) readingAt(now, devTime int64, ds *devState, frame []byte, r *decodedReading) bool {
+	decodeMessage(frame, &r.raw, p.checks, &r.v)
+	r.msg = r.raw
+	r.calibrated = p.calibs.apply(ds.imei, now, &r.msg)
+	r.devTime = devTime
+	r.timeReason = reasonNone
+	if devTime != 0 {
+		r.timeReason = p.checkTime(now, devTime)
+	}
+	ok := r.msg.validate(&ds.profile.limits, &r.v) && r.timeReason == reasonNone
+	if ok {
+		// position time is device time if supplied (readings received in burst, ingested backlog)
+		t := now
+		if devTime != 0 {
+			t = devTime
+		}
+		ok = p.move(t, ds, r)
+	}
+	ds.validated(&r.v, r.timeReason, now, devTime)
+	if ok {
+		t := now
+		if p.outTime == TimeDevice && devTime != 0 {
+			t = devTime
+		}
+		suppressed := p.checkStuck(now, ds, &r.msg)
+		if !ds.muted(now) && !suppressed {
+			var mv *motion
+			if p.movement != nil && p.movement.Columns {
+				mv = &r.motion
+			}
+			p.output(t, ds.imei, &r.msg, mv)
+			// upstream calibrates raw message, relayed with original receive time
+			if p.relay != nil {
+				p.relay.add(now, ds.imei, &r.raw)
+			}
+		}
+		var raw *readingMessage
+		if r.calibrated {
+			raw = &r.raw
+		}
+		p.retain(now, ds, &r.msg, raw)
+		p.detectAnomalies(now, ds, &r.msg)
+		return true
+	}
+	atomic.AddInt64(&p.stats.invalid, 1)
+	if p.quarLog != nil {
+		p.quarLog.Printf("%v,%s,%x,%v", now, ds.imei, frame, r.reasons())
+	}
+	return false
+}
+
+// reasons invalid fields and reasons of Reading message, e.g. "Temp: above max;Time: below min"
+func (r *decodedReading) reasons() string {
+	s := r.v.String()
+	if r.timeReason == reasonNone {
+		return s
+	}
+	if s != "" {
+		s += ";"
+	}
+	return s + "Time: " + r.timeReason.String()
+}
+
+// status last reading status of valid Reading message (raw message set if calibrated)
+func (r *decodedReading) status(now int64) deviceReadingStatus {
+	drs := deviceReadingStatus{Reading: r.msg, Time: now}
+	if r.calibrated {
+		raw := r.raw
+		drs.Raw = &raw
+	}
+	return drs
+}
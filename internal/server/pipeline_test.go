@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/radisvaliullin/test_task_17/record"
+)
+
+func Test_pipeline_output(t *testing.T) {
+
+	rm := readingMessage{Temp: 67.77, BattLev: 0.25}
+	testCases := []struct {
+		format record.Format
+		out    string
+	}{
+		{format: record.CSV, out: "1257894000000000000,490154203237518,67.770000,0.000000,0.000000,0.000000,0.250000\n"},
+		{format: record.NDJSON, out: `{"time":1257894000000000000,"imei":"490154203237518","Temp":67.77,"Alt":0,"Lat":0,"Lon":0,"BattLev":0.25}` + "\n"},
+		{format: record.Influx, out: "reading,imei=490154203237518 Temp=67.77,Alt=0,Lat=0,Lon=0,BattLev=0.25 1257894000000000000\n"},
+		{format: record.Binary, out: string(record.AppendBinary(nil, &record.Record{Time: 1257894000000000000, IMEI: "490154203237518", Temp: 67.77, BattLev: 0.25}))},
+	}
+
+	for _, tc := range testCases {
+
+		var out bytes.Buffer
+		p := newPipeline(log.New(&out, "", 0), newServerStats())
+		p.format = tc.format
+		p.output(1257894000000000000, "490154203237518", &rm, nil)
+		if out.String() != tc.out {
+			t.Fatalf("%v: expected output %q, got %q", tc.format, tc.out, out.String())
+		}
+
+		// output record encoding should not allocate
+		allocs := testing.AllocsPerRun(100, func() {
+			out.Reset()
+			p.output(1257894000000000000, "490154203237518", &rm, nil)
+		})
+		if allocs != 0 {
+			t.Fatalf("%v: output should not allocate, got %v allocs", tc.format, allocs)
+		}
+		mv := motion{speed: 1.5, heading: 90, moving: true}
+		allocs = testing.AllocsPerRun(100, func() {
+			out.Reset()
+			p.output(1257894000000000000, "490154203237518", &rm, &mv)
+		})
+		if allocs != 0 {
+			t.Fatalf("%v: output with movement should not allocate, got %v allocs", tc.format, allocs)
+		}
+		t.Logf("%v: test ok", tc.format)
+	}
+}
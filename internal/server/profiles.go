@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+const (
+	// name of default validation profile (limits by spec)
+	defaultProfileName = "default"
+)
+
+// FieldRange range of valid Reading message field values, bounds are inclusive if not set
+type FieldRange struct {
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	MinInclusive *bool   `json:"min_inclusive,omitempty"`
+	MaxInclusive *bool   `json:"max_inclusive,omitempty"`
+}
+
+// inclusive returns whether bound is inclusive (inclusive if not set)
+func inclusive(b *bool) bool {
+	return b == nil || *b
+}
+
+// Profile validation profile of device model, ranges of Reading message fields
+// (limits by spec if field range not set)
+type Profile struct {
+	Temp    *FieldRange `json:"temp,omitempty"`
+	Alt     *FieldRange `json:"alt,omitempty"`
+	Lat     *FieldRange `json:"lat,omitempty"`
+	Lon     *FieldRange `json:"lon,omitempty"`
+	BattLev *FieldRange `json:"batt_lev,omitempty"`
+}
+
+// Profiles validation profiles by name and assignment of devices to profiles.
+// Device profile is looked up by IMEI, then by device model of registry,
+// then by longest IMEI prefix (TAC), else Default profile (limits by spec if not set) is applied.
+type Profiles struct {
+	Profiles map[string]Profile `json:"profiles"`
+	Default  string             `json:"default,omitempty"`
+
+	// profile name by IMEI
+	IMEI map[string]string `json:"imei,omitempty"`
+	// profile name by IMEI prefix (TAC)
+	TAC map[string]string `json:"tac,omitempty"`
+	// registry of devices, model by IMEI, and profile name by model
+	Registry map[string]string `json:"registry,omitempty"`
+	Models   map[string]string `json:"models,omitempty"`
+}
+
+// LoadProfiles loads validation profiles from JSON file
+func LoadProfiles(path string) (*Profiles, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ps := &Profiles{}
+	if err := json.Unmarshal(b, ps); err != nil {
+		return nil, err
+	}
+	if err := ps.Validate(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Validate checks profiles ranges and assignments
+func (ps *Profiles) Validate() error {
+	for name, p := range ps.Profiles {
+		if name == "" {
+			return fmt.Errorf("profile name is empty")
+		}
+		for f, fr := range p.ranges() {
+			if fr != nil && !(fr.Min <= fr.Max) {
+				return fmt.Errorf("profile %v, field %v, min %v greater than max %v", name, fieldNames[f], fr.Min, fr.Max)
+			}
+		}
+	}
+	exists := func(name string) bool {
+		_, ok := ps.Profiles[name]
+		return ok || name == defaultProfileName
+	}
+	if ps.Default != "" && !exists(ps.Default) {
+		return fmt.Errorf("default profile %v not found", ps.Default)
+	}
+	for _, assign := range []map[string]string{ps.IMEI, ps.TAC, ps.Models} {
+		for k, name := range assign {
+			if !exists(name) {
+				return fmt.Errorf("profile %v of %v not found", name, k)
+			}
+		}
+	}
+	for imei, model := range ps.Registry {
+		if _, ok := ps.Models[model]; !ok {
+			return fmt.Errorf("model %v of device %v has no profile", model, imei)
+		}
+	}
+	return nil
+}
+
+// ranges field ranges of profile by Reading message field
+func (p *Profile) ranges() [fieldsNum]*FieldRange {
+	return [fieldsNum]*FieldRange{p.Temp, p.Alt, p.Lat, p.Lon, p.BattLev}
+}
+
+// profile compiled validation profile
+type profile struct {
+	name   string
+	limits [fieldsNum]fieldLimit
+}
+
+// default profile, limits by spec
+var defaultProfile = &profile{name: defaultProfileName, limits: readingLimits}
+
+// profileSet compiled validation profiles and assignments
+type profileSet struct {
+	profiles map[string]*profile
+	def      *profile
+
+	imei     map[string]*profile
+	tac      map[string]*profile
+	registry map[string]*profile
+	// max TAC length
+	tacLen int
+}
+
+// inits profile set of config (profiles should be valid), nil config - only default profile
+func newProfileSet(conf *Profiles) *profileSet {
+	ps := &profileSet{
+		profiles: map[string]*profile{defaultProfileName: defaultProfile},
+		def:      defaultProfile,
+		imei:     make(map[string]*profile),
+		tac:      make(map[string]*profile),
+		registry: make(map[string]*profile),
+	}
+	if conf == nil {
+		return ps
+	}
+
+	for name, p := range conf.Profiles {
+		cp := &profile{name: name, limits: readingLimits}
+		for f, fr := range p.ranges() {
+			if fr != nil {
+				cp.limits[f] = fieldLimit{min: fr.Min, max: fr.Max, minInclusive: inclusive(fr.MinInclusive), maxInclusive: inclusive(fr.MaxInclusive)}
+			}
+		}
+		ps.profiles[name] = cp
+	}
+	// profile by name, default if not found
+	byName := func(name string) *profile {
+		p, ok := ps.profiles[name]
+		if !ok {
+			log.Printf("validation profile %v not found, default profile used", name)
+			return defaultProfile
+		}
+		return p
+	}
+	if conf.Default != "" {
+		ps.def = byName(conf.Default)
+	}
+	for imei, name := range conf.IMEI {
+		ps.imei[imei] = byName(name)
+	}
+	for tac, name := range conf.TAC {
+		ps.tac[tac] = byName(name)
+		if len(tac) > ps.tacLen {
+			ps.tacLen = len(tac)
+		}
+	}
+	for imei, model := range conf.Registry {
+		ps.registry[imei] = byName(conf.Models[model])
+	}
+	return ps
+}
+
+// lookup returns validation profile of device
+func (ps *profileSet) lookup(imei string) *profile {
+	if p, ok := ps.imei[imei]; ok {
+		return p
+	}
+	if p, ok := ps.registry[imei]; ok {
+		return p
+	}
+	// longest prefix
+	for l := ps.tacLen; l > 0; l-- {
+		if l > len(imei) {
+			continue
+		}
+		if p, ok := ps.tac[imei[:l]]; ok {
+			return p
+		}
+	}
+	return ps.def
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testProfiles = `{
+	"profiles": {
+		"greenhouse": {"temp": {"min": -40, "max": 80, "min_inclusive": true, "max_inclusive": false}},
+		"field": {"temp": {"min": -60, "max": 60, "min_inclusive": true, "max_inclusive": true}, "alt": {"min": -500, "max": 9000}}
+	},
+	"imei": {"490154203237518": "greenhouse"},
+	"tac": {"4901": "default", "49015420": "field"},
+	"registry": {"490154200000010": "GH-200"},
+	"models": {"GH-200": "greenhouse"}
+}`
+
+func Test_LoadProfiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name     string
+		profiles string
+		isValid  bool
+	}{
+		// Positive
+		{name: "valid profiles", profiles: testProfiles, isValid: true},
+		// Negative
+		{name: "min greater than max", profiles: `{"profiles": {"p": {"temp": {"min": 1, "max": 0}}}}`, isValid: false},
+		{name: "unknown profile of imei", profiles: `{"imei": {"490154203237518": "p"}}`, isValid: false},
+		{name: "unknown model of registry", profiles: `{"registry": {"490154203237518": "m"}}`, isValid: false},
+		{name: "not json", profiles: `profiles`, isValid: false},
+	}
+
+	for i, tc := range testCases {
+
+		path := filepath.Join(dir, string(rune('a'+i))+".json")
+		if err := ioutil.WriteFile(path, []byte(tc.profiles), 0644); err != nil {
+			t.Fatalf("%v: write profiles err: %v", tc.name, err)
+		}
+		_, err := LoadProfiles(path)
+		if tc.isValid && err != nil {
+			t.Fatalf("%v: load profiles err: %v", tc.name, err)
+		} else if !tc.isValid && err == nil {
+			t.Fatalf("%v: negative test case should return err", tc.name)
+		}
+		t.Logf("%v: test ok, err: %v", tc.name, err)
+	}
+}
+
+func Test_profileSet_lookup(t *testing.T) {
+
+	conf := &Profiles{}
+	if err := json.Unmarshal([]byte(testProfiles), conf); err != nil {
+		t.Fatalf("profiles unmarshal err: %v", err)
+	}
+	ps := newProfileSet(conf)
+
+	testCases := []struct {
+		name    string
+		imei    string
+		profile string
+	}{
+		{name: "by imei", imei: "490154203237518", profile: "greenhouse"},
+		{name: "by registry", imei: "490154200000010", profile: "greenhouse"},
+		{name: "by longest tac", imei: "490154200000028", profile: "field"},
+		{name: "by short tac", imei: "490100000000007", profile: "default"},
+		{name: "default", imei: "356938035643809", profile: "default"},
+	}
+
+	for _, tc := range testCases {
+
+		if p := ps.lookup(tc.imei); p.name != tc.profile {
+			t.Fatalf("%v: expected profile %v, got %v", tc.name, tc.profile, p.name)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// limits of profile
+	field := ps.profiles["field"]
+	if field.limits[fieldTemp].max != 60 || field.limits[fieldLat] != readingLimits[fieldLat] {
+		t.Fatalf("wrong limits of profile %+v", field)
+	}
+	// bounds inclusive if not set
+	if alt := field.limits[fieldAlt]; !alt.minInclusive || !alt.maxInclusive {
+		t.Fatalf("bounds of range should be inclusive by default, got %+v", alt)
+	}
+}
+
+func Test_Server_Profiles(t *testing.T) {
+
+	conf := &Profiles{}
+	if err := json.Unmarshal([]byte(testProfiles), conf); err != nil {
+		t.Fatalf("profiles unmarshal err: %v", err)
+	}
+	s := New(Config{Profiles: conf}, testOutLog)
+
+	// greenhouse profile, max temp 80 (exclusive)
+	ds := s.pipe.devs.get("490154203237518")
+	if !s.pipe.reading(1, ds, testFrame(readingMessage{Temp: 79.9, BattLev: 1}), &decodedReading{}) {
+		t.Fatalf("message should be valid by greenhouse profile")
+	}
+	r := decodedReading{}
+	if s.pipe.reading(1, ds, testFrame(readingMessage{Temp: 80, BattLev: 1}), &r) {
+		t.Fatalf("message should be invalid by greenhouse profile")
+	}
+	if r.v.String() != "Temp: above max" {
+		t.Fatalf("wrong invalid reason %q", r.v.String())
+	}
+
+	// status reports profile
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status/490154203237518", nil))
+	sts := deviceStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &sts); err != nil {
+		t.Fatalf("status response unmarshal err: %v", err)
+	}
+	if sts.Profile != "greenhouse" {
+		t.Fatalf("status should report greenhouse profile, got %+v", sts)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import "time"
+
+// RatePolicy action on Reading messages exceeding device rate limit
+type RatePolicy string
+
+// Rate limit policies
+const (
+	// drop Reading messages over the limit
+	RateDrop RatePolicy = "drop"
+	// disconnect device exceeded the limit
+	RateDisconnect RatePolicy = "disconnect"
+)
+
+// tokenBucket rate limiter of device Reading messages (not safe for concurrent use)
+type tokenBucket struct {
+	// tokens per nanosecond
+	rate float64
+	// max tokens
+	burst float64
+
+	tokens float64
+	// last update time (unix nano)
+	last int64
+}
+
+// inits new token bucket, rate - tokens per second, full at start
+func newTokenBucket(rate float64, burst int, now int64) tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	tb := tokenBucket{
+		rate:   rate / float64(time.Second),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+	return tb
+}
+
+// allow takes token if available
+func (b *tokenBucket) allow(now int64) bool {
+	if now > b.last {
+		b.tokens += float64(now-b.last) * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
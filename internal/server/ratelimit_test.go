@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_tokenBucket(t *testing.T) {
+
+	// 40 messages per second, burst 2
+	now := int64(0)
+	tb := newTokenBucket(40, 2, now)
+
+	// burst
+	if !tb.allow(now) || !tb.allow(now) {
+		t.Fatalf("burst messages should be allowed")
+	}
+	if tb.allow(now) {
+		t.Fatalf("message over burst should not be allowed")
+	}
+
+	// one token per 25ms
+	now += int64(time.Millisecond * 24)
+	if tb.allow(now) {
+		t.Fatalf("message before refill should not be allowed")
+	}
+	now += int64(time.Millisecond)
+	if !tb.allow(now) {
+		t.Fatalf("message after refill should be allowed")
+	}
+
+	// refill limited by burst
+	now += int64(time.Second)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if tb.allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("expected %v allowed messages after idle, got %v", 2, allowed)
+	}
+}
+
+func Test_Device_RateLimit(t *testing.T) {
+
+	testCases := []struct {
+		name    string
+		policy  RatePolicy
+		err     error
+		dropped int64
+	}{
+		{
+			name:    "drop policy",
+			policy:  RateDrop,
+			err:     nil,
+			dropped: 8,
+		},
+		{
+			name:    "disconnect policy",
+			policy:  RateDisconnect,
+			err:     errRateLimit,
+			dropped: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		srvConn, clnConn := net.Pipe()
+		st := newServerStats()
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		conf := devConfig{
+			loginDeadline: time.Second, messageDeadline: time.Second,
+			rateLimit: 1, rateBurst: 2, ratePolicy: tc.policy,
+		}
+		d := newDevice(conf, srvConn, newPipeline(testOutLog, st), &wg, make(chan struct{}, 1), newDevStorage())
+		errs := make(chan error, 1)
+		go func() {
+			errs <- d.run()
+		}()
+
+		// send login and flood of messages
+		if _, err := clnConn.Write(testIMEI); err != nil {
+			t.Fatalf("%v: client conn write imei err: %v", tc.name, err)
+		}
+		msg := make([]byte, msgLength)
+		for i := 0; i < 10; i++ {
+			if _, err := clnConn.Write(msg); err != nil {
+				break
+			}
+		}
+		clnConn.Close()
+
+		err := <-errs
+		if tc.err != nil && err != tc.err {
+			t.Fatalf("%v: expected err %v, got %v", tc.name, tc.err, err)
+		}
+		sr := st.snapshot(time.Now().UnixNano())
+		f, ok := sr.Flooders["490154203237518"]
+		if !ok || f.Dropped != tc.dropped || sr.RateDropped != tc.dropped {
+			t.Fatalf("%v: expected flooder with %v dropped messages, got %+v", tc.name, tc.dropped, sr)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/radisvaliullin/test_task_17/record"
+)
+
+// relay defaults
+const (
+	relayBuffer     = 100000
+	relayBackoff    = time.Second
+	relayMaxBackoff = time.Minute
+	// heartbeat period of idle relay link, read deadline of relay link on upstream
+	relayHeartbeat    = time.Second * 20
+	relayLinkDeadline = relayHeartbeat * 3
+	// deadline of relay link handshake
+	relayHandshakeDeadline = time.Second * 5
+)
+
+// relay link protocol: relay logins with relayLogin instead of IMEI, upstream sends challenge
+// (relayChallengeLength random bytes), relay responds by HMAC-SHA256 of challenge by shared key,
+// upstream acks authenticated link by relayAck, then relay sends ingest frames (IMEI, original
+// receive time, raw Reading message) or heartbeat frames (first byte relayHeartbeatByte),
+// upstream acks each ingest frame by relayAck
+var relayLogin = [imeiLength]byte{0x7f, 'T', 'M', '-', 'R', 'E', 'L', 'A', 'Y', '/', '1'}
+
+const (
+	relayHeartbeatByte   = 0xff
+	relayAck             = 0x06
+	relayChallengeLength = 32
+)
+
+// RelayConfig configs of relay of valid readings to upstream server
+type RelayConfig struct {
+	// upstream server address (device protocol, relay links accepted),
+	// shared key of relay links authentication
+	Addr string
+	Key  string
+	// max buffered (not acked) readings, new readings dropped if buffer full
+	Buffer int
+	// exponential reconnect backoff (initial, max)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// relayStats statistics of relay (JSON)
+type relayStats struct {
+	Connected  bool  `json:"connected"`
+	Relayed    int64 `json:"relayed"`
+	Pending    int64 `json:"pending"`
+	Dropped    int64 `json:"dropped"`
+	Reconnects int64 `json:"reconnects"`
+}
+
+// relay forwards valid readings to upstream by relay link, buffers readings until acked
+type relay struct {
+	conf RelayConfig
+
+	// ring of ingest frames: head - oldest frame, n - frames, sent - frames sent and not acked
+	mux    sync.Mutex
+	frames []byte
+	head   int
+	n      int
+	sent   int
+	// signal of new frame
+	notify chan struct{}
+
+	// statistics (counters updated atomically)
+	connected  int32
+	relayed    int64
+	dropped    int64
+	reconnects int64
+}
+
+// inits relay
+func newRelay(conf RelayConfig) (*relay, error) {
+	if conf.Addr == "" || conf.Key == "" {
+		return nil, errors.New("relay: upstream address and key required")
+	}
+	if conf.Buffer <= 0 {
+		conf.Buffer = relayBuffer
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = relayBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = relayMaxBackoff
+	}
+	r := &relay{
+		conf:   conf,
+		frames: make([]byte, conf.Buffer*ingestFrameLength),
+		notify: make(chan struct{}, 1),
+	}
+	return r, nil
+}
+
+// add buffers valid Reading message of device received at time now
+func (r *relay) add(now int64, imei string, rm *readingMessage) {
+	rec := newRecord(now, imei, rm)
+	// binary record payload has layout of ingest frame
+	var buf [2 + record.BinaryLength]byte
+	frame := record.AppendBinary(buf[:0], &rec)[2:]
+
+	r.mux.Lock()
+	if r.n == r.conf.Buffer {
+		r.mux.Unlock()
+		atomic.AddInt64(&r.dropped, 1)
+		return
+	}
+	i := (r.head + r.n) % r.conf.Buffer
+	copy(r.frames[i*ingestFrameLength:], frame)
+	r.n++
+	r.mux.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// acked removes acked frames from buffer
+func (r *relay) acked(k int) {
+	r.mux.Lock()
+	if k > r.sent {
+		k = r.sent
+	}
+	r.head = (r.head + k) % r.conf.Buffer
+	r.n -= k
+	r.sent -= k
+	r.mux.Unlock()
+	atomic.AddInt64(&r.relayed, int64(k))
+}
+
+// pending returns contiguous frames not sent yet
+func (r *relay) pending() []byte {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.sent == r.n {
+		return nil
+	}
+	i := (r.head + r.sent) % r.conf.Buffer
+	k := r.n - r.sent
+	if i+k > r.conf.Buffer {
+		k = r.conf.Buffer - i
+	}
+	return r.frames[i*ingestFrameLength : (i+k)*ingestFrameLength]
+}
+
+// run connects to upstream, reconnects with backoff, relays buffered frames until done
+func (r *relay) run(done <-chan struct{}) {
+	for attempt := 0; ; {
+		conn, err := dialLogin(r.conf.Addr, relayLogin[:])
+		if err == nil {
+			if err = relayHandshake(conn, r.conf.Key); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			attempt = 0
+			atomic.StoreInt32(&r.connected, 1)
+			err = r.serve(conn, done)
+			atomic.StoreInt32(&r.connected, 0)
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Printf("relay, upstream - %v, link err: %v", r.conf.Addr, err)
+		atomic.AddInt64(&r.reconnects, 1)
+		attempt++
+		select {
+		case <-done:
+			return
+		case <-time.After(r.backoff(attempt)):
+		}
+	}
+}
+
+// backoff returns reconnect delay after failed attempt (doubled each attempt, limited by max backoff)
+func (r *relay) backoff(attempt int) time.Duration {
+	d := r.conf.Backoff
+	for i := 1; i < attempt && d < r.conf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.conf.MaxBackoff {
+		d = r.conf.MaxBackoff
+	}
+	return d
+}
+
+// serve sends frames to upstream link and reads acks until link error or done,
+// closes link, not acked frames are resent on next link
+func (r *relay) serve(conn net.Conn, done <-chan struct{}) error {
+	r.mux.Lock()
+	r.sent = 0
+	r.mux.Unlock()
+
+	// acks reader (stopped before next link)
+	errc := make(chan error, 1)
+	stopped := make(chan struct{})
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("relay, upstream conn close err: %v", err)
+		}
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		acks := make([]byte, 512)
+		for {
+			n, err := conn.Read(acks)
+			for _, b := range acks[:n] {
+				if b != relayAck {
+					errc <- errors.New("relay: wrong ack")
+					return
+				}
+			}
+			r.acked(n)
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	heartbeat := make([]byte, ingestFrameLength)
+	heartbeat[0] = relayHeartbeatByte
+	t := time.NewTicker(relayHeartbeat)
+	defer t.Stop()
+	for {
+		if frames := r.pending(); frames != nil {
+			// counted as sent before write, acks of frames may arrive while write in progress
+			r.mux.Lock()
+			r.sent += len(frames) / ingestFrameLength
+			r.mux.Unlock()
+			if _, err := conn.Write(frames); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case <-done:
+			return nil
+		case err := <-errc:
+			return err
+		case <-r.notify:
+		case <-t.C:
+			if _, err := conn.Write(heartbeat); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// snapshot of relay statistics
+func (r *relay) snapshot() *relayStats {
+	r.mux.Lock()
+	pending := r.n
+	r.mux.Unlock()
+	return &relayStats{
+		Connected:  atomic.LoadInt32(&r.connected) == 1,
+		Relayed:    atomic.LoadInt64(&r.relayed),
+		Pending:    int64(pending),
+		Dropped:    atomic.LoadInt64(&r.dropped),
+		Reconnects: atomic.LoadInt64(&r.reconnects),
+	}
+}
+
+// relaySignature returns HMAC-SHA256 of relay link challenge by key
+func relaySignature(key string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// relayHandshake authenticates relay link after relay login: signs challenge of upstream, reads ack
+func relayHandshake(conn net.Conn, key string) error {
+	conn.SetDeadline(time.Now().Add(relayHandshakeDeadline))
+	defer conn.SetDeadline(time.Time{})
+	challenge := make([]byte, relayChallengeLength)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return err
+	}
+	if _, err := conn.Write(relaySignature(key, challenge)); err != nil {
+		return err
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	if ack[0] != relayAck {
+		return errors.New("relay: link not acked")
+	}
+	return nil
+}
+
+// dialLogin connects to server and sends login (device IMEI or relay login)
+func dialLogin(addr string, login []byte) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(login); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// acceptRelayLink authenticates relay link (after relay login) by challenge signed with shared key
+func (d *device) acceptRelayLink() error {
+	challenge := make([]byte, relayChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	if _, err := d.conn.Write(challenge); err != nil {
+		return err
+	}
+	d.conn.SetReadDeadline(time.Now().Add(relayHandshakeDeadline))
+	sig := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(d.conn, sig); err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, relaySignature(d.conf.relayKey, challenge)) {
+		return errors.New("relay: wrong link signature")
+	}
+	_, err := d.conn.Write([]byte{relayAck})
+	return err
+}
+
+// runRelayLink handles relay link (after relay login): authenticates link, processes
+// ingest frames with original receive time as device time (frames of banned devices skipped),
+// acks each frame
+func (d *device) runRelayLink() error {
+	if err := d.acceptRelayLink(); err != nil {
+		log.Printf("relay link, raddr - %v, authentication err: %v", d.raddr, err)
+		d.loginFailed()
+		return err
+	}
+	log.Printf("relay link logged, raddr - %v", d.raddr)
+	frame := make([]byte, ingestFrameLength)
+	ack := []byte{relayAck}
+	r := decodedReading{}
+	ir := ingestReading{}
+	for {
+		d.conn.SetReadDeadline(time.Now().Add(relayLinkDeadline))
+		if _, err := io.ReadFull(d.conn, frame); err != nil {
+			log.Printf("relay link, raddr - %v, read frame err: %v", d.raddr, err)
+			return err
+		}
+		atomic.AddInt64(&d.pipe.stats.bytesRead, ingestFrameLength)
+		if frame[0] == relayHeartbeatByte {
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		imei, err := parseIngestFrame(frame, &ir)
+		if err != nil {
+			log.Printf("relay link, raddr - %v, frame imei err: %v", d.raddr, err)
+		} else if _, banned := d.pipe.bans.banned(imei, now); banned {
+			log.Printf("relay link, imei %v banned, frame skipped", imei)
+		} else if ds := d.pipe.devs.get(imei); d.pipe.readingAt(now, ir.Time, ds, frame[imeiLength+8:], &r) {
+			if d.pktStor != nil {
+				d.pktStor.seen(imei, now)
+				d.pktStor.setReading(imei, r.status(ir.Time))
+			}
+		} else {
+			log.Printf("relay link, imei %v, invalid reading message %+v: %v", imei, r.msg, r.reasons())
+		}
+		// frame processed (valid or not)
+		if _, err := d.conn.Write(ack); err != nil {
+			log.Printf("relay link, raddr - %v, write ack err: %v", d.raddr, err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"testing"
+	"time"
+)
+
+// shared key of relay links
+const testRelayKey = "relay-key"
+
+// testRelayUpstream starts upstream server accepting relay links, valid readings output to olg
+func testRelayUpstream(t *testing.T, addr string, accept bool, olg *log.Logger) *Server {
+	s := New(Config{
+		Addr: addr, LoginDeadline: time.Millisecond * 50, MsgDeadline: time.Millisecond * 50,
+		HistorySize: 10, RelayAccept: accept, RelayKey: testRelayKey,
+	}, olg)
+	if err := s.Start(); err != nil {
+		t.Fatalf("upstream start err: %v", err)
+	}
+	return s
+}
+
+// testRelayWait waits relay statistics condition
+func testRelayWait(t *testing.T, r *relay, cond func(rs *relayStats) bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond(r.snapshot()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("relay wait timeout, stats %+v", r.snapshot())
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func Test_relay_run(t *testing.T) {
+
+	up := testRelayUpstream(t, "127.0.0.1:0", true, testOutLog)
+	addr := up.ln.Addr().String()
+
+	// readings buffered before link
+	before := time.Now().UnixNano()
+	r, err := newRelay(RelayConfig{Addr: addr, Key: testRelayKey, Backoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 20})
+	if err != nil {
+		t.Fatalf("new relay err: %v", err)
+	}
+	r.add(1, "490154203237518", &readingMessage{Temp: 1, BattLev: 1})
+	r.add(2, "490154203237518", &readingMessage{Temp: 2, BattLev: 1})
+	// invalid on upstream (acked)
+	r.add(3, "490154203237518", &readingMessage{Temp: 1000, BattLev: 1})
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		r.run(done)
+		close(finished)
+	}()
+	testRelayWait(t, r, func(rs *relayStats) bool { return rs.Relayed == 3 && rs.Pending == 0 && rs.Connected })
+
+	// original receive times processed as device times
+	hrs := up.pipe.history("490154203237518", math.MinInt64, math.MaxInt64)
+	if len(hrs) != 2 || hrs[0].msg.Temp != 1 || hrs[1].msg.Temp != 2 {
+		t.Fatalf("wrong upstream history %+v", hrs)
+	}
+	if dc := up.deviceClock("490154203237518"); dc.Readings == 0 || dc.Offset < before-3 {
+		t.Fatalf("relayed times should be device times, got clock %+v", dc)
+	}
+
+	// upstream outage, readings buffered until reconnect
+	up.Stop()
+	up.Wait()
+	testRelayWait(t, r, func(rs *relayStats) bool { return !rs.Connected })
+	r.add(4, "490154203237518", &readingMessage{Temp: 4, BattLev: 1})
+	if rs := r.snapshot(); rs.Pending != 1 {
+		t.Fatalf("expected pending reading, got %+v", rs)
+	}
+	up = testRelayUpstream(t, addr, true, testOutLog)
+	testRelayWait(t, r, func(rs *relayStats) bool { return rs.Relayed == 4 && rs.Pending == 0 && rs.Reconnects > 0 })
+	hrs = up.pipe.history("490154203237518", math.MinInt64, math.MaxInt64)
+	if len(hrs) != 1 || hrs[0].msg.Temp != 4 {
+		t.Fatalf("wrong upstream history after reconnect %+v", hrs)
+	}
+
+	close(done)
+	<-finished
+	up.Stop()
+	up.Wait()
+}
+
+func Test_relay_run_Backlog(t *testing.T) {
+
+	up := testRelayUpstream(t, "127.0.0.1:0", true, log.New(ioutil.Discard, "", 0))
+	defer func() {
+		up.Stop()
+		up.Wait()
+	}()
+
+	// full backlog written at once, acks arrive while write in progress
+	r, err := newRelay(RelayConfig{Addr: up.ln.Addr().String(), Key: testRelayKey, Backoff: time.Millisecond * 10})
+	if err != nil {
+		t.Fatalf("new relay err: %v", err)
+	}
+	for i := 1; i <= relayBuffer; i++ {
+		r.add(int64(i), "490154203237518", &readingMessage{Temp: 1, BattLev: 1})
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		r.run(done)
+		close(finished)
+	}()
+	testRelayWait(t, r, func(rs *relayStats) bool { return rs.Relayed == relayBuffer && rs.Pending == 0 })
+	close(done)
+	<-finished
+}
+
+func Test_relay_run_NotAccepted(t *testing.T) {
+
+	testCases := []struct {
+		name   string
+		accept bool
+		key    string
+	}{
+		// relay login rejected as wrong imei
+		{name: "relay links not accepted", accept: false, key: testRelayKey},
+		{name: "wrong key", accept: true, key: "wrong-key"},
+	}
+
+	for _, tc := range testCases {
+
+		up := testRelayUpstream(t, "127.0.0.1:0", tc.accept, testOutLog)
+		r, err := newRelay(RelayConfig{Addr: up.ln.Addr().String(), Key: tc.key, Backoff: time.Millisecond * 10})
+		if err != nil {
+			t.Fatalf("%v: new relay err: %v", tc.name, err)
+		}
+		r.add(1, "490154203237518", &readingMessage{Temp: 1, BattLev: 1})
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			r.run(done)
+			close(finished)
+		}()
+		testRelayWait(t, r, func(rs *relayStats) bool { return rs.Reconnects > 1 })
+		close(done)
+		<-finished
+		up.Stop()
+		up.Wait()
+		if rs := r.snapshot(); rs.Relayed != 0 || rs.Pending != 1 || rs.Connected {
+			t.Fatalf("%v: reading should not be relayed, got %+v", tc.name, rs)
+		}
+		if hrs := up.pipe.history("490154203237518", math.MinInt64, math.MaxInt64); len(hrs) != 0 {
+			t.Fatalf("%v: reading should not be accepted by upstream, got %+v", tc.name, hrs)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// key required to accept relay links
+	s := New(Config{Addr: "127.0.0.1:0", RelayAccept: true}, testOutLog)
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatalf("relay key should be required to accept relay links")
+	}
+}
+
+func Test_pipeline_reading_RelayRaw(t *testing.T) {
+
+	p := newPipeline(testOutLog, newServerStats())
+	r, err := newRelay(RelayConfig{Addr: "127.0.0.1:1", Key: testRelayKey})
+	if err != nil {
+		t.Fatalf("new relay err: %v", err)
+	}
+	p.relay = r
+	if _, err := p.calibs.add("490154203237518", calibrationEntry{Temp: &fieldCalibration{Offset: -2, Gain: 1}}, 1); err != nil {
+		t.Fatalf("add calibration err: %v", err)
+	}
+	p.reading(1, p.devs.get("490154203237518"), testFrame(readingMessage{Temp: 10, BattLev: 1}), &decodedReading{})
+
+	// raw reading relayed, calibrated by upstream
+	ir := ingestReading{}
+	if _, err := parseIngestFrame(r.pending(), &ir); err != nil || ir.Reading.Temp != 10 {
+		t.Fatalf("raw reading should be relayed, got %+v, %v", ir, err)
+	}
+
+	// original receive time relayed (output time of device)
+	p.outTime = TimeDevice
+	r.sent = r.n
+	r.acked(r.n)
+	p.readingAt(2, 1, p.devs.get("490154203237518"), testFrame(readingMessage{Temp: 10, BattLev: 1}), &decodedReading{})
+	if _, err := parseIngestFrame(r.pending(), &ir); err != nil || ir.Time != 2 {
+		t.Fatalf("reading should be relayed with receive time, got %+v, %v", ir, err)
+	}
+}
+
+func Test_relay_buffer(t *testing.T) {
+
+	if _, err := newRelay(RelayConfig{}); err == nil {
+		t.Fatalf("upstream address and key should be required")
+	}
+	r, err := newRelay(RelayConfig{Addr: "127.0.0.1:1", Key: testRelayKey, Buffer: 2})
+	if err != nil {
+		t.Fatalf("new relay err: %v", err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		r.add(i, "490154203237518", &readingMessage{Temp: float64(i)})
+	}
+	if rs := r.snapshot(); rs.Pending != 2 || rs.Dropped != 1 {
+		t.Fatalf("expected dropped reading on full buffer, got %+v", rs)
+	}
+
+	// sent frames acked, ring wraps
+	if frames := r.pending(); len(frames) != 2*ingestFrameLength {
+		t.Fatalf("expected 2 pending frames, got %v bytes", len(frames))
+	}
+	r.sent = 2
+	r.acked(1)
+	r.add(4, "490154203237518", &readingMessage{Temp: 4})
+	frames := r.pending()
+	ir := ingestReading{}
+	if len(frames) != ingestFrameLength {
+		t.Fatalf("expected 1 pending frame, got %v bytes", len(frames))
+	}
+	if imei, err := parseIngestFrame(frames, &ir); err != nil || imei != "490154203237518" || ir.Time != 4 || ir.Reading.Temp != 4 {
+		t.Fatalf("wrong pending frame %+v, %v", ir, err)
+	}
+	// acks over sent frames ignored
+	r.acked(5)
+	if rs := r.snapshot(); rs.Pending != 1 || rs.Relayed != 2 {
+		t.Fatalf("wrong relay stats %+v", rs)
+	}
+
+	// backoff
+	r.conf.Backoff, r.conf.MaxBackoff = time.Second, time.Second*3
+	for attempt, exp := range []time.Duration{time.Second, time.Second * 2, time.Second * 3} {
+		if got := r.backoff(attempt + 1); got != exp {
+			t.Fatalf("attempt %v: expected backoff %v, got %v", attempt+1, exp, got)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// period of closing expired rollup buckets
+const rollupExpirePeriod = time.Second * 10
+
+// rollup resolutions
+const (
+	rollup1m = iota
+	rollup1h
+	rollup1d
+	rollupResNum
+)
+
+// rollupRes rollup resolution: bucket duration and number of kept closed buckets
+type rollupRes struct {
+	name   string
+	dur    int64
+	retain int
+}
+
+// rollup resolutions (memory bounded by kept buckets)
+var rollupResolutions = [rollupResNum]rollupRes{
+	rollup1m: {name: "1m", dur: int64(time.Minute), retain: 60},
+	rollup1h: {name: "1h", dur: int64(time.Hour), retain: 48},
+	rollup1d: {name: "1d", dur: int64(time.Hour * 24), retain: 30},
+}
+
+// fieldAgg aggregate of Reading message field values
+type fieldAgg struct {
+	min, max, sum float64
+}
+
+// rollupBucket aggregate of device Reading messages in time bucket
+type rollupBucket struct {
+	start  int64
+	count  int64
+	fields [fieldsNum]fieldAgg
+}
+
+// add aggregates Reading message
+func (b *rollupBucket) add(rm *readingMessage) {
+	vals := [fieldsNum]float64{rm.Temp, rm.Alt, rm.Lat, rm.Lon, rm.BattLev}
+	for f, v := range vals {
+		fa := &b.fields[f]
+		if b.count == 0 || v < fa.min {
+			fa.min = v
+		}
+		if b.count == 0 || v > fa.max {
+			fa.max = v
+		}
+		fa.sum += v
+	}
+	b.count++
+}
+
+// rollupRing current (open) bucket and ring of closed buckets of resolution
+type rollupRing struct {
+	cur rollupBucket
+	// closed buckets, next - index of next closed bucket, n - number of closed buckets
+	buckets []rollupBucket
+	next    int
+	n       int
+	// end time of last closed bucket
+	closedUntil int64
+}
+
+// close closes current bucket of duration dur, returns false if current bucket is empty
+func (r *rollupRing) close(dur int64) (rollupBucket, bool) {
+	if r.cur.count == 0 {
+		return rollupBucket{}, false
+	}
+	b := r.cur
+	r.closedUntil = b.start + dur
+	r.buckets[r.next] = b
+	r.next = (r.next + 1) % len(r.buckets)
+	if r.n < len(r.buckets) {
+		r.n++
+	}
+	r.cur = rollupBucket{}
+	return b, true
+}
+
+// devRollups rollups of device for each resolution (should be used under device state lock)
+type devRollups struct {
+	rings [rollupResNum]rollupRing
+}
+
+// closedBucket bucket closed by rollups update
+type closedBucket struct {
+	res    int
+	bucket rollupBucket
+}
+
+// inits device rollups, allocates rings of closed buckets
+func newDevRollups() *devRollups {
+	dr := &devRollups{}
+	for res := range dr.rings {
+		dr.rings[res].buckets = make([]rollupBucket, rollupResolutions[res].retain)
+	}
+	return dr
+}
+
+// add aggregates Reading message of time t, closes buckets of previous time, returns number of closed buckets
+// set to closed (late Reading messages of already closed buckets are skipped)
+func (dr *devRollups) add(t int64, rm *readingMessage, closed *[rollupResNum]closedBucket) int {
+	n := 0
+	for res := range dr.rings {
+		r := &dr.rings[res]
+		dur := rollupResolutions[res].dur
+		start := t - t%dur
+		if start < r.closedUntil || (r.cur.count > 0 && start < r.cur.start) {
+			continue
+		}
+		if r.cur.count > 0 && start > r.cur.start {
+			if b, ok := r.close(dur); ok {
+				closed[n] = closedBucket{res: res, bucket: b}
+				n++
+			}
+		}
+		if r.cur.count == 0 {
+			r.cur.start = start
+		}
+		r.cur.add(rm)
+	}
+	return n
+}
+
+// expire closes current buckets ended before time t, returns number of closed buckets set to closed
+func (dr *devRollups) expire(t int64, closed *[rollupResNum]closedBucket) int {
+	n := 0
+	for res := range dr.rings {
+		r := &dr.rings[res]
+		dur := rollupResolutions[res].dur
+		if r.cur.count > 0 && r.cur.start+dur <= t {
+			if b, ok := r.close(dur); ok {
+				closed[n] = closedBucket{res: res, bucket: b}
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// rollupField aggregate of field values
+type rollupField struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// rollup bucket of device (JSON)
+type rollup struct {
+	IMEI   string                 `json:"imei"`
+	Res    string                 `json:"res"`
+	Start  int64                  `json:"start"`
+	End    int64                  `json:"end"`
+	Count  int64                  `json:"count"`
+	Open   bool                   `json:"open,omitempty"`
+	Fields map[string]rollupField `json:"fields"`
+}
+
+// newRollup converts bucket of resolution to rollup
+func newRollup(imei string, res int, b *rollupBucket, open bool) rollup {
+	ru := rollup{
+		IMEI:   imei,
+		Res:    rollupResolutions[res].name,
+		Start:  b.start,
+		End:    b.start + rollupResolutions[res].dur,
+		Count:  b.count,
+		Open:   open,
+		Fields: make(map[string]rollupField, fieldsNum),
+	}
+	for f, fa := range b.fields {
+		ru.Fields[fieldNames[f]] = rollupField{Min: fa.min, Max: fa.max, Avg: fa.sum / float64(b.count)}
+	}
+	return ru
+}
+
+// rollups returns buckets of resolution in time range [from, to), closed and current (open) bucket
+func (dr *devRollups) rollups(imei string, res int, from, to int64) []rollup {
+	rus := []rollup{}
+	r := &dr.rings[res]
+	dur := rollupResolutions[res].dur
+	// closed buckets, oldest first
+	for i := 0; i < r.n; i++ {
+		b := &r.buckets[(r.next-r.n+i+len(r.buckets))%len(r.buckets)]
+		if b.start+dur > from && b.start < to {
+			rus = append(rus, newRollup(imei, res, b, false))
+		}
+	}
+	if r.cur.count > 0 && r.cur.start+dur > from && r.cur.start < to {
+		rus = append(rus, newRollup(imei, res, &r.cur, true))
+	}
+	return rus
+}
+
+// rollupsExpire closes expired buckets of all devices, logs them to rollup output
+func (p *pipeline) rollupsExpire(now int64) {
+	for _, ds := range p.devs.list() {
+		var closed [rollupResNum]closedBucket
+		ds.mux.Lock()
+		n := 0
+		if ds.rollups != nil {
+			n = ds.rollups.expire(now, &closed)
+		}
+		ds.mux.Unlock()
+
+		p.rollupsOutput(ds.imei, closed[:n])
+	}
+}
+
+// rollupsOutput logs closed buckets of device to rollup output (NDJSON)
+func (p *pipeline) rollupsOutput(imei string, closed []closedBucket) {
+	if p.rollupLog == nil {
+		return
+	}
+	for i := range closed {
+		out, err := json.Marshal(newRollup(imei, closed[i].res, &closed[i].bucket, false))
+		if err != nil {
+			log.Printf("rollup, imei - %v, marshal err: %v", imei, err)
+			continue
+		}
+		p.rollupLog.Print(string(out))
+	}
+}
+
+// deviceRollups returns rollups of device by query: res (1m by default), from, to (unix nano)
+func (s *Server) deviceRollups(imei string, q url.Values) ([]rollup, error) {
+	res := rollup1m
+	if name := q.Get("res"); name != "" {
+		res = -1
+		for i, rr := range rollupResolutions {
+			if rr.name == name {
+				res = i
+			}
+		}
+		if res < 0 {
+			return nil, errors.New("unknown resolution")
+		}
+	}
+	from, to, err := queryTimeRange(q)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok {
+		return []rollup{}, nil
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	if ds.rollups == nil {
+		return []rollup{}, nil
+	}
+	return ds.rollups.rollups(imei, res, from, to), nil
+}
+
+// queryTimeRange parses time range of query: from, to (unix nano), unbounded if not set
+func queryTimeRange(q url.Values) (int64, int64, error) {
+	var from, to int64 = math.MinInt64, math.MaxInt64
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, 0, errors.New("wrong from")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, 0, errors.New("wrong to")
+		}
+	}
+	if from >= to {
+		return 0, 0, errors.New("from should be before to")
+	}
+	return from, to, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_devRollups_add(t *testing.T) {
+
+	min := int64(time.Minute)
+	dr := newDevRollups()
+	var closed [rollupResNum]closedBucket
+
+	// two readings in first minute
+	if n := dr.add(min*10+1, &readingMessage{Temp: 10, BattLev: 50}, &closed); n != 0 {
+		t.Fatalf("expected no closed buckets, got %v", n)
+	}
+	if n := dr.add(min*10+2, &readingMessage{Temp: 20, BattLev: 40}, &closed); n != 0 {
+		t.Fatalf("expected no closed buckets, got %v", n)
+	}
+	// next minute closes 1m bucket
+	n := dr.add(min*11, &readingMessage{Temp: 30, BattLev: 30}, &closed)
+	if n != 1 || closed[0].res != rollup1m {
+		t.Fatalf("expected closed 1m bucket, got %v %+v", n, closed[:n])
+	}
+	b := closed[0].bucket
+	if b.start != min*10 || b.count != 2 || b.fields[fieldTemp] != (fieldAgg{min: 10, max: 20, sum: 30}) {
+		t.Fatalf("wrong closed bucket %+v", b)
+	}
+	// late reading of closed bucket is skipped by 1m rollup
+	dr.add(min*10+3, &readingMessage{Temp: 40, BattLev: 30}, &closed)
+
+	rus := dr.rollups("490154203237518", rollup1m, min*10, min*12)
+	if len(rus) != 2 || rus[0].Open || !rus[1].Open || rus[0].Fields["Temp"].Avg != 15 || rus[1].Count != 1 {
+		t.Fatalf("wrong 1m rollups %+v", rus)
+	}
+	rus = dr.rollups("490154203237518", rollup1h, 0, min*60)
+	if len(rus) != 1 || rus[0].Count != 4 || rus[0].Fields["Temp"].Max != 40 || rus[0].Fields["BattLev"].Min != 30 {
+		t.Fatalf("wrong 1h rollups %+v", rus)
+	}
+
+	// expire closes current buckets
+	if n := dr.expire(min*12, &closed); n != 1 || closed[0].bucket.start != min*11 {
+		t.Fatalf("expected expired 1m bucket, got %v %+v", n, closed[:n])
+	}
+
+	// closed buckets are bounded by retain
+	for i := int64(0); i < 100; i++ {
+		dr.add(min*(20+i), &readingMessage{Temp: float64(i), BattLev: 1}, &closed)
+	}
+	rus = dr.rollups("490154203237518", rollup1m, 0, min*1000)
+	if len(rus) != rollupResolutions[rollup1m].retain+1 || rus[0].Start != min*59 || rus[len(rus)-2].Start != min*118 {
+		t.Fatalf("wrong bounded 1m rollups: %v, first %v", len(rus), rus[0].Start)
+	}
+}
+
+func Test_devRollups_add_Allocs(t *testing.T) {
+
+	dr := newDevRollups()
+	var closed [rollupResNum]closedBucket
+	rm := readingMessage{Temp: 10, BattLev: 50}
+	now := int64(0)
+	allocs := testing.AllocsPerRun(1000, func() {
+		now += int64(time.Second)
+		dr.add(now, &rm, &closed)
+	})
+	if allocs != 0 {
+		t.Fatalf("rollups update should not allocate, got %v allocs", allocs)
+	}
+}
+
+func Test_Server_deviceRollups(t *testing.T) {
+
+	var rout bytes.Buffer
+	s := New(Config{RollupOut: &rout}, testOutLog)
+	ds := s.pipe.devs.get("490154203237518")
+	min := int64(time.Minute)
+	s.pipe.reading(min*10, ds, testFrame(readingMessage{Temp: 1, BattLev: 1}), &decodedReading{})
+	s.pipe.reading(min*11, ds, testFrame(readingMessage{Temp: 2, BattLev: 1}), &decodedReading{})
+	s.pipe.rollupsExpire(min * 24 * 60)
+
+	// closed buckets output
+	records := strings.Split(strings.TrimSpace(rout.String()), "\n")
+	if len(records) != 4 {
+		t.Fatalf("expected %v closed buckets, got %q", 4, rout.String())
+	}
+
+	testCases := []struct {
+		name    string
+		query   string
+		code    int
+		rollups int
+	}{
+		// Positive
+		{name: "default resolution", query: "", code: http.StatusOK, rollups: 2},
+		{name: "time range", query: "?res=1m&from=660000000000&to=720000000000", code: http.StatusOK, rollups: 1},
+		{name: "1h resolution", query: "?res=1h", code: http.StatusOK, rollups: 1},
+		{name: "1d resolution, empty range", query: "?res=1d&from=86400000000000", code: http.StatusOK, rollups: 0},
+		// Negative
+		{name: "unknown resolution", query: "?res=1s", code: http.StatusBadRequest},
+		{name: "wrong from", query: "?from=a", code: http.StatusBadRequest},
+		{name: "wrong range", query: "?from=2&to=1", code: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/devices/490154203237518/rollups"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: expected code %v, got %v", tc.name, tc.code, rec.Code)
+		}
+		if tc.code == http.StatusOK {
+			rus := []rollup{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &rus); err != nil {
+				t.Fatalf("%v: rollups response unmarshal err: %v", tc.name, err)
+			}
+			if len(rus) != tc.rollups {
+				t.Fatalf("%v: expected %v rollups, got %+v", tc.name, tc.rollups, rus)
+			}
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+
+	// unknown device has no rollups
+	rus, err := (&Server{pipe: newPipeline(log.New(&rout, "", 0), newServerStats())}).deviceRollups("490154203237518", nil)
+	if err != nil || len(rus) != 0 {
+		t.Fatalf("unknown device should have no rollups, got %+v, %v", rus, err)
+	}
+}
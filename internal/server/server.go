@@ -3,13 +3,18 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/radisvaliullin/test_task_17/record"
 )
 
 // Config server configs
@@ -18,39 +23,166 @@ type Config struct {
 	Addr string
 	// http server address
 	HTTPAddr string
+	// udp server address (optional, udp listener disabled if empty)
+	UDPAddr string
 
 	// client message read timeouts
 	LoginDeadline time.Duration
 	MsgDeadline   time.Duration
+
+	// device reading rate limit (messages per second, disabled if zero),
+	// burst (max messages at once) and policy on exceeding (drop by default)
+	RateLimit  float64
+	RateBurst  int
+	RatePolicy RatePolicy
+
+	// max ratio of invalid device messages (disabled if zero), checked after
+	// min messages of connection, device exceeded the ratio is disconnected
+	InvalidRatio       float64
+	InvalidMinMessages int
+	// quarantine output of invalid Reading messages (disabled if nil)
+	Quarantine io.Writer
+	// reject subnormal numbers and negative zero in Reading messages
+	// (NaN and infinities are always rejected)
+	RejectSubnormal bool
+	RejectNegZero   bool
+
+	// validation profiles of devices (limits by spec if nil)
+	Profiles *Profiles
+	// calibrations file of devices (calibrations not persisted if empty)
+	CalibrationFile string
+	// rollups output of closed rollup buckets (disabled if nil)
+	RollupOut io.Writer
+	// anomaly detection of temperature and altitude of devices (disabled if nil),
+	// output of anomaly events (disabled if nil)
+	Anomaly    *AnomalyConfig
+	AnomalyOut io.Writer
+	// stuck sensor detection of devices (disabled if nil), output of stuck sensor events (disabled if nil)
+	Stuck    *StuckConfig
+	StuckOut io.Writer
+	// GPS movement tracking of devices (disabled if nil)
+	Movement *MovementConfig
+	// history size of device, last valid readings kept for export (history disabled if zero),
+	// max devices with history (unlimited if zero, history of least recently updated device dropped),
+	// history of device dropped if not updated within idle time (kept if zero)
+	HistorySize    int
+	HistoryDevices int
+	HistoryIdle    time.Duration
+	// output records format (spec CSV by default)
+	OutputFormat record.Format
+	// time of output records (server receive time by default), device time of reading
+	// rejected if ahead of receive time more than max future or behind more than max age
+	// (checks disabled if zero)
+	OutputTime         TimeSource
+	TimestampMaxFuture time.Duration
+	TimestampMaxAge    time.Duration
+	// webhook output of valid readings (disabled if nil)
+	Webhook *WebhookConfig
+	// relay of valid readings to upstream server (disabled if nil),
+	// accept relay links of edge servers authenticated by shared key (key required)
+	Relay       *RelayConfig
+	RelayAccept bool
+	RelayKey    string
+	// cluster node configs (clustering disabled if nil)
+	Cluster *ClusterConfig
+
+	// admin token of admin endpoints (disabled if empty and API keys not set),
+	// bans file of devices (bans not persisted if empty), audit log of admin actions (disabled if nil)
+	AdminToken string
+	BansFile   string
+	AuditLog   io.Writer
+	// temporary bans of remote IPs with repeated failed device logins (disabled if nil)
+	IPBan *IPBanConfig
+	// API keys file of HTTP API (authentication disabled if empty), reloaded if changed
+	APIKeysFile string
 }
 
 // Server implements logging server of thermometers.
 type Server struct {
 	conf Config
 
-	// std out logger for loggin Reading message
-	outLog *log.Logger
+	// Reading messages pipeline (output, statistics)
+	pipe *pipeline
 
 	// listener
 	ln net.Listener
+	// udp listener
+	udpConn net.PacketConn
 
 	// wg
 	wg sync.WaitGroup
 
 	// server error
 	errs chan error
+	// closed on server stop (once)
+	done     chan struct{}
+	stopOnce sync.Once
 
 	//
 	devStor *devStorage
+	// devices sending datagrams
+	pktStor *pktStorage
+	// cluster membership and devices directory (clustering disabled if nil)
+	cluster *cluster
+	// audit logger of admin actions (disabled if nil)
+	auditLog *log.Logger
+	// failed logins and bans of remote IPs (disabled if nil)
+	ipGuard *ipGuard
+	// API keys of HTTP API (authentication disabled if nil)
+	keys *keyStore
 }
 
 // New inits new Server.
 func New(conf Config, olg *log.Logger) *Server {
 	s := &Server{
 		conf:    conf,
-		outLog:  olg,
+		pipe:    newPipeline(olg, newServerStats()),
 		errs:    make(chan error, 1),
+		done:    make(chan struct{}),
 		devStor: newDevStorage(),
+		pktStor: newPktStorage(),
+	}
+	s.pipe.calibs = newCalibStore(conf.CalibrationFile)
+	s.pipe.bans = newBanStore(conf.BansFile)
+	s.pipe.historySize = conf.HistorySize
+	s.pipe.histDevs = newHistDevices(conf.HistoryDevices)
+	s.pipe.historyIdle = conf.HistoryIdle
+	s.pipe.format = conf.OutputFormat
+	s.pipe.outTime = conf.OutputTime
+	s.pipe.tsMaxFuture = int64(conf.TimestampMaxFuture)
+	s.pipe.tsMaxAge = int64(conf.TimestampMaxAge)
+	if conf.Profiles != nil {
+		s.pipe.devs.profiles = newProfileSet(conf.Profiles)
+	}
+	if conf.RejectSubnormal {
+		s.pipe.checks |= checkSubnormal
+	}
+	if conf.RejectNegZero {
+		s.pipe.checks |= checkNegZero
+	}
+	if conf.Quarantine != nil {
+		s.pipe.quarLog = log.New(conf.Quarantine, "", 0)
+	}
+	if conf.RollupOut != nil {
+		s.pipe.rollupLog = log.New(conf.RollupOut, "", 0)
+	}
+	if conf.Anomaly != nil {
+		s.pipe.anomaly = conf.Anomaly.withDefaults()
+	}
+	if conf.AnomalyOut != nil {
+		s.pipe.anomalyLog = log.New(conf.AnomalyOut, "", 0)
+	}
+	if conf.Stuck != nil {
+		s.pipe.stuck = newStuckDetector(*conf.Stuck)
+	}
+	if conf.StuckOut != nil {
+		s.pipe.stuckLog = log.New(conf.StuckOut, "", 0)
+	}
+	if conf.Movement != nil {
+		s.pipe.movement = conf.Movement.withDefaults()
+	}
+	if conf.AuditLog != nil {
+		s.auditLog = log.New(conf.AuditLog, "", 0)
 	}
 	return s
 }
@@ -58,6 +190,58 @@ func New(conf Config, olg *log.Logger) *Server {
 // Start starts new server.
 func (s *Server) Start() error {
 
+	// relay links
+	if s.conf.RelayAccept && s.conf.RelayKey == "" {
+		err := errors.New("relay key required to accept relay links")
+		log.Printf("relay accept err: %v", err)
+		return err
+	}
+	// webhook output
+	if s.conf.Webhook != nil {
+		wh, err := newWebhook(*s.conf.Webhook)
+		if err != nil {
+			log.Printf("new webhook, url - %v, err: %v", s.conf.Webhook.URL, err)
+			return err
+		}
+		s.pipe.webhook = wh
+	}
+	// cluster node
+	if s.conf.Cluster != nil {
+		c, err := newCluster(*s.conf.Cluster, s.devStor.imeis)
+		if err != nil {
+			log.Printf("new cluster node, advertise - %v, err: %v", s.conf.Cluster.Advertise, err)
+			return err
+		}
+		s.cluster = c
+	}
+	// API keys
+	if s.conf.APIKeysFile != "" {
+		ks, err := newKeyStore(s.conf.APIKeysFile)
+		if err != nil {
+			log.Printf("api keys, file - %v, load err: %v", s.conf.APIKeysFile, err)
+			return err
+		}
+		s.keys = ks
+	}
+	// IP bans
+	if s.conf.IPBan != nil {
+		g, err := newIPGuard(*s.conf.IPBan)
+		if err != nil {
+			log.Printf("new ip guard err: %v", err)
+			return err
+		}
+		s.ipGuard = g
+	}
+	// relay to upstream
+	if s.conf.Relay != nil {
+		r, err := newRelay(*s.conf.Relay)
+		if err != nil {
+			log.Printf("new relay, upstream - %v, err: %v", s.conf.Relay.Addr, err)
+			return err
+		}
+		s.pipe.relay = r
+	}
+
 	log.Print("server listener starting ", s.conf.Addr)
 	ln, err := net.Listen("tcp", s.conf.Addr)
 	if err != nil {
@@ -66,6 +250,26 @@ func (s *Server) Start() error {
 	}
 	s.ln = ln
 
+	// udp listener
+	if s.conf.UDPAddr != "" {
+		log.Print("server udp listener starting ", s.conf.UDPAddr)
+		uc, err := net.ListenPacket("udp", s.conf.UDPAddr)
+		if err != nil {
+			log.Printf("new udp listener, addr - %v, err: %v", s.conf.UDPAddr, err)
+			if err := s.ln.Close(); err != nil {
+				log.Printf("server, listenner close err: %v", err)
+			}
+			return err
+		}
+		s.udpConn = uc
+		s.wg.Add(1)
+		go func() {
+			if err := s.runUDP(); err != nil {
+				s.errs <- err
+			}
+		}()
+	}
+
 	// run server
 	s.wg.Add(1)
 	go func() {
@@ -74,6 +278,55 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	// close expired rollup buckets
+	s.wg.Add(1)
+	go s.runRollups()
+
+	// deliver webhook batches
+	if s.pipe.webhook != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.pipe.webhook.run(s.done)
+		}()
+	}
+
+	// reload changed API keys
+	if s.keys != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.keys.run(s.done)
+		}()
+	}
+
+	// forget stale IPs of IP guard
+	if s.ipGuard != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.ipGuard.run(s.done)
+		}()
+	}
+
+	// gossip cluster membership and devices
+	if s.cluster != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.cluster.run(s.done)
+		}()
+	}
+
+	// relay readings to upstream
+	if s.pipe.relay != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.pipe.relay.run(s.done)
+		}()
+	}
+
 	// run HTTP server
 	go func() {
 		if err := s.startHTTPServer(); err != nil {
@@ -84,11 +337,19 @@ func (s *Server) Start() error {
 	return nil
 }
 
-// Stop stops server
+// Stop stops server (safe to call more than once)
 func (s *Server) Stop() {
-	if err := s.ln.Close(); err != nil {
-		log.Printf("server, listenner close err: %v", err)
-	}
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if err := s.ln.Close(); err != nil {
+			log.Printf("server, listenner close err: %v", err)
+		}
+		if s.udpConn != nil {
+			if err := s.udpConn.Close(); err != nil {
+				log.Printf("server, udp listenner close err: %v", err)
+			}
+		}
+	})
 }
 
 // Wait waits server stoping (blocking)
@@ -117,36 +378,68 @@ func (s *Server) run() error {
 			break
 		}
 		log.Printf("new conn accepted: laddr - %v, raddr - %v", conn.LocalAddr(), conn.RemoteAddr())
+		atomic.AddInt64(&s.pipe.stats.conns, 1)
+		// banned IP refused
+		if s.ipGuard != nil && !s.ipGuard.allowed(remoteIP(conn.RemoteAddr()), time.Now().UnixNano()) {
+			log.Printf("conn refused, raddr - %v, ip banned", conn.RemoteAddr())
+			if err := conn.Close(); err != nil {
+				log.Printf("device conn close err: %v", err)
+			}
+			continue
+		}
 
 		// connection (device) handler responsible for close connection
 		s.wg.Add(1)
 		d := newDevice(
-			devConfig{loginDeadline: s.conf.LoginDeadline, messageDeadline: s.conf.MsgDeadline},
-			conn, s.outLog, &s.wg, stop, s.devStor,
+			devConfig{
+				loginDeadline: s.conf.LoginDeadline, messageDeadline: s.conf.MsgDeadline,
+				rateLimit: s.conf.RateLimit, rateBurst: s.conf.RateBurst, ratePolicy: s.conf.RatePolicy,
+				invalidRatio: s.conf.InvalidRatio, invalidMinMessages: int64(s.conf.InvalidMinMessages),
+				relayAccept: s.conf.RelayAccept, relayKey: s.conf.RelayKey,
+			},
+			conn, s.pipe, &s.wg, stop, s.devStor,
 		)
+		d.pktStor = s.pktStor
+		d.cluster = s.cluster
+		d.ipGuard = s.ipGuard
 		go d.run()
 	}
 
 	return nil
 }
 
+// runRollups periodically closes expired rollup buckets of devices, drops idle histories of devices,
+// forgets stale flooders of stats
+func (s *Server) runRollups() {
+	defer s.wg.Done()
+	t := time.NewTicker(rollupExpirePeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			s.pipe.rollupsExpire(now.UnixNano())
+			s.pipe.historyExpire(now.UnixNano())
+			s.pipe.stats.expireFlooders(now.UnixNano())
+		}
+	}
+}
+
 // http server
 func (s *Server) startHTTPServer() error {
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/stats", s.stats)
-	mux.HandleFunc("/readings/", s.readings)
-	mux.HandleFunc("/status/", s.status)
-
-	return http.ListenAndServe(s.conf.HTTPAddr, mux)
+	return http.ListenAndServe(s.conf.HTTPAddr, s.httpHandler())
 }
 
-// not implemented
-func (s *Server) stats(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
-	if _, err := w.Write([]byte("Not Implemented")); err != nil {
-		log.Printf("http server: write err: %v", err)
+// http server routes
+func (s *Server) httpHandler() http.Handler {
+
+	mux := http.NewServeMux()
+	for _, r := range s.httpRoutes() {
+		mux.HandleFunc(r.pattern, r.handler)
 	}
+
+	return s.authenticate(mux)
 }
 
 // return last Reading of device by IMEI
@@ -167,42 +460,125 @@ func (s *Server) readings(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// request last reading
+	// device of other node
+	if s.proxyOwner(w, req, imei) {
+		return
+	}
+	drs := s.lastReading(imei)
+
+	// response
+	out, err := json.Marshal(&drs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
+
+// proxyOwner proxies request of device connected to other cluster node to owning node,
+// returns false if device is not of other node (request not forwarded by node)
+func (s *Server) proxyOwner(w http.ResponseWriter, req *http.Request, imei string) bool {
+	if s.cluster == nil || req.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+	if _, ok := s.devStor.ok(imei); ok {
+		return false
+	}
+	_, addr, ok := s.cluster.owner(imei, time.Now().UnixNano())
+	if !ok {
+		return false
+	}
+	s.clusterProxy(w, req, addr)
+	return true
+}
+
+// lastReading requests last reading of device connected to node (last retained reading if device offline)
+func (s *Server) lastReading(imei string) deviceReadingStatus {
 	drs := deviceReadingStatus{
 		deviceStatus: deviceStatus{
-			IMEI: imei,
+			IMEI:    imei,
+			Profile: s.deviceProfile(imei),
+			Battery: s.deviceBattery(imei, time.Now().UnixNano()),
 		},
 	}
-	dreq, ok := s.devStor.ok(imei)
-	if ok {
+	stuck, since := s.deviceStuck(imei)
+	drs.SensorStuckFields, drs.SensorStuck = stuckFieldNames(stuck, &fieldNames), since
+	if s.cluster != nil {
+		drs.Node = s.cluster.conf.NodeID
+	}
+	if dreq, ok := s.devStor.ok(imei); ok {
 		dresp := make(chan deviceReadingStatus, 1)
 		dreq <- dresp
 		resp, ok := <-dresp
 		if ok {
 			drs.Status = "online"
 			drs.Reading = resp.Reading
+			drs.Raw = resp.Raw
 			drs.Time = resp.Time
 		} else {
 			drs.Status = "offline"
 		}
+	} else if pd, ok := s.pktStor.online(imei, time.Now().UnixNano(), s.conf.MsgDeadline); ok {
+		// udp device
+		drs.Status = "online"
+		drs.Reading = pd.last.Reading
+		drs.Raw = pd.last.Raw
+		drs.Time = pd.last.Time
 	} else {
 		drs.Status = "offline"
 	}
-
-	// response
-	out, err := json.Marshal(&drs)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
-			log.Printf("http server: write err: %v", err)
+	// offline device, last retained reading
+	if hr, ok := s.pipe.lastReading(imei); ok && drs.Status == "offline" {
+		drs.Reading = hr.msg
+		if hr.calibrated {
+			drs.Raw = &hr.raw
 		}
-		return
+		drs.Time = hr.time
 	}
+	return drs
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err := w.Write(out); err != nil {
-		log.Printf("http server: write err: %v", err)
+// deviceStatus returns status of device (online on node or other cluster node)
+func (s *Server) deviceStatus(imei string) deviceStatus {
+	sts := deviceStatus{
+		IMEI:    imei,
+		Profile: s.deviceProfile(imei),
+		Battery: s.deviceBattery(imei, time.Now().UnixNano()),
+	}
+	stuck, since := s.deviceStuck(imei)
+	sts.SensorStuckFields, sts.SensorStuck = stuckFieldNames(stuck, &fieldNames), since
+	if s.cluster != nil {
+		sts.Node = s.cluster.conf.NodeID
+	}
+	if _, ok := s.devStor.ok(imei); ok {
+		sts.Status = "online"
+	} else if _, ok := s.pktStor.online(imei, time.Now().UnixNano(), s.conf.MsgDeadline); ok {
+		sts.Status = "online"
+	} else if s.cluster == nil {
+		sts.Status = "offline"
+	} else if node, _, ok := s.cluster.owner(imei, time.Now().UnixNano()); ok {
+		// device of other node
+		sts.Status = "online"
+		sts.Node = node
+	} else {
+		sts.Status = "offline"
+	}
+	return sts
+}
+
+// deviceProfile returns name of validation profile applied to device (empty if device unknown)
+func (s *Server) deviceProfile(imei string) string {
+	if ds, ok := s.pipe.devs.lookup(imei); ok {
+		return ds.profile.name
 	}
+	return ""
 }
 
 // return device status by IMEI
@@ -225,14 +601,7 @@ func (s *Server) status(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// response status
-	sts := deviceStatus{
-		IMEI: imei,
-	}
-	if _, ok := s.devStor.ok(imei); ok {
-		sts.Status = "online"
-	} else {
-		sts.Status = "offline"
-	}
+	sts := s.deviceStatus(imei)
 
 	// response
 	out, err := json.Marshal(&sts)
@@ -74,6 +74,22 @@ func Test_Server_Stop(t *testing.T) {
 	}
 }
 
+func Test_Server_StopTwice(t *testing.T) {
+
+	// new server init
+	s := New(Config{Addr: testSrvAddr, LoginDeadline: time.Millisecond * 50, MsgDeadline: time.Millisecond * 50}, testOutLog)
+	// start server
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("server start err: %v", err)
+	}
+
+	// repeated stop is no-op
+	s.Stop()
+	s.Stop()
+	s.Wait()
+}
+
 func Test_Server_MultiClient(t *testing.T) {
 
 	// new server init
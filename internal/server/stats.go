@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats runtime statistics of server (counters updated atomically)
+type serverStats struct {
+	start int64
+
+	// accepted connections
+	conns int64
+	// read bytes
+	bytesRead int64
+	// valid, invalid Reading messages
+	readings int64
+	invalid  int64
+
+	// anomalous fields of valid Reading messages
+	anomalies int64
+	// stuck sensor detections, Reading messages of stuck devices suppressed
+	stuck           int64
+	stuckSuppressed int64
+	// position jumps of valid Reading messages
+	jumps int64
+
+	// Reading messages dropped by rate limit, devices disconnected by rate limit
+	rateDropped     int64
+	rateDisconnects int64
+
+	// devices exceeded rate limit
+	mux      sync.Mutex
+	flooders map[string]*flooder
+}
+
+// flooder of stats is forgotten if not exceeded rate limit within ttl
+const flooderTTL = time.Hour
+
+// flooder device exceeded reading rate limit
+type flooder struct {
+	Dropped     int64 `json:"dropped"`
+	Disconnects int64 `json:"disconnects"`
+	// last time of exceeding (unix nano)
+	Last int64 `json:"last"`
+}
+
+// statsResponse /stats response
+type statsResponse struct {
+	Uptime          int64               `json:"uptime"`
+	Goroutines      int                 `json:"goroutines"`
+	DevicesOnline   int                 `json:"devices_online"`
+	Conns           int64               `json:"conns"`
+	BytesRead       int64               `json:"bytes_read"`
+	BytesReadPerSec float64             `json:"bytes_read_per_sec"`
+	Readings        int64               `json:"readings"`
+	Invalid         int64               `json:"invalid"`
+	Anomalies       int64               `json:"anomalies"`
+	Stuck           int64               `json:"stuck"`
+	StuckSuppressed int64               `json:"stuck_suppressed"`
+	Jumps           int64               `json:"jumps"`
+	RateDropped     int64               `json:"rate_dropped"`
+	RateDisconnects int64               `json:"rate_disconnects"`
+	Flooders        map[string]*flooder `json:"flooders"`
+	Webhook         *webhookStats       `json:"webhook,omitempty"`
+	Relay           *relayStats         `json:"relay,omitempty"`
+	ClusterMembers  []clusterMember     `json:"cluster_members,omitempty"`
+}
+
+func newServerStats() *serverStats {
+	st := &serverStats{
+		start:    time.Now().UnixNano(),
+		flooders: make(map[string]*flooder),
+	}
+	return st
+}
+
+// rateLimited counts Reading messages of device dropped by rate limit
+func (st *serverStats) rateLimited(imei string, dropped int64, disconnect bool, now int64) {
+	atomic.AddInt64(&st.rateDropped, dropped)
+	if disconnect {
+		atomic.AddInt64(&st.rateDisconnects, 1)
+	}
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	f, ok := st.flooders[imei]
+	if !ok {
+		f = &flooder{}
+		st.flooders[imei] = f
+	}
+	f.Dropped += dropped
+	if disconnect {
+		f.Disconnects++
+	}
+	f.Last = now
+}
+
+// expireFlooders forgets flooders not exceeded rate limit within ttl before time now
+func (st *serverStats) expireFlooders(now int64) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	for imei, f := range st.flooders {
+		if now-f.Last > int64(flooderTTL) {
+			delete(st.flooders, imei)
+		}
+	}
+}
+
+// snapshot of statistics
+func (st *serverStats) snapshot(now int64) statsResponse {
+	sr := statsResponse{
+		Uptime:          now - st.start,
+		Goroutines:      runtime.NumGoroutine(),
+		Conns:           atomic.LoadInt64(&st.conns),
+		BytesRead:       atomic.LoadInt64(&st.bytesRead),
+		Readings:        atomic.LoadInt64(&st.readings),
+		Invalid:         atomic.LoadInt64(&st.invalid),
+		Anomalies:       atomic.LoadInt64(&st.anomalies),
+		Stuck:           atomic.LoadInt64(&st.stuck),
+		StuckSuppressed: atomic.LoadInt64(&st.stuckSuppressed),
+		Jumps:           atomic.LoadInt64(&st.jumps),
+		RateDropped:     atomic.LoadInt64(&st.rateDropped),
+		RateDisconnects: atomic.LoadInt64(&st.rateDisconnects),
+	}
+	if sr.Uptime > 0 {
+		sr.BytesReadPerSec = float64(sr.BytesRead) / (float64(sr.Uptime) / float64(time.Second))
+	}
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	sr.Flooders = make(map[string]*flooder, len(st.flooders))
+	for imei, f := range st.flooders {
+		fc := *f
+		sr.Flooders[imei] = &fc
+	}
+	return sr
+}
+
+// return runtime statistics of server
+func (s *Server) stats(w http.ResponseWriter, req *http.Request) {
+	sr := s.pipe.stats.snapshot(time.Now().UnixNano())
+	sr.DevicesOnline = s.devStor.count()
+	if s.pipe.webhook != nil {
+		sr.Webhook = s.pipe.webhook.snapshot()
+	}
+	if s.pipe.relay != nil {
+		sr.Relay = s.pipe.relay.snapshot()
+	}
+	if s.cluster != nil {
+		sr.ClusterMembers = s.cluster.members(time.Now().UnixNano())
+	}
+
+	// response
+	out, err := json.Marshal(&sr)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte("500 Internal Server Error")); err != nil {
+			log.Printf("http server: write err: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Printf("http server: write err: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Server_stats(t *testing.T) {
+
+	s := New(Config{}, testOutLog)
+	s.pipe.output(1, "490154203237518", &readingMessage{BattLev: 1}, nil)
+	s.pipe.reading(1, s.pipe.devs.get("490154203237518"), make([]byte, msgLength), &decodedReading{})
+	s.pipe.stats.rateLimited("490154203237518", 3, true, time.Now().UnixNano())
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	sr := statsResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("stats response unmarshal err: %v", err)
+	}
+	if sr.Readings != 1 || sr.Invalid != 1 || sr.RateDropped != 3 || sr.RateDisconnects != 1 {
+		t.Fatalf("wrong stats counters: %+v", sr)
+	}
+	if f := sr.Flooders["490154203237518"]; f == nil || f.Disconnects != 1 {
+		t.Fatalf("flooder not found in stats: %+v", sr)
+	}
+	if sr.Goroutines == 0 {
+		t.Fatalf("stats should report goroutines: %+v", sr)
+	}
+}
+
+func Test_serverStats_expireFlooders(t *testing.T) {
+
+	st := newServerStats()
+	now := time.Now().UnixNano()
+	st.rateLimited("490154203237518", 1, false, now-int64(flooderTTL)-1)
+	st.rateLimited("490154203237526", 1, false, now)
+
+	st.expireFlooders(now)
+	sr := st.snapshot(now)
+	if _, ok := sr.Flooders["490154203237518"]; ok || len(sr.Flooders) != 1 {
+		t.Fatalf("stale flooder should be forgotten: %+v", sr.Flooders)
+	}
+}
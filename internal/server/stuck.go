@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// stuck sensor detection defaults
+const stuckWindow = 10 * time.Minute
+
+// stuck sensor events
+const (
+	stuckDetected  = "stuck"
+	stuckRecovered = "recovered"
+)
+
+// StuckConfig configs of stuck (flat-lined) sensor detection: field of device is stuck if it keeps
+// identical or near-identical value in valid readings for window
+type StuckConfig struct {
+	// window of unchanged values
+	Window time.Duration
+	// max change of near-identical values (identical values if zero)
+	Tolerance float64
+	// checked Reading message fields, e.g. Temp, Alt (all fields if empty)
+	Fields []string
+	// suppress output of device with all checked fields stuck until values change
+	Suppress bool
+}
+
+// stuckDetector stuck sensor detection of devices
+type stuckDetector struct {
+	conf   StuckConfig
+	window int64
+	fields [fieldsNum]bool
+}
+
+// inits stuck sensor detection, unknown fields are ignored
+func newStuckDetector(conf StuckConfig) *stuckDetector {
+	if conf.Window <= 0 {
+		conf.Window = stuckWindow
+	}
+	if conf.Tolerance < 0 {
+		conf.Tolerance = 0
+	}
+	sd := &stuckDetector{conf: conf, window: int64(conf.Window)}
+	for _, name := range conf.Fields {
+		found := false
+		for f, fn := range fieldNames {
+			if fn == name {
+				sd.fields[f], found = true, true
+			}
+		}
+		if !found {
+			log.Printf("stuck sensor, unknown field %v ignored", name)
+		}
+	}
+	if len(conf.Fields) == 0 {
+		for f := range sd.fields {
+			sd.fields[f] = true
+		}
+	}
+	return sd
+}
+
+// devStuck stuck sensor state of device: reference value of field and its time
+type devStuck struct {
+	readings int64
+	ref      [fieldsNum]float64
+	since    [fieldsNum]int64
+	// stuck since time of field (unix nano), not stuck if zero
+	stuck [fieldsNum]int64
+}
+
+// stuckChange stuck state change of field
+type stuckChange struct {
+	field int
+	event string
+	since int64
+}
+
+// stuckEvent stuck sensor field detection or recovery of device (JSON)
+type stuckEvent struct {
+	Time    int64     `json:"time_ns"`
+	IMEI    string    `json:"imei"`
+	Event   string    `json:"event"`
+	Field   string    `json:"field"`
+	Since   int64     `json:"since_ns"`
+	Reading v1Reading `json:"reading"`
+}
+
+// check checks Reading message of device at time now, returns stuck state changes of fields
+func (st *devStuck) check(sd *stuckDetector, now int64, rm *readingMessage) []stuckChange {
+	values := [fieldsNum]float64{fieldTemp: rm.Temp, fieldAlt: rm.Alt, fieldLat: rm.Lat, fieldLon: rm.Lon, fieldBattLev: rm.BattLev}
+	var changes []stuckChange
+	for f, x := range values {
+		if !sd.fields[f] {
+			continue
+		}
+		if st.readings == 0 || math.Abs(x-st.ref[f]) > sd.conf.Tolerance {
+			st.ref[f], st.since[f] = x, now
+		}
+		stuck := now-st.since[f] >= sd.window
+		switch {
+		case stuck && st.stuck[f] == 0:
+			st.stuck[f] = st.since[f]
+			changes = append(changes, stuckChange{field: f, event: stuckDetected, since: st.stuck[f]})
+		case !stuck && st.stuck[f] != 0:
+			changes = append(changes, stuckChange{field: f, event: stuckRecovered, since: st.stuck[f]})
+			st.stuck[f] = 0
+		}
+	}
+	st.readings++
+	return changes
+}
+
+// all returns whether all checked fields are stuck
+func (st *devStuck) all(sd *stuckDetector) bool {
+	for f := range st.stuck {
+		if sd.fields[f] && st.stuck[f] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// state returns stuck fields (Reading message field indexes) and earliest stuck since time (zero if not stuck)
+func (st *devStuck) state() ([]int, int64) {
+	var fields []int
+	var since int64
+	for f, t := range st.stuck {
+		if t == 0 {
+			continue
+		}
+		fields = append(fields, f)
+		if since == 0 || t < since {
+			since = t
+		}
+	}
+	return fields, since
+}
+
+// checkStuck checks valid Reading message of device, logs stuck state changes of fields,
+// returns whether output of message is suppressed (all checked fields stuck)
+func (p *pipeline) checkStuck(now int64, ds *devState, rm *readingMessage) bool {
+	if p.stuck == nil {
+		return false
+	}
+	ds.mux.Lock()
+	changes := ds.stuck.check(p.stuck, now, rm)
+	suppress := p.stuck.conf.Suppress && ds.stuck.all(p.stuck)
+	ds.mux.Unlock()
+
+	if suppress {
+		atomic.AddInt64(&p.stats.stuckSuppressed, 1)
+	}
+	for _, c := range changes {
+		log.Printf("stuck sensor, imei - %v, %v %v", ds.imei, fieldNames[c.field], c.event)
+		if c.event == stuckDetected {
+			atomic.AddInt64(&p.stats.stuck, 1)
+		}
+		if p.stuckLog == nil {
+			continue
+		}
+		out, err := json.Marshal(&stuckEvent{
+			Time: now, IMEI: ds.imei, Event: c.event, Field: v1FieldNames[c.field], Since: c.since, Reading: *newV1Reading(rm),
+		})
+		if err != nil {
+			log.Printf("stuck sensor, imei - %v, marshal err: %v", ds.imei, err)
+			continue
+		}
+		p.stuckLog.Print(string(out))
+	}
+	return suppress
+}
+
+// deviceStuck returns stuck fields (Reading message field indexes) of device and earliest
+// stuck since time (zero if not stuck)
+func (s *Server) deviceStuck(imei string) ([]int, int64) {
+	if s.pipe.stuck == nil {
+		return nil, 0
+	}
+	ds, ok := s.pipe.devs.lookup(imei)
+	if !ok {
+		return nil, 0
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	return ds.stuck.state()
+}
+
+// stuckFieldNames returns names of stuck fields
+func stuckFieldNames(fields []int, names *[fieldsNum]string) []string {
+	var ns []string
+	for _, f := range fields {
+		ns = append(ns, names[f])
+	}
+	return ns
+}
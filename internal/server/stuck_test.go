@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_devStuck_check(t *testing.T) {
+
+	min := int64(time.Minute)
+	start := int64(time.Hour)
+
+	testCases := []struct {
+		name string
+		conf StuckConfig
+		// readings each minute
+		readings func(i int) readingMessage
+		mins     int
+		// expected stuck fields, stuck since minute (not stuck if negative), field events, all fields stuck
+		fields []string
+		since  int
+		events []string
+		all    bool
+	}{
+		// Positive
+		{name: "identical readings", conf: StuckConfig{Window: 10 * time.Minute, Fields: []string{"Temp", "Alt"}},
+			readings: func(i int) readingMessage { return readingMessage{Temp: 20, Alt: 100, BattLev: 50} }, mins: 15,
+			fields: []string{"Temp", "Alt"}, since: 0, events: []string{"Temp stuck", "Alt stuck"}, all: true},
+		{name: "stuck after change", conf: StuckConfig{Window: 10 * time.Minute, Fields: []string{"Temp", "BattLev"}},
+			readings: func(i int) readingMessage {
+				if i < 5 {
+					return readingMessage{Temp: float64(i), BattLev: 50}
+				}
+				return readingMessage{Temp: 5, BattLev: 50}
+			}, mins: 20, fields: []string{"Temp", "BattLev"}, since: 0, events: []string{"BattLev stuck", "Temp stuck"}, all: true},
+		{name: "near-identical within tolerance", conf: StuckConfig{Window: 10 * time.Minute, Tolerance: 0.1, Fields: []string{"Temp"}},
+			readings: func(i int) readingMessage { return readingMessage{Temp: 20 + 0.05*float64(i%2), BattLev: 50} }, mins: 15,
+			fields: []string{"Temp"}, since: 0, events: []string{"Temp stuck"}, all: true},
+		{name: "single field stuck", conf: StuckConfig{Window: 10 * time.Minute, Fields: []string{"Temp", "BattLev"}},
+			readings: func(i int) readingMessage { return readingMessage{Temp: 20, BattLev: 50 - float64(i)} }, mins: 15,
+			fields: []string{"Temp"}, since: 0, events: []string{"Temp stuck"}},
+		{name: "recovered", conf: StuckConfig{Window: 10 * time.Minute, Fields: []string{"Temp"}},
+			readings: func(i int) readingMessage {
+				if i < 12 {
+					return readingMessage{Temp: 20, BattLev: 50}
+				}
+				return readingMessage{Temp: float64(i), BattLev: 50}
+			}, mins: 15, since: -1, events: []string{"Temp stuck", "Temp recovered"}},
+		// Negative
+		{name: "changing field", conf: StuckConfig{Window: 10 * time.Minute, Fields: []string{"BattLev"}},
+			readings: func(i int) readingMessage { return readingMessage{Temp: 20, Alt: 100, BattLev: 50 - float64(i)} }, mins: 15, since: -1},
+		{name: "window not elapsed", conf: StuckConfig{Window: 10 * time.Minute},
+			readings: func(i int) readingMessage { return readingMessage{Temp: 20, BattLev: 50} }, mins: 10, since: -1},
+		{name: "change over tolerance", conf: StuckConfig{Window: 10 * time.Minute, Tolerance: 0.1, Fields: []string{"Temp"}},
+			readings: func(i int) readingMessage { return readingMessage{Temp: 20 + 0.2*float64(i%2), BattLev: 50} }, mins: 15, since: -1},
+	}
+
+	for _, tc := range testCases {
+
+		sd := newStuckDetector(tc.conf)
+		st := &devStuck{}
+		var events []string
+		for i := 0; i < tc.mins; i++ {
+			rm := tc.readings(i)
+			for _, c := range st.check(sd, start+int64(i)*min, &rm) {
+				events = append(events, fieldNames[c.field]+" "+c.event)
+			}
+		}
+		fields, since := st.state()
+		if tc.since < 0 && since != 0 || tc.since >= 0 && since != start+int64(tc.since)*min {
+			t.Fatalf("%v: expected stuck since %v, got %v", tc.name, tc.since, since)
+		}
+		if names := stuckFieldNames(fields, &fieldNames); strings.Join(names, ",") != strings.Join(tc.fields, ",") {
+			t.Fatalf("%v: expected stuck fields %v, got %v", tc.name, tc.fields, names)
+		}
+		if strings.Join(events, ",") != strings.Join(tc.events, ",") {
+			t.Fatalf("%v: expected events %v, got %v", tc.name, tc.events, events)
+		}
+		if st.all(sd) != tc.all {
+			t.Fatalf("%v: expected all fields stuck %v", tc.name, tc.all)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_pipeline_checkStuck(t *testing.T) {
+
+	var out, events bytes.Buffer
+	s := New(Config{
+		Stuck: &StuckConfig{Window: time.Minute, Fields: []string{"Temp", "BattLev"}, Suppress: true}, StuckOut: &events,
+	}, log.New(&out, "", 0))
+	ds := s.pipe.devs.get("490154203237518")
+	now := time.Now().UnixNano()
+	// identical readings each 10s, temperature changed after 200s
+	for i := 0; i <= 20; i++ {
+		rm := readingMessage{Temp: 20, BattLev: 50}
+		if i == 20 {
+			rm.Temp = 21
+		}
+		s.pipe.reading(now+int64(i)*int64(10*time.Second), ds, testFrame(rm), &decodedReading{})
+		if i == 15 {
+			rec := httptest.NewRecorder()
+			s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/devices/490154203237518/status", nil))
+			sts := v1DeviceStatus{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &sts); err != nil || sts.SensorStuckSinceNs != now ||
+				strings.Join(sts.SensorStuckFields, ",") != "temperature_c,battery_pct" {
+				t.Fatalf("device should be flagged stuck, got %s, %v", rec.Body.Bytes(), err)
+			}
+		}
+	}
+
+	// readings 0-5 output, 6-19 suppressed (all fields stuck), 20 output (battery still stuck)
+	if n := strings.Count(out.String(), "\n"); n != 7 {
+		t.Fatalf("expected 7 output records, got %v:\n%v", n, out.String())
+	}
+	sr := s.pipe.stats.snapshot(now)
+	if sr.Stuck != 2 || sr.StuckSuppressed != 14 {
+		t.Fatalf("wrong stuck stats %v, %v", sr.Stuck, sr.StuckSuppressed)
+	}
+	var evs []stuckEvent
+	for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+		e := stuckEvent{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.Since != now {
+			t.Fatalf("wrong stuck event %q, %v", line, err)
+		}
+		evs = append(evs, e)
+	}
+	if len(evs) != 3 || evs[0].Event != stuckDetected || evs[0].Field != "temperature_c" || evs[0].Reading.TemperatureC != 20 ||
+		evs[1].Event != stuckDetected || evs[1].Field != "battery_pct" ||
+		evs[2].Event != stuckRecovered || evs[2].Field != "temperature_c" || evs[2].Reading.TemperatureC != 21 {
+		t.Fatalf("wrong stuck events %q", events.String())
+	}
+	if fields, _ := s.deviceStuck("490154203237518"); len(fields) != 1 || fields[0] != fieldBattLev {
+		t.Fatalf("only battery should stay stuck, got %v", fields)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// max size of udp datagram
+	udpPacketMaxSize = 65535
+)
+
+// pktDevice state of device sending datagrams (no connection)
+type pktDevice struct {
+	// last packet time (unix nano)
+	seen int64
+	// last valid Reading
+	last deviceReadingStatus
+}
+
+// pktStorage storage of devices sending datagrams.
+// Device is online while it sends packets at least every timeout.
+type pktStorage struct {
+	mux     sync.Mutex
+	storage map[string]pktDevice
+}
+
+func newPktStorage() *pktStorage {
+	ps := &pktStorage{
+		storage: make(map[string]pktDevice),
+	}
+	return ps
+}
+
+// seen updates last packet time of device
+func (s *pktStorage) seen(imei string, now int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pd := s.storage[imei]
+	pd.seen = now
+	s.storage[imei] = pd
+}
+
+// setReading sets last valid Reading of device
+func (s *pktStorage) setReading(imei string, last deviceReadingStatus) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pd := s.storage[imei]
+	pd.last = last
+	s.storage[imei] = pd
+}
+
+// online returns device state if device sent packet not later than timeout
+func (s *pktStorage) online(imei string, now int64, timeout time.Duration) (pktDevice, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pd, ok := s.storage[imei]
+	if !ok || now-pd.seen > int64(timeout) {
+		return pktDevice{}, false
+	}
+	return pd, true
+}
+
+// prune deletes devices which did not send packets since before
+func (s *pktStorage) prune(before int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for imei, pd := range s.storage {
+		if pd.seen < before {
+			delete(s.storage, imei)
+		}
+	}
+}
+
+// runUDP reads datagrams from udp listener (IMEI followed by one or more Reading messages)
+func (s *Server) runUDP() error {
+	defer s.wg.Done()
+
+	buf := make([]byte, udpPacketMaxSize)
+	r := decodedReading{}
+	lastPrune := time.Now().UnixNano()
+	for {
+		n, raddr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("udp listener read err: %v", err)
+			return nil
+		}
+		now := time.Now().UnixNano()
+		atomic.AddInt64(&s.pipe.stats.bytesRead, int64(n))
+
+		// drop devices which went offline
+		if now-lastPrune > int64(s.conf.MsgDeadline) {
+			s.pktStor.prune(now - int64(s.conf.MsgDeadline))
+			lastPrune = now
+		}
+
+		s.handlePacket(buf[:n], raddr, now, &r)
+	}
+}
+
+// handlePacket validates datagram and logs its valid Reading messages (datagrams of banned devices dropped)
+func (s *Server) handlePacket(pkt []byte, raddr net.Addr, now int64, r *decodedReading) {
+	if len(pkt) < imeiLength+msgLength || (len(pkt)-imeiLength)%msgLength != 0 {
+		log.Printf("udp packet, raddr - %v, wrong length %v", raddr, len(pkt))
+		return
+	}
+	imei, err := validParseIMEI(pkt[:imeiLength])
+	if err != nil {
+		log.Printf("udp packet, raddr - %v, imei validate err: %v", raddr, err)
+		return
+	}
+	if b, ok := s.pipe.bans.banned(imei, now); ok {
+		log.Printf("udp packet, raddr - %v, imei - %v banned (until %v): %v", raddr, imei, b.Until, b.Reason)
+		return
+	}
+	s.pktStor.seen(imei, now)
+	ds := s.pipe.devs.get(imei)
+
+	for msg := pkt[imeiLength:]; len(msg) >= msgLength; msg = msg[msgLength:] {
+		// parse message, if valid, logging Reading message to stdout
+		ok := s.pipe.reading(now, ds, msg[:msgLength], r)
+		log.Printf("udp device, imei - %v, read message %+v", imei, r.msg)
+		if ok {
+			s.pktStor.setReading(imei, r.status(now))
+		} else {
+			log.Printf("udp device, imei %v, invalid reading message %+v: %v", imei, r.msg, &r.v)
+		}
+	}
+}
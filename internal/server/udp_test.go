@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// udp packet of IMEI and Reading messages
+func testPacket(t *testing.T, imei []byte, msgs ...readingMessage) []byte {
+	var buf bytes.Buffer
+	buf.Write(imei)
+	for _, m := range msgs {
+		if err := binary.Write(&buf, binary.BigEndian, m); err != nil {
+			t.Fatalf("message to bytes converting err: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func Test_Server_handlePacket(t *testing.T) {
+
+	testCases := []struct {
+		name    string
+		pkt     []byte
+		banned  bool
+		records int
+	}{
+		// Positive
+		{
+			name:    "one reading",
+			pkt:     testPacket(t, testIMEI, readingMessage{BattLev: 1}),
+			records: 1,
+		},
+		{
+			name:    "few readings, one invalid",
+			pkt:     testPacket(t, testIMEI, readingMessage{BattLev: 1}, readingMessage{BattLev: 0}, readingMessage{Temp: 7, BattLev: 1}),
+			records: 2,
+		},
+		// Negative
+		{
+			name:    "no readings",
+			pkt:     testPacket(t, testIMEI),
+			records: 0,
+		},
+		{
+			name:    "wrong length",
+			pkt:     append(testPacket(t, testIMEI, readingMessage{BattLev: 1}), 0),
+			records: 0,
+		},
+		{
+			name:    "invalid imei",
+			pkt:     testPacket(t, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 9}, readingMessage{BattLev: 1}),
+			records: 0,
+		},
+		{
+			name:    "banned device",
+			pkt:     testPacket(t, testIMEI, readingMessage{BattLev: 1}),
+			banned:  true,
+			records: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		var out bytes.Buffer
+		s := New(Config{MsgDeadline: time.Second}, log.New(&out, "", 0))
+		if tc.banned {
+			if err := s.pipe.bans.ban("490154203237518", &deviceRestriction{Reason: "test"}); err != nil {
+				t.Fatalf("%v: ban err: %v", tc.name, err)
+			}
+		}
+		r := decodedReading{}
+		s.handlePacket(tc.pkt, nil, 1, &r)
+
+		records := strings.Count(out.String(), "\n")
+		if records != tc.records {
+			t.Fatalf("%v: expected %v records, got %v: %q", tc.name, tc.records, records, out.String())
+		}
+		if _, seen := s.pktStor.online("490154203237518", 1, time.Second); tc.banned && seen {
+			t.Fatalf("%v: banned device should not be seen", tc.name)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_Server_UDP(t *testing.T) {
+
+	testUDPAddr := "127.0.0.1:7376"
+	deadline := time.Millisecond * 100
+
+	// new server init
+	var out bytes.Buffer
+	s := New(Config{Addr: "127.0.0.1:7377", UDPAddr: testUDPAddr, MsgDeadline: deadline}, log.New(&out, "", 0))
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("server start err: %v", err)
+	}
+
+	// send packet
+	conn, err := net.Dial("udp", testUDPAddr)
+	if err != nil {
+		t.Fatalf("client conn err: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(testPacket(t, testIMEI, readingMessage{Temp: 7.3, BattLev: 1}))
+	if err != nil {
+		t.Fatalf("client conn write packet err: %v", err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	// device online while sending packets
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readings/490154203237518", nil))
+	drs := deviceReadingStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &drs); err != nil {
+		t.Fatalf("readings response unmarshal err: %v", err)
+	}
+	if drs.Status != "online" || drs.Reading.Temp != 7.3 {
+		t.Fatalf("udp device should be online with last reading, got %+v", drs)
+	}
+
+	// device offline after deadline
+	time.Sleep(deadline * 2)
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status/490154203237518", nil))
+	sts := deviceStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &sts); err != nil {
+		t.Fatalf("status response unmarshal err: %v", err)
+	}
+	if sts.Status != "offline" {
+		t.Fatalf("udp device should be offline, got %+v", sts)
+	}
+
+	// stop server
+	s.Stop()
+	s.Wait()
+
+	if !strings.Contains(out.String(), ",490154203237518,7.300000,") {
+		t.Fatalf("reading record not found in output: %q", out.String())
+	}
+}
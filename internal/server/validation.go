@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// Reading message fields
+const (
+	fieldTemp = iota
+	fieldAlt
+	fieldLat
+	fieldLon
+	fieldBattLev
+	fieldsNum
+)
+
+// Reading message field names
+var fieldNames = [fieldsNum]string{"Temp", "Alt", "Lat", "Lon", "BattLev"}
+
+// invalidReason reason of invalid Reading message field
+type invalidReason uint8
+
+// invalid reasons
+const (
+	reasonNone invalidReason = iota
+	reasonBelowMin
+	reasonAboveMax
+	reasonNaN
+	reasonPosInf
+	reasonNegInf
+	reasonSubnormal
+	reasonNegZero
+	reasonJump
+	reasonsNum
+)
+
+// invalid reason names
+var reasonNames = [reasonsNum]string{
+	"", "below min", "above max", "NaN", "+Inf", "-Inf", "subnormal", "negative zero", "position jump",
+}
+
+func (r invalidReason) String() string {
+	return reasonNames[r]
+}
+
+// floatChecks optional checks of float classification
+type floatChecks uint8
+
+// optional float checks
+const (
+	// reject subnormal (denormalized) numbers
+	checkSubnormal floatChecks = 1 << iota
+	// reject negative zero
+	checkNegZero
+)
+
+// classifyFloat64 returns reason if float is not finite (always checked)
+// or is subnormal, negative zero (if checks set)
+func classifyFloat64(f float64, checks floatChecks) invalidReason {
+	bits := math.Float64bits(f)
+	exp := bits >> 52 & 0x7ff
+	frac := bits & (1<<52 - 1)
+	switch {
+	case exp == 0x7ff && frac != 0:
+		return reasonNaN
+	case exp == 0x7ff && bits>>63 == 0:
+		return reasonPosInf
+	case exp == 0x7ff:
+		return reasonNegInf
+	case checks&checkSubnormal != 0 && exp == 0 && frac != 0:
+		return reasonSubnormal
+	case checks&checkNegZero != 0 && bits == 1<<63:
+		return reasonNegZero
+	}
+	return reasonNone
+}
+
+// fieldLimit range of valid field values
+type fieldLimit struct {
+	min, max     float64
+	minInclusive bool
+	maxInclusive bool
+}
+
+// Reading message limits by spec
+var readingLimits = [fieldsNum]fieldLimit{
+	fieldTemp:    {min: -300, max: 300, minInclusive: true, maxInclusive: true},
+	fieldAlt:     {min: -20_000, max: 20_000, minInclusive: true, maxInclusive: true},
+	fieldLat:     {min: -90, max: 90, minInclusive: true, maxInclusive: true},
+	fieldLon:     {min: -180, max: 180, minInclusive: true, maxInclusive: true},
+	fieldBattLev: {min: 0, max: 100, minInclusive: false, maxInclusive: true},
+}
+
+// check returns reason if value is not finite or is out of range
+func (l fieldLimit) check(v float64) invalidReason {
+	if r := classifyFloat64(v, 0); r != reasonNone {
+		return r
+	}
+	if l.maxInclusive && v > l.max {
+		return reasonAboveMax
+	} else if !l.maxInclusive && v >= l.max {
+		return reasonAboveMax
+	}
+	if l.minInclusive && v < l.min {
+		return reasonBelowMin
+	} else if !l.minInclusive && v <= l.min {
+		return reasonBelowMin
+	}
+	return reasonNone
+}
+
+// validation result of Reading message, invalid reason of each field
+type validation [fieldsNum]invalidReason
+
+// ok if all fields valid
+func (v *validation) ok() bool {
+	for _, r := range v {
+		if r != reasonNone {
+			return false
+		}
+	}
+	return true
+}
+
+// String invalid fields and reasons, e.g. "Temp: above max;BattLev: below min"
+func (v *validation) String() string {
+	var sb strings.Builder
+	for f, r := range v {
+		if r == reasonNone {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(';')
+		}
+		sb.WriteString(fieldNames[f])
+		sb.WriteString(": ")
+		sb.WriteString(r.String())
+	}
+	return sb.String()
+}
+
+// messageBytes encodes Reading message to its 40-bytes binary form
+func messageBytes(rm *readingMessage, b []byte) {
+	// panic if len less then message length
+	_ = b[msgLength-1]
+	//
+	binary.BigEndian.PutUint64(b[:8], math.Float64bits(rm.Temp))
+	binary.BigEndian.PutUint64(b[8:16], math.Float64bits(rm.Alt))
+	binary.BigEndian.PutUint64(b[16:24], math.Float64bits(rm.Lat))
+	binary.BigEndian.PutUint64(b[24:32], math.Float64bits(rm.Lon))
+	binary.BigEndian.PutUint64(b[32:40], math.Float64bits(rm.BattLev))
+}
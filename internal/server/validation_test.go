@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func Test_readingMessage_validate(t *testing.T) {
+
+	testCases := []struct {
+		name    string
+		msg     readingMessage
+		reasons string
+	}{
+		// Positive
+		{
+			name:    "valid message",
+			msg:     readingMessage{Temp: 300, Alt: -20000, Lat: 90, Lon: -180, BattLev: 100},
+			reasons: "",
+		},
+		// Negative
+		{
+			name:    "temp above max",
+			msg:     readingMessage{Temp: 300.1, BattLev: 1},
+			reasons: "Temp: above max",
+		},
+		{
+			name:    "few invalid fields",
+			msg:     readingMessage{Alt: -20001, Lon: 181, BattLev: 0},
+			reasons: "Alt: below min;Lon: above max;BattLev: below min",
+		},
+	}
+
+	for _, tc := range testCases {
+
+		v := validation{}
+		ok := tc.msg.validate(&readingLimits, &v)
+		if ok != (tc.reasons == "") {
+			t.Fatalf("%v: message %+v, unexpected validation result %v", tc.name, tc.msg, ok)
+		}
+		if v.String() != tc.reasons {
+			t.Fatalf("%v: expected reasons %q, got %q", tc.name, tc.reasons, v.String())
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+// Reading message binary form
+func testFrame(rm readingMessage) []byte {
+	b := make([]byte, msgLength)
+	messageBytes(&rm, b)
+	return b
+}
+
+func Test_messageBytes(t *testing.T) {
+
+	rm := readingMessage{Temp: 67.77, Alt: 2.63555, Lat: 33.41, Lon: 44.4, BattLev: 0.25666}
+	b := make([]byte, msgLength)
+	messageBytes(&rm, b)
+	prm := readingMessage{}
+	parseMessage(b, &prm)
+	if prm != rm {
+		t.Fatalf("orig message %+v and parsed %+v not equal", rm, prm)
+	}
+}
+
+func Test_Device_InvalidRatio(t *testing.T) {
+
+	srvConn, clnConn := net.Pipe()
+	var quar bytes.Buffer
+	p := newPipeline(testOutLog, newServerStats())
+	p.quarLog = log.New(&quar, "", 0)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	conf := devConfig{
+		loginDeadline: time.Second, messageDeadline: time.Second,
+		invalidRatio: 0.5, invalidMinMessages: 4,
+	}
+	d := newDevice(conf, srvConn, p, &wg, make(chan struct{}, 1), newDevStorage())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.run()
+	}()
+
+	// send login and invalid messages (zero battery level)
+	if _, err := clnConn.Write(testIMEI); err != nil {
+		t.Fatalf("client conn write imei err: %v", err)
+	}
+	msg := make([]byte, msgLength)
+	sent := 0
+	for i := 0; i < 10; i++ {
+		if _, err := clnConn.Write(msg); err != nil {
+			break
+		}
+		sent++
+	}
+	clnConn.Close()
+
+	if err := <-errs; err != errInvalidRatio {
+		t.Fatalf("expected err %v, got %v", errInvalidRatio, err)
+	}
+	if sent != 4 {
+		t.Fatalf("device should be disconnected after %v messages, sent %v", 4, sent)
+	}
+
+	// quarantine records
+	records := strings.Split(strings.TrimSpace(quar.String()), "\n")
+	if len(records) != 4 {
+		t.Fatalf("expected %v quarantine records, got %q", 4, quar.String())
+	}
+	if !strings.HasSuffix(records[0], ",490154203237518,"+strings.Repeat("00", msgLength)+",BattLev: below min") {
+		t.Fatalf("wrong quarantine record %q", records[0])
+	}
+
+	// device counters
+	dv := (&Server{pipe: p}).deviceValidation("490154203237518")
+	if dv.Invalid != 4 || dv.InvalidRatio != 1 || dv.Fields["BattLev"]["below min"] != 4 {
+		t.Fatalf("wrong device validation counters %+v", dv)
+	}
+}
+
+func Test_classifyFloat64(t *testing.T) {
+
+	all := checkSubnormal | checkNegZero
+	testCases := []struct {
+		name   string
+		f      float64
+		checks floatChecks
+		reason invalidReason
+	}{
+		// Positive
+		{name: "zero", f: 0, checks: all, reason: reasonNone},
+		{name: "normal", f: -67.77, checks: all, reason: reasonNone},
+		{name: "smallest normal", f: 0x1p-1022, checks: all, reason: reasonNone},
+		{name: "max float", f: math.MaxFloat64, checks: all, reason: reasonNone},
+		{name: "subnormal, not checked", f: math.SmallestNonzeroFloat64, checks: 0, reason: reasonNone},
+		{name: "negative zero, not checked", f: math.Copysign(0, -1), checks: 0, reason: reasonNone},
+		// Negative
+		{name: "NaN", f: math.NaN(), checks: 0, reason: reasonNaN},
+		{name: "negative NaN", f: math.Float64frombits(0xfff8000000000001), checks: 0, reason: reasonNaN},
+		{name: "signaling NaN", f: math.Float64frombits(0x7ff0000000000001), checks: 0, reason: reasonNaN},
+		{name: "+Inf", f: math.Inf(1), checks: 0, reason: reasonPosInf},
+		{name: "-Inf", f: math.Inf(-1), checks: 0, reason: reasonNegInf},
+		{name: "subnormal", f: math.SmallestNonzeroFloat64, checks: all, reason: reasonSubnormal},
+		{name: "negative subnormal", f: -0x1p-1023, checks: all, reason: reasonSubnormal},
+		{name: "negative zero", f: math.Copysign(0, -1), checks: all, reason: reasonNegZero},
+	}
+
+	for _, tc := range testCases {
+
+		r := classifyFloat64(tc.f, tc.checks)
+		if r != tc.reason {
+			t.Fatalf("%v: expected reason %q, got %q", tc.name, tc.reason, r)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+// special float bit patterns
+var testSpecialFloats = []uint64{
+	0x7ff8000000000000, // NaN
+	0xfff8000000000000, // negative NaN
+	0x7ff0000000000001, // signaling NaN
+	0x7fffffffffffffff, // NaN, max payload
+	0x7ff0000000000000, // +Inf
+	0xfff0000000000000, // -Inf
+	0x0000000000000001, // smallest subnormal
+	0x800fffffffffffff, // negative subnormal
+	0x8000000000000000, // negative zero
+	0x0000000000000000, // zero
+	0x3ff0000000000000, // 1
+}
+
+// checkDecodedMessage fails if invalid float of Reading message passed validation
+func checkDecodedMessage(frame [msgLength]byte, checks floatChecks) bool {
+	rm := readingMessage{}
+	v := validation{}
+	decodeMessage(frame[:], &rm, checks, &v)
+	if !rm.validate(&readingLimits, &v) {
+		return true
+	}
+	for f, x := range [fieldsNum]float64{rm.Temp, rm.Alt, rm.Lat, rm.Lon, rm.BattLev} {
+		if math.IsNaN(x) || math.IsInf(x, 0) || x < readingLimits[f].min || x > readingLimits[f].max {
+			return false
+		}
+		if checks&checkNegZero != 0 && x == 0 && math.Signbit(x) {
+			return false
+		}
+		if checks&checkSubnormal != 0 && x != 0 && math.Abs(x) < 0x1p-1022 {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_decodeMessage_Fuzz(t *testing.T) {
+
+	// arbitrary 40-bytes frames
+	conf := &quick.Config{MaxCount: 100000}
+	for _, checks := range []floatChecks{0, checkSubnormal | checkNegZero} {
+		f := func(frame [msgLength]byte) bool {
+			return checkDecodedMessage(frame, checks)
+		}
+		if err := quick.Check(f, conf); err != nil {
+			t.Fatalf("checks %b: invalid message passed validation: %v", checks, err)
+		}
+	}
+
+	// frames of valid floats mixed with special floats
+	rnd := rand.New(rand.NewSource(73))
+	for i := 0; i < 100000; i++ {
+		var frame [msgLength]byte
+		for f := 0; f < fieldsNum; f++ {
+			bits := math.Float64bits(rnd.Float64())
+			if rnd.Intn(2) == 0 {
+				bits = testSpecialFloats[rnd.Intn(len(testSpecialFloats))]
+			}
+			binary.BigEndian.PutUint64(frame[f*8:], bits)
+		}
+		if !checkDecodedMessage(frame, checkSubnormal|checkNegZero) {
+			t.Fatalf("invalid message passed validation: %x", frame)
+		}
+	}
+}
+
+func Test_pipeline_reading_NonFinite(t *testing.T) {
+
+	var out, quar bytes.Buffer
+	p := newPipeline(log.New(&out, "", 0), newServerStats())
+	p.quarLog = log.New(&quar, "", 0)
+	p.checks = checkSubnormal | checkNegZero
+	ds := p.devs.get("490154203237518")
+
+	for _, bits := range testSpecialFloats[:9] {
+		frame := testFrame(readingMessage{BattLev: 1})
+		binary.BigEndian.PutUint64(frame, bits)
+		if p.reading(1, ds, frame, &decodedReading{}) {
+			t.Fatalf("message with temp %x should be invalid", bits)
+		}
+	}
+	if out.Len() != 0 {
+		t.Fatalf("invalid messages logged to output: %q", out.String())
+	}
+	for _, reason := range []string{"Temp: NaN", "Temp: +Inf", "Temp: -Inf", "Temp: subnormal", "Temp: negative zero"} {
+		if !strings.Contains(quar.String(), reason) {
+			t.Fatalf("reason %q not found in quarantine: %q", reason, quar.String())
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// webhook defaults
+const (
+	webhookBatchSize     = 100
+	webhookBatchInterval = time.Second
+	webhookBackoff       = time.Second
+	webhookMaxBackoff    = time.Minute
+	webhookTimeout       = time.Second * 10
+	webhookMaxSpool      = 10000
+	// max batches queued to spool by sender (oldest dropped)
+	webhookMaxQueued = 1000
+)
+
+// header of HMAC-SHA256 signature of webhook batch body, "sha256=<hex>"
+const webhookSignatureHeader = "X-Signature-256"
+
+// WebhookConfig configs of webhook output of valid readings,
+// batches are spooled to disk and POSTed in order (body of /ingest JSON format)
+type WebhookConfig struct {
+	// endpoint URL and extra request headers
+	URL     string
+	Headers map[string]string
+	// HMAC-SHA256 secret of body signature (not signed if empty)
+	Secret string
+
+	// batch max readings and flush interval of not full batch
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// delivery attempts of batch before dead letter (retried until delivered if zero),
+	// exponential retry backoff (initial, max)
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// request timeout
+	Timeout time.Duration
+
+	// spool directory of batches pending delivery (kept on restart), max spooled batches
+	// (oldest dropped), dead letter directory of failed batches (SpoolDir/dead if empty)
+	SpoolDir      string
+	MaxSpool      int
+	DeadLetterDir string
+}
+
+// webhookStats delivery statistics of webhook (JSON)
+type webhookStats struct {
+	Delivered  int64  `json:"delivered"`
+	Readings   int64  `json:"readings"`
+	Failures   int64  `json:"failures"`
+	DeadLetter int64  `json:"dead_letter"`
+	Spooled    int64  `json:"spooled"`
+	Dropped    int64  `json:"dropped"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// webhook batches valid readings, sender spools batches to disk and delivers spooled batches to endpoint
+type webhook struct {
+	conf   WebhookConfig
+	client *http.Client
+
+	// current batch, full batches queued to spool
+	mux   sync.Mutex
+	batch []ingestReading
+	queue [][]ingestReading
+	// sequence of spool file names (used by sender)
+	seq int64
+
+	// signal of queued batch
+	kick chan struct{}
+
+	// statistics (counters updated atomically)
+	delivered  int64
+	readings   int64
+	failures   int64
+	deadLetter int64
+	spooled    int64
+	dropped    int64
+	lastErr    atomic.Value
+}
+
+// inits webhook, creates spool and dead letter directories, counts already spooled batches
+func newWebhook(conf WebhookConfig) (*webhook, error) {
+	if conf.URL == "" || conf.SpoolDir == "" {
+		return nil, errors.New("webhook: url and spool dir required")
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = webhookBatchSize
+	}
+	if conf.BatchInterval <= 0 {
+		conf.BatchInterval = webhookBatchInterval
+	}
+	if conf.MaxAttempts < 0 {
+		conf.MaxAttempts = 0
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = webhookBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = webhookMaxBackoff
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = webhookTimeout
+	}
+	if conf.MaxSpool <= 0 {
+		conf.MaxSpool = webhookMaxSpool
+	}
+	if conf.DeadLetterDir == "" {
+		conf.DeadLetterDir = filepath.Join(conf.SpoolDir, "dead")
+	}
+	for _, dir := range []string{conf.SpoolDir, conf.DeadLetterDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	wh := &webhook{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout},
+		kick:   make(chan struct{}, 1),
+	}
+	files, err := wh.spooledFiles()
+	if err != nil {
+		return nil, err
+	}
+	wh.spooled = int64(len(files))
+	return wh, nil
+}
+
+// add adds valid Reading message of device to batch, queues full batch to spool by sender
+func (wh *webhook) add(now int64, imei string, rm *readingMessage) {
+	wh.mux.Lock()
+	wh.batch = append(wh.batch, ingestReading{IMEI: imei, Time: now, Reading: *rm})
+	full := len(wh.batch) >= wh.conf.BatchSize
+	if full {
+		wh.queueBatch()
+	}
+	wh.mux.Unlock()
+	if full {
+		select {
+		case wh.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// queueBatch queues batch to spool, oldest queued batch dropped over max queued batches (should be used under lock)
+func (wh *webhook) queueBatch() {
+	if len(wh.queue) >= webhookMaxQueued {
+		log.Printf("webhook, spool queue full, batch of %v readings dropped", len(wh.queue[0]))
+		atomic.AddInt64(&wh.dropped, 1)
+		wh.queue = wh.queue[1:]
+	}
+	wh.queue = append(wh.queue, wh.batch)
+	wh.batch = nil
+}
+
+// flush queues not empty batch, spools queued batches (used by sender)
+func (wh *webhook) flush() {
+	wh.mux.Lock()
+	if len(wh.batch) > 0 {
+		wh.queueBatch()
+	}
+	wh.mux.Unlock()
+	wh.spoolQueued()
+}
+
+// spoolQueued spools queued batches (used by sender)
+func (wh *webhook) spoolQueued() {
+	wh.mux.Lock()
+	queue := wh.queue
+	wh.queue = nil
+	wh.mux.Unlock()
+	for _, batch := range queue {
+		wh.spoolBatch(batch)
+	}
+}
+
+// spoolBatch writes batch to spool file named by server time and sequence,
+// oldest spooled batches dropped over max spooled batches (used by sender)
+func (wh *webhook) spoolBatch(batch []ingestReading) {
+	body, err := json.Marshal(&ingestRequest{Readings: batch})
+	if err != nil {
+		log.Printf("webhook, batch marshal err: %v", err)
+		return
+	}
+	if atomic.LoadInt64(&wh.spooled) >= int64(wh.conf.MaxSpool) {
+		wh.dropSpooled(int(atomic.LoadInt64(&wh.spooled)) - wh.conf.MaxSpool + 1)
+	}
+	// names ordered by spool time
+	wh.seq++
+	path := filepath.Join(wh.conf.SpoolDir, fmt.Sprintf("batch-%020d-%010d.json", time.Now().UnixNano(), wh.seq))
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		log.Printf("webhook, batch of %v readings spool err: %v", len(batch), err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("webhook, batch of %v readings spool err: %v", len(batch), err)
+		return
+	}
+	atomic.AddInt64(&wh.spooled, 1)
+}
+
+// dropSpooled removes n oldest spooled batches
+func (wh *webhook) dropSpooled(n int) {
+	files, err := wh.spooledFiles()
+	if err != nil {
+		log.Printf("webhook, spooled batches list err: %v", err)
+		return
+	}
+	for i := 0; i < n && i < len(files); i++ {
+		if err := os.Remove(files[i]); err != nil {
+			log.Printf("webhook, spooled batch remove err: %v", err)
+			continue
+		}
+		log.Printf("webhook, spool full, batch %v dropped", filepath.Base(files[i]))
+		atomic.AddInt64(&wh.spooled, -1)
+		atomic.AddInt64(&wh.dropped, 1)
+	}
+}
+
+// spooledFiles returns spooled batches, oldest first
+func (wh *webhook) spooledFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(wh.conf.SpoolDir, "batch-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// run (sender) spools queued batches, flushes batch by interval and delivers spooled batches
+// until done (batch flushed on done)
+func (wh *webhook) run(done <-chan struct{}) {
+	t := time.NewTicker(wh.conf.BatchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			wh.flush()
+			return
+		case <-t.C:
+			wh.flush()
+		case <-wh.kick:
+			wh.spoolQueued()
+		}
+		if !wh.deliverSpooled(done) {
+			wh.flush()
+			return
+		}
+	}
+}
+
+// deliverSpooled delivers spooled batches in order, retries failed batch with backoff,
+// moves batch to dead letter after max attempts or on rejection, returns false if done
+func (wh *webhook) deliverSpooled(done <-chan struct{}) bool {
+	files, err := wh.spooledFiles()
+	if err != nil {
+		log.Printf("webhook, spooled batches list err: %v", err)
+		return true
+	}
+	for _, path := range files {
+		for attempt := 1; ; attempt++ {
+			retry, err := wh.deliver(path)
+			if err == nil || os.IsNotExist(err) {
+				// delivered or dropped from full spool
+				break
+			}
+			atomic.AddInt64(&wh.failures, 1)
+			wh.lastErr.Store(err.Error())
+			log.Printf("webhook, batch %v delivery attempt %v err: %v", filepath.Base(path), attempt, err)
+			if !retry || (wh.conf.MaxAttempts > 0 && attempt >= wh.conf.MaxAttempts) {
+				wh.toDeadLetter(path)
+				break
+			}
+			// queued batches spooled during backoff
+			wait := time.After(wh.backoff(attempt))
+			for waiting := true; waiting; {
+				select {
+				case <-done:
+					return false
+				case <-wh.kick:
+					wh.spoolQueued()
+				case <-wait:
+					waiting = false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// backoff returns retry delay after failed attempt (doubled each attempt, limited by max backoff)
+func (wh *webhook) backoff(attempt int) time.Duration {
+	d := wh.conf.Backoff
+	for i := 1; i < attempt && d < wh.conf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > wh.conf.MaxBackoff {
+		d = wh.conf.MaxBackoff
+	}
+	return d
+}
+
+// deliver POSTs spooled batch, removes it on success,
+// returns whether failed delivery should be retried (network errors, 5xx, 429)
+func (wh *webhook) deliver(path string) (bool, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	batch := struct {
+		Readings []json.RawMessage `json:"readings"`
+	}{}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, wh.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range wh.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	if wh.conf.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(wh.conf.Secret, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		log.Printf("webhook, response read err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, errors.New("webhook: response status " + resp.Status)
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Printf("webhook, delivered batch remove err: %v", err)
+	}
+	atomic.AddInt64(&wh.spooled, -1)
+	atomic.AddInt64(&wh.delivered, 1)
+	atomic.AddInt64(&wh.readings, int64(len(batch.Readings)))
+	return false, nil
+}
+
+// toDeadLetter moves failed batch to dead letter directory
+func (wh *webhook) toDeadLetter(path string) {
+	dead := filepath.Join(wh.conf.DeadLetterDir, filepath.Base(path))
+	if err := os.Rename(path, dead); err != nil {
+		log.Printf("webhook, batch %v dead letter err: %v", filepath.Base(path), err)
+		return
+	}
+	atomic.AddInt64(&wh.spooled, -1)
+	atomic.AddInt64(&wh.deadLetter, 1)
+}
+
+// webhookSignature returns HMAC-SHA256 signature of body, "sha256=<hex>"
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// snapshot of webhook statistics
+func (wh *webhook) snapshot() *webhookStats {
+	ws := &webhookStats{
+		Delivered:  atomic.LoadInt64(&wh.delivered),
+		Readings:   atomic.LoadInt64(&wh.readings),
+		Failures:   atomic.LoadInt64(&wh.failures),
+		DeadLetter: atomic.LoadInt64(&wh.deadLetter),
+		Spooled:    atomic.LoadInt64(&wh.spooled),
+		Dropped:    atomic.LoadInt64(&wh.dropped),
+	}
+	if err, ok := wh.lastErr.Load().(string); ok {
+		ws.LastError = err
+	}
+	return ws
+}
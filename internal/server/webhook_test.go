@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookEndpoint webhook stand-in, responds with statuses in order (200 after),
+// keeps accepted batches
+type testWebhookEndpoint struct {
+	mux      sync.Mutex
+	statuses []int
+	batches  []ingestRequest
+	errs     []string
+}
+
+func (te *testWebhookEndpoint) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	te.mux.Lock()
+	defer te.mux.Unlock()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		te.errs = append(te.errs, err.Error())
+	}
+	if sig := req.Header.Get(webhookSignatureHeader); sig != webhookSignature("secret", body) {
+		te.errs = append(te.errs, "wrong signature "+sig)
+	}
+	if req.Header.Get("X-Farm") != "1" || req.Header.Get("Content-Type") != "application/json" {
+		te.errs = append(te.errs, "wrong headers")
+	}
+	if len(te.statuses) > 0 {
+		status := te.statuses[0]
+		te.statuses = te.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	ir := ingestRequest{}
+	if err := json.Unmarshal(body, &ir); err != nil {
+		te.errs = append(te.errs, err.Error())
+	}
+	te.batches = append(te.batches, ir)
+}
+
+func Test_webhook_run(t *testing.T) {
+
+	testCases := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int
+		readings    int
+		// expected delivered batches, dead letter batches, failures
+		delivered  int
+		deadLetter int
+		failures   int64
+	}{
+		// Positive
+		{name: "delivery", readings: 5, delivered: 3},
+		{name: "endpoint down, retries", statuses: []int{503, 502, 429}, readings: 2, delivered: 1, failures: 3},
+		// Negative
+		{name: "rejected batch", statuses: []int{400}, readings: 4, delivered: 1, deadLetter: 1, failures: 1},
+		{name: "max attempts", statuses: []int{500, 500}, maxAttempts: 2, readings: 2, deadLetter: 1, failures: 2},
+	}
+
+	for _, tc := range testCases {
+
+		dir, err := ioutil.TempDir("", "webhook")
+		if err != nil {
+			t.Fatalf("%v: temp dir err: %v", tc.name, err)
+		}
+		defer os.RemoveAll(dir)
+		te := &testWebhookEndpoint{statuses: tc.statuses}
+		ts := httptest.NewServer(te)
+		defer ts.Close()
+
+		wh, err := newWebhook(WebhookConfig{
+			URL: ts.URL, Headers: map[string]string{"X-Farm": "1"}, Secret: "secret",
+			BatchSize: 2, BatchInterval: time.Millisecond * 10, MaxAttempts: tc.maxAttempts,
+			Backoff: time.Millisecond, MaxBackoff: time.Millisecond * 4, SpoolDir: dir,
+		})
+		if err != nil {
+			t.Fatalf("%v: new webhook err: %v", tc.name, err)
+		}
+		// full batches queued before delivery, spooled by sender
+		for i := 0; i < tc.readings; i++ {
+			wh.add(int64(i+1), "490154203237518", &readingMessage{Temp: float64(i)})
+		}
+		if files, _ := wh.spooledFiles(); len(wh.queue) != tc.readings/2 || len(files) != 0 {
+			t.Fatalf("%v: expected %v queued batches, got %v, spooled %v", tc.name, tc.readings/2, len(wh.queue), files)
+		}
+
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			wh.run(done)
+			close(finished)
+		}()
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			ws := wh.snapshot()
+			if int(ws.Delivered) == tc.delivered && int(ws.DeadLetter) == tc.deadLetter && ws.Spooled == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: delivery timeout, stats %+v", tc.name, ws)
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		close(done)
+		<-finished
+
+		te.mux.Lock()
+		if len(te.errs) > 0 {
+			t.Fatalf("%v: endpoint errs %v", tc.name, te.errs)
+		}
+		readings := 0
+		var last int64
+		for _, b := range te.batches {
+			for _, ir := range b.Readings {
+				if ir.Time <= last || ir.IMEI != "490154203237518" {
+					t.Fatalf("%v: readings should be delivered in order, got %+v", tc.name, te.batches)
+				}
+				last = ir.Time
+				readings++
+			}
+		}
+		te.mux.Unlock()
+		ws := wh.snapshot()
+		if ws.Failures != tc.failures || ws.Readings != int64(readings) || (tc.failures > 0) != (ws.LastError != "") {
+			t.Fatalf("%v: wrong stats %+v", tc.name, ws)
+		}
+		dead, _ := filepath.Glob(filepath.Join(dir, "dead", "batch-*.json"))
+		if len(dead) != tc.deadLetter {
+			t.Fatalf("%v: expected %v dead letter batches, got %v", tc.name, tc.deadLetter, dead)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_webhook_spool(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatalf("temp dir err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := newWebhook(WebhookConfig{URL: "http://127.0.0.1:1"}); err == nil {
+		t.Fatalf("spool dir should be required")
+	}
+
+	// spooled batches kept on restart
+	conf := WebhookConfig{URL: "http://127.0.0.1:1", BatchSize: 10, SpoolDir: dir}
+	wh, err := newWebhook(conf)
+	if err != nil {
+		t.Fatalf("new webhook err: %v", err)
+	}
+	p := newPipeline(testOutLog, newServerStats())
+	p.webhook = wh
+	ds := p.devs.get("490154203237518")
+	p.reading(1, ds, testFrame(readingMessage{Temp: 1, BattLev: 1}), &decodedReading{})
+	p.reading(2, ds, testFrame(readingMessage{Temp: 1000, BattLev: 1}), &decodedReading{})
+	wh.flush()
+
+	wh, err = newWebhook(conf)
+	if err != nil {
+		t.Fatalf("new webhook err: %v", err)
+	}
+	files, _ := wh.spooledFiles()
+	if wh.snapshot().Spooled != 1 || len(files) != 1 {
+		t.Fatalf("expected spooled batch, got %v", files)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("spooled batch read err: %v", err)
+	}
+	ir := ingestRequest{}
+	if err := json.Unmarshal(b, &ir); err != nil || len(ir.Readings) != 1 || ir.Readings[0].Reading.Temp != 1 {
+		t.Fatalf("spooled batch should have valid reading, got %s, %v", b, err)
+	}
+
+	// spool bounded, oldest batches dropped
+	wh.conf.MaxSpool = 2
+	for i := int64(10); i < 12; i++ {
+		wh.add(i, "490154203237518", &readingMessage{Temp: float64(i)})
+		wh.flush()
+	}
+	files, _ = wh.spooledFiles()
+	if ws := wh.snapshot(); ws.Spooled != 2 || ws.Dropped != 1 || len(files) != 2 {
+		t.Fatalf("expected 2 spooled batches and 1 dropped, got %+v, %v", ws, files)
+	}
+	if b, err := ioutil.ReadFile(files[0]); err != nil || json.Unmarshal(b, &ir) != nil || ir.Readings[0].Time != 10 {
+		t.Fatalf("oldest spooled batch should be dropped, got %s, %v", b, err)
+	}
+
+	// backoff
+	wh.conf.Backoff, wh.conf.MaxBackoff = time.Second, time.Second*5
+	for attempt, exp := range []time.Duration{0, time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5} {
+		if attempt > 0 && wh.backoff(attempt) != exp {
+			t.Fatalf("attempt %v: expected backoff %v, got %v", attempt, exp, wh.backoff(attempt))
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// errMovementField field is not movement field (influx record)
+var errMovementField = errors.New("record: not movement field")
+
+// Decoder reads records of format from input stream
+type Decoder struct {
+	r *bufio.Reader
+	f Format
+}
+
+// NewDecoder inits decoder of records of format from r
+func NewDecoder(r io.Reader, f Format) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), f: f}
+}
+
+// Decode reads next record to rec, returns io.EOF at end of input,
+// io.ErrUnexpectedEOF if input ends within record
+func (d *Decoder) Decode(rec *Record) error {
+	if d.f == Binary {
+		return d.decodeBinary(rec)
+	}
+	line, err := d.r.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	line = line[:len(line)-1]
+	switch d.f {
+	case CSV:
+		return ParseCSV(line, rec)
+	case NDJSON:
+		return ParseNDJSON(line, rec)
+	case Influx:
+		return ParseInflux(line, rec)
+	}
+	return errors.New("record: unknown format " + d.f.String())
+}
+
+// decodeBinary reads length-prefixed binary record (payload bytes over BinaryMovementLength skipped)
+func (d *Decoder) decodeBinary(rec *Record) error {
+	var b [2 + BinaryMovementLength]byte
+	if _, err := io.ReadFull(d.r, b[:2]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(b[:2]))
+	if n < BinaryLength {
+		return errors.New("record: wrong binary record length " + strconv.Itoa(n))
+	}
+	m := BinaryLength
+	if n >= BinaryMovementLength {
+		m = BinaryMovementLength
+	}
+	if _, err := io.ReadFull(d.r, b[2:2+m]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if _, err := d.r.Discard(n - m); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return ParseBinary(b[2:2+m], rec)
+}
+
+// ParseBinary parses binary record payload (without length prefix) to rec
+func ParseBinary(p []byte, rec *Record) error {
+	if len(p) < BinaryLength {
+		return errors.New("record: short binary record")
+	}
+	var imei [IMEILength]byte
+	for i, b := range p[:IMEILength] {
+		if b > 9 {
+			return errors.New("record: imei should be decimal number (0-9)")
+		}
+		// add 48 to get ASCII code of decimal number
+		imei[i] = b + 48
+	}
+	rec.IMEI = string(imei[:])
+	rec.Time = int64(binary.BigEndian.Uint64(p[IMEILength:]))
+	var vals [5]float64
+	for i := range vals {
+		vals[i] = math.Float64frombits(binary.BigEndian.Uint64(p[IMEILength+8+i*8:]))
+	}
+	rec.setFields(&vals)
+	rec.HasMovement, rec.Speed, rec.Heading, rec.Moving = false, 0, 0, false
+	if len(p) >= BinaryMovementLength {
+		rec.HasMovement = true
+		rec.Speed = math.Float64frombits(binary.BigEndian.Uint64(p[BinaryLength:]))
+		rec.Heading = math.Float64frombits(binary.BigEndian.Uint64(p[BinaryLength+8:]))
+		rec.Moving = p[BinaryLength+16] != 0
+	}
+	return nil
+}
+
+// ParseCSV parses CSV record line (without newline) to rec
+func ParseCSV(line []byte, rec *Record) error {
+	cols := bytes.Split(line, []byte{','})
+	if len(cols) != 2+len(fieldNames) && len(cols) != 2+len(fieldNames)+3 {
+		return errors.New("record: wrong number of CSV columns")
+	}
+	t, err := strconv.ParseInt(string(cols[0]), 10, 64)
+	if err != nil {
+		return errors.New("record: wrong time")
+	}
+	var vals [5]float64
+	for i := range vals {
+		if vals[i], err = strconv.ParseFloat(string(cols[2+i]), 64); err != nil {
+			return errors.New("record: wrong " + fieldNames[i])
+		}
+	}
+	var mv Record
+	if len(cols) > 2+len(fieldNames) {
+		mov := cols[2+len(fieldNames):]
+		mv.HasMovement = true
+		if mv.Speed, err = strconv.ParseFloat(string(mov[0]), 64); err != nil {
+			return errors.New("record: wrong Speed")
+		}
+		if mv.Heading, err = strconv.ParseFloat(string(mov[1]), 64); err != nil {
+			return errors.New("record: wrong Heading")
+		}
+		if mv.Moving, err = strconv.ParseBool(string(mov[2])); err != nil {
+			return errors.New("record: wrong Moving")
+		}
+	}
+	rec.Time = t
+	rec.IMEI = string(cols[1])
+	rec.setFields(&vals)
+	rec.HasMovement, rec.Speed, rec.Heading, rec.Moving = mv.HasMovement, mv.Speed, mv.Heading, mv.Moving
+	return nil
+}
+
+// ndjsonRecord NDJSON record
+type ndjsonRecord struct {
+	Time    *int64   `json:"time"`
+	IMEI    string   `json:"imei"`
+	Temp    *float64 `json:"Temp"`
+	Alt     *float64 `json:"Alt"`
+	Lat     *float64 `json:"Lat"`
+	Lon     *float64 `json:"Lon"`
+	BattLev *float64 `json:"BattLev"`
+	Speed   *float64 `json:"Speed"`
+	Heading *float64 `json:"Heading"`
+	Moving  *bool    `json:"Moving"`
+}
+
+// ParseNDJSON parses NDJSON record line to rec
+func ParseNDJSON(line []byte, rec *Record) error {
+	nr := ndjsonRecord{}
+	if err := json.Unmarshal(line, &nr); err != nil {
+		return err
+	}
+	if nr.Time == nil || nr.Temp == nil || nr.Alt == nil || nr.Lat == nil || nr.Lon == nil || nr.BattLev == nil {
+		return errors.New("record: missing NDJSON record fields")
+	}
+	*rec = Record{Time: *nr.Time, IMEI: nr.IMEI, Temp: *nr.Temp, Alt: *nr.Alt, Lat: *nr.Lat, Lon: *nr.Lon, BattLev: *nr.BattLev}
+	if nr.Speed != nil || nr.Heading != nil || nr.Moving != nil {
+		if nr.Speed == nil || nr.Heading == nil || nr.Moving == nil {
+			return errors.New("record: missing NDJSON record movement fields")
+		}
+		rec.HasMovement, rec.Speed, rec.Heading, rec.Moving = true, *nr.Speed, *nr.Heading, *nr.Moving
+	}
+	return nil
+}
+
+// ParseInflux parses InfluxDB line protocol record line (as written by AppendInflux) to rec
+func ParseInflux(line []byte, rec *Record) error {
+	parts := bytes.Split(line, []byte{' '})
+	if len(parts) != 3 || !bytes.HasPrefix(parts[0], []byte("reading,imei=")) {
+		return errors.New("record: wrong influx record")
+	}
+	t, err := strconv.ParseInt(string(parts[2]), 10, 64)
+	if err != nil {
+		return errors.New("record: wrong time")
+	}
+	var vals [5]float64
+	var set [5]bool
+	var mv Record
+	var movSet int
+	for _, kv := range bytes.Split(parts[1], []byte{','}) {
+		i := bytes.IndexByte(kv, '=')
+		if i < 0 {
+			return errors.New("record: wrong influx field")
+		}
+		switch string(kv[:i]) {
+		case "Speed":
+			mv.Speed, err = strconv.ParseFloat(string(kv[i+1:]), 64)
+		case "Heading":
+			mv.Heading, err = strconv.ParseFloat(string(kv[i+1:]), 64)
+		case "Moving":
+			mv.Moving, err = strconv.ParseBool(string(kv[i+1:]))
+		default:
+			err = errMovementField
+		}
+		if err == nil {
+			movSet++
+			continue
+		} else if err != errMovementField {
+			return errors.New("record: wrong " + string(kv[:i]))
+		}
+		f := -1
+		for j, name := range fieldNames {
+			if string(kv[:i]) == name {
+				f = j
+			}
+		}
+		if f < 0 {
+			continue
+		}
+		if vals[f], err = strconv.ParseFloat(string(kv[i+1:]), 64); err != nil {
+			return errors.New("record: wrong " + fieldNames[f])
+		}
+		set[f] = true
+	}
+	for f, ok := range set {
+		if !ok {
+			return errors.New("record: missing " + fieldNames[f])
+		}
+	}
+	if movSet != 0 && movSet != 3 {
+		return errors.New("record: missing influx record movement fields")
+	}
+	rec.Time = t
+	rec.IMEI = string(parts[0][len("reading,imei="):])
+	rec.setFields(&vals)
+	rec.HasMovement, rec.Speed, rec.Heading, rec.Moving = movSet == 3, mv.Speed, mv.Heading, mv.Moving
+	return nil
+}
@@ -0,0 +1,206 @@
+// Package record implements encoders and decoders of server output records of thermometer readings.
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// IMEILength length of device IMEI
+const IMEILength = 15
+
+// BinaryLength length of binary record payload: IMEI, time (int64), Temp, Alt, Lat, Lon, BattLev (float64)
+const BinaryLength = IMEILength + 8 + 5*8
+
+// BinaryMovementLength length of binary record payload with movement: Speed, Heading (float64), Moving (byte)
+const BinaryMovementLength = BinaryLength + 2*8 + 1
+
+// Record output record of device reading
+type Record struct {
+	// receive time (unix nano)
+	Time int64
+	IMEI string
+
+	Temp    float64
+	Alt     float64
+	Lat     float64
+	Lon     float64
+	BattLev float64
+
+	// movement of device (optional columns, written if HasMovement):
+	// speed (m/s), heading (degrees clockwise from north), moving or stationary
+	HasMovement bool
+	Speed       float64
+	Heading     float64
+	Moving      bool
+}
+
+// Format output record format
+type Format int
+
+// record formats
+const (
+	// CSV spec format "time,imei,temp,alt,lat,lon,battlev\n", floats with 6 decimals
+	// (",speed,heading,moving" appended with movement)
+	CSV Format = iota
+	// NDJSON object per line {"time":..,"imei":"..","Temp":..,"Alt":..,"Lat":..,"Lon":..,"BattLev":..}
+	// (,"Speed":..,"Heading":..,"Moving":.. appended with movement)
+	NDJSON
+	// Binary length-prefixed record: payload length (uint16 Big-Endian), payload of BinaryLength bytes
+	// (IMEI digits 0-9, time, fields Big-Endian, same layout as binary ingest frame),
+	// payload of BinaryMovementLength bytes with movement
+	Binary
+	// Influx InfluxDB line protocol "reading,imei=.. Temp=..,Alt=..,Lat=..,Lon=..,BattLev=.. time\n"
+	// (,Speed=..,Heading=..,Moving=.. appended to fields with movement)
+	Influx
+)
+
+// names of formats
+var formatNames = [...]string{
+	CSV:    "csv",
+	NDJSON: "ndjson",
+	Binary: "binary",
+	Influx: "influx",
+}
+
+// String returns name of format
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return "Format(" + strconv.Itoa(int(f)) + ")"
+	}
+	return formatNames[f]
+}
+
+// ParseFormat returns format by name
+func ParseFormat(name string) (Format, error) {
+	for f, n := range formatNames {
+		if n == name {
+			return Format(f), nil
+		}
+	}
+	return 0, errors.New("record: unknown format " + name)
+}
+
+// fields names of record
+var fieldNames = [5]string{"Temp", "Alt", "Lat", "Lon", "BattLev"}
+
+// fields returns fields values of record
+func (r *Record) fields() [5]float64 {
+	return [5]float64{r.Temp, r.Alt, r.Lat, r.Lon, r.BattLev}
+}
+
+// setFields sets fields values of record
+func (r *Record) setFields(vals *[5]float64) {
+	r.Temp, r.Alt, r.Lat, r.Lon, r.BattLev = vals[0], vals[1], vals[2], vals[3], vals[4]
+}
+
+// Append appends record of format to dst
+func Append(dst []byte, f Format, r *Record) []byte {
+	switch f {
+	case NDJSON:
+		return AppendNDJSON(dst, r)
+	case Binary:
+		return AppendBinary(dst, r)
+	case Influx:
+		return AppendInflux(dst, r)
+	default:
+		return AppendCSV(dst, r)
+	}
+}
+
+// AppendCSV appends CSV record to dst
+func AppendCSV(dst []byte, r *Record) []byte {
+	dst = strconv.AppendInt(dst, r.Time, 10)
+	dst = append(dst, ',')
+	dst = append(dst, r.IMEI...)
+	for _, v := range r.fields() {
+		dst = append(dst, ',')
+		dst = strconv.AppendFloat(dst, v, 'f', 6, 64)
+	}
+	if r.HasMovement {
+		dst = append(dst, ',')
+		dst = strconv.AppendFloat(dst, r.Speed, 'f', 6, 64)
+		dst = append(dst, ',')
+		dst = strconv.AppendFloat(dst, r.Heading, 'f', 6, 64)
+		dst = append(dst, ',')
+		dst = strconv.AppendBool(dst, r.Moving)
+	}
+	return append(dst, '\n')
+}
+
+// AppendNDJSON appends NDJSON record to dst
+func AppendNDJSON(dst []byte, r *Record) []byte {
+	dst = append(dst, `{"time":`...)
+	dst = strconv.AppendInt(dst, r.Time, 10)
+	dst = append(dst, `,"imei":"`...)
+	dst = append(dst, r.IMEI...)
+	dst = append(dst, '"')
+	for i, v := range r.fields() {
+		dst = append(dst, `,"`...)
+		dst = append(dst, fieldNames[i]...)
+		dst = append(dst, `":`...)
+		dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+	}
+	if r.HasMovement {
+		dst = append(dst, `,"Speed":`...)
+		dst = strconv.AppendFloat(dst, r.Speed, 'g', -1, 64)
+		dst = append(dst, `,"Heading":`...)
+		dst = strconv.AppendFloat(dst, r.Heading, 'g', -1, 64)
+		dst = append(dst, `,"Moving":`...)
+		dst = strconv.AppendBool(dst, r.Moving)
+	}
+	return append(dst, "}\n"...)
+}
+
+// AppendBinary appends binary record to dst (IMEI expected of IMEILength decimal chars)
+func AppendBinary(dst []byte, r *Record) []byte {
+	var b [2 + BinaryMovementLength]byte
+	n := BinaryLength
+	if r.HasMovement {
+		n = BinaryMovementLength
+		binary.BigEndian.PutUint64(b[2+BinaryLength:], math.Float64bits(r.Speed))
+		binary.BigEndian.PutUint64(b[2+BinaryLength+8:], math.Float64bits(r.Heading))
+		if r.Moving {
+			b[2+BinaryLength+16] = 1
+		}
+	}
+	binary.BigEndian.PutUint16(b[:2], uint16(n))
+	for i := 0; i < IMEILength && i < len(r.IMEI); i++ {
+		// subtract 48 to get decimal number of ASCII code
+		b[2+i] = r.IMEI[i] - 48
+	}
+	binary.BigEndian.PutUint64(b[2+IMEILength:], uint64(r.Time))
+	for i, v := range r.fields() {
+		binary.BigEndian.PutUint64(b[2+IMEILength+8+i*8:], math.Float64bits(v))
+	}
+	return append(dst, b[:2+n]...)
+}
+
+// AppendInflux appends InfluxDB line protocol record to dst
+func AppendInflux(dst []byte, r *Record) []byte {
+	dst = append(dst, "reading,imei="...)
+	dst = append(dst, r.IMEI...)
+	for i, v := range r.fields() {
+		if i == 0 {
+			dst = append(dst, ' ')
+		} else {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, fieldNames[i]...)
+		dst = append(dst, '=')
+		dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+	}
+	if r.HasMovement {
+		dst = append(dst, ",Speed="...)
+		dst = strconv.AppendFloat(dst, r.Speed, 'g', -1, 64)
+		dst = append(dst, ",Heading="...)
+		dst = strconv.AppendFloat(dst, r.Heading, 'g', -1, 64)
+		dst = append(dst, ",Moving="...)
+		dst = strconv.AppendBool(dst, r.Moving)
+	}
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, r.Time, 10)
+	return append(dst, '\n')
+}
@@ -0,0 +1,171 @@
+package record
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// records of golden files
+var testRecords = []Record{
+	{Time: 1257894000000000000, IMEI: "490154203237518"},
+	{Time: 1257894000000000001, IMEI: "490154203237518", Temp: 67.77, Alt: -0.5, Lat: 89.9999999, Lon: -180, BattLev: 100},
+	{Time: 1576833027211679121, IMEI: "490154203237526", Temp: -300, Alt: 20000, Lat: -90, Lon: 179.123456, BattLev: 0.25},
+	{Time: 1576833027211679122, IMEI: "490154203237534", Temp: 1e-7, Alt: 1e21, Lat: 1.0000005, Lon: math.SmallestNonzeroFloat64, BattLev: 1},
+	{Time: 1576833027211679123, IMEI: "490154203237542", Temp: 21.5, Alt: 120, Lat: 55.75, Lon: 37.61, BattLev: 80,
+		HasMovement: true, Speed: 12.25, Heading: 271.5, Moving: true},
+}
+
+func Test_Append_golden(t *testing.T) {
+
+	testCases := []struct {
+		format Format
+		golden string
+		// decoded records equal to encoded (CSV rounds to 6 decimals)
+		exact bool
+	}{
+		{format: CSV, golden: "records.csv"},
+		{format: NDJSON, golden: "records.ndjson", exact: true},
+		{format: Binary, golden: "records.bin", exact: true},
+		{format: Influx, golden: "records.influx", exact: true},
+	}
+
+	for _, tc := range testCases {
+
+		var out []byte
+		for i := range testRecords {
+			out = Append(out, tc.format, &testRecords[i])
+		}
+		path := filepath.Join("testdata", tc.golden)
+		if *update {
+			if err := ioutil.WriteFile(path, out, 0644); err != nil {
+				t.Fatalf("%v: golden file write err: %v", tc.format, err)
+			}
+		}
+		golden, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v: golden file read err: %v", tc.format, err)
+		}
+		if !bytes.Equal(out, golden) {
+			t.Fatalf("%v: records not equal golden file\n%q\n%q", tc.format, out, golden)
+		}
+
+		// decode golden file
+		dec := NewDecoder(bytes.NewReader(golden), tc.format)
+		for i := range testRecords {
+			rec := Record{}
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatalf("%v: record %v decode err: %v", tc.format, i, err)
+			}
+			exp := testRecords[i]
+			if !tc.exact {
+				var enc Record
+				if err := ParseCSV(bytes.TrimSuffix(AppendCSV(nil, &exp), []byte{'\n'}), &enc); err != nil {
+					t.Fatalf("%v: record %v parse err: %v", tc.format, i, err)
+				}
+				exp = enc
+			}
+			if rec != exp {
+				t.Fatalf("%v: record %v expected %+v, got %+v", tc.format, i, exp, rec)
+			}
+		}
+		if err := dec.Decode(&Record{}); err != io.EOF {
+			t.Fatalf("%v: expected EOF, got %v", tc.format, err)
+		}
+		t.Logf("%v: test ok", tc.format)
+	}
+}
+
+func Test_AppendCSV(t *testing.T) {
+
+	// spec record format of server output
+	for _, r := range testRecords {
+		exp := fmt.Sprintf("%v,%s,%f,%f,%f,%f,%f", r.Time, r.IMEI, r.Temp, r.Alt, r.Lat, r.Lon, r.BattLev)
+		if r.HasMovement {
+			exp += fmt.Sprintf(",%f,%f,%v", r.Speed, r.Heading, r.Moving)
+		}
+		exp += "\n"
+		if got := string(AppendCSV(nil, &r)); got != exp {
+			t.Fatalf("expected record %q, got %q", exp, got)
+		}
+	}
+}
+
+func Test_Append_Allocs(t *testing.T) {
+
+	buf := make([]byte, 0, 1024)
+	for f := range formatNames {
+		allocs := testing.AllocsPerRun(1000, func() {
+			buf = Append(buf[:0], Format(f), &testRecords[1])
+			buf = Append(buf[:0], Format(f), &testRecords[4])
+		})
+		if allocs != 0 {
+			t.Fatalf("%v: encoder should not allocate, got %v allocs", Format(f), allocs)
+		}
+	}
+}
+
+func Test_Decoder_Decode(t *testing.T) {
+
+	bin := AppendBinary(nil, &testRecords[1])
+	// binary record with extended payload
+	binExt := append([]byte{0, BinaryLength + 2}, bin[2:]...)
+	binExt = append(binExt, 0xff, 0xff)
+	mov := AppendBinary(nil, &testRecords[4])
+	movExt := append([]byte{0, BinaryMovementLength + 2}, mov[2:]...)
+	movExt = append(movExt, 0xff, 0xff)
+
+	testCases := []struct {
+		name   string
+		format Format
+		input  []byte
+		err    bool
+	}{
+		// Positive
+		{name: "binary, extended payload", format: Binary, input: binExt},
+		{name: "binary, movement extended payload", format: Binary, input: movExt},
+		{name: "csv, movement columns", format: CSV, input: []byte("1,490154203237518,0,0,0,0,0,1.5,90,true\n")},
+		{name: "ndjson, unknown keys", format: NDJSON, input: []byte(`{"time":1,"imei":"490154203237518","Temp":0,"Alt":0,"Lat":0,"Lon":0,"BattLev":1,"x":1}` + "\n")},
+		// Negative
+		{name: "csv, wrong columns", format: CSV, input: []byte("1,490154203237518,0.000000\n"), err: true},
+		{name: "csv, wrong float", format: CSV, input: []byte("1,490154203237518,a,0,0,0,0\n"), err: true},
+		{name: "csv, no newline", format: CSV, input: []byte("1,490154203237518,0,0,0,0,0"), err: true},
+		{name: "csv, wrong movement", format: CSV, input: []byte("1,490154203237518,0,0,0,0,0,1.5,90,yes\n"), err: true},
+		{name: "ndjson, partial movement", format: NDJSON, input: []byte(`{"time":1,"imei":"490154203237518","Temp":0,"Alt":0,"Lat":0,"Lon":0,"BattLev":1,"Speed":1}` + "\n"), err: true},
+		{name: "influx, partial movement", format: Influx, input: []byte("reading,imei=490154203237518 Temp=0,Alt=0,Lat=0,Lon=0,BattLev=1,Moving=true 1\n"), err: true},
+		{name: "ndjson, missing field", format: NDJSON, input: []byte(`{"time":1,"imei":"490154203237518","Temp":0}` + "\n"), err: true},
+		{name: "influx, missing field", format: Influx, input: []byte("reading,imei=490154203237518 Temp=1 1\n"), err: true},
+		{name: "influx, wrong measurement", format: Influx, input: []byte("temp,imei=490154203237518 Temp=1 1\n"), err: true},
+		{name: "binary, short length", format: Binary, input: []byte{0, 1, 0}, err: true},
+		{name: "binary, partial record", format: Binary, input: bin[:20], err: true},
+		{name: "binary, wrong imei", format: Binary, input: append([]byte{0, BinaryLength, 'a'}, bin[3:]...), err: true},
+	}
+
+	for _, tc := range testCases {
+
+		err := NewDecoder(bytes.NewReader(tc.input), tc.format).Decode(&Record{})
+		if tc.err != (err != nil) {
+			t.Fatalf("%v: expected err %v, got %v", tc.name, tc.err, err)
+		}
+		t.Logf("%v: test ok", tc.name)
+	}
+}
+
+func Test_ParseFormat(t *testing.T) {
+
+	for f, name := range formatNames {
+		if got, err := ParseFormat(name); err != nil || got != Format(f) || got.String() != name {
+			t.Fatalf("expected format %v, got %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Fatalf("expected unknown format err")
+	}
+}